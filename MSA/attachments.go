@@ -0,0 +1,198 @@
+/*
+attachments.go handles the multipart emails
+An email can be submitted either as JSON, or as multipart/form-data with the
+fields of the email and any number of files, which become its attachments
+The parts of a multipart submission are read one at a time as they arrive,
+rather than parsing the whole form at once
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxMessageSize is the maximum size of an email submitted to the MSA
+const maxMessageSize = 25 << 20
+
+// maxFieldSize is the maximum size of a text field of a multipart submission
+const maxFieldSize = 1 << 20
+
+var errFieldTooLarge = errors.New("multipart field too large")
+
+// htmlTags matches the tags of an HTML document, to extract its text
+var htmlTags = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// htmlText extracts the text of an HTML body, for indexing
+func htmlText(html string) string {
+	return htmlTags.ReplaceAllString(html, " ")
+}
+
+// isMultipart tells whether a request was sent as multipart/form-data
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// readMultipartEmail reads an email submitted as multipart/form-data. The
+// fields from, to, subject, body, html and inreplyto fill the email, and
+// every file is attached to it
+func readMultipartEmail(r *http.Request) (EMail, error) {
+	var email EMail
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return email, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return email, nil
+		} else if err != nil {
+			return email, err
+		}
+
+		if part.FileName() != "" {
+			id := strconv.Itoa(len(email.Attachments) + 1)
+
+			attachment, err := readAttachment(part, id)
+			if err != nil {
+				return email, err
+			}
+
+			email.Attachments = append(email.Attachments, attachment)
+			continue
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize+1))
+		if err != nil {
+			return email, err
+		} else if len(value) > maxFieldSize {
+			return email, errFieldTooLarge
+		}
+
+		switch strings.ToLower(part.FormName()) {
+		case "from":
+			email.From = string(value)
+		case "to":
+			email.To = string(value)
+		case "subject":
+			email.Subject = string(value)
+		case "body":
+			email.Body = string(value)
+		case "html":
+			email.HTML = string(value)
+		case "inreplyto":
+			email.InReplyTo = string(value)
+		case "sendat":
+			if email.SendAt, err = time.Parse(time.RFC3339, string(value)); err != nil {
+				return email, err
+			}
+		}
+	}
+}
+
+// normalizeAttachments numbers the attachments of an email submitted as JSON,
+// and fills in the details the client left out
+func normalizeAttachments(email *EMail) {
+	for i := range email.Attachments {
+		attachment := &email.Attachments[i]
+
+		attachment.ID = strconv.Itoa(i + 1)
+		attachment.Size = len(attachment.Data)
+
+		if attachment.TransferEncoding == "" {
+			attachment.TransferEncoding = "base64"
+		}
+		if attachment.ContentType == "" {
+			attachment.ContentType = http.DetectContentType(attachment.Data)
+		}
+	}
+}
+
+// readAttachment reads a file of a multipart submission. Its content type is
+// taken from the part, guessed from the file name, or detected from the data
+func readAttachment(part *multipart.Part, id string) (Attachment, error) {
+	var data bytes.Buffer
+
+	if _, err := io.Copy(&data, part); err != nil {
+		return Attachment{}, err
+	}
+
+	attachment := Attachment{
+		ID:               id,
+		Filename:         part.FileName(),
+		ContentType:      part.Header.Get("Content-Type"),
+		TransferEncoding: "base64",
+		Size:             data.Len(),
+		Data:             data.Bytes(),
+	}
+
+	// Browsers send application/octet-stream when they don't know better
+	if attachment.ContentType == "" ||
+		attachment.ContentType == "application/octet-stream" {
+		attachment.ContentType = mime.TypeByExtension(filepath.Ext(attachment.Filename))
+	}
+	if attachment.ContentType == "" {
+		attachment.ContentType = http.DetectContentType(attachment.Data)
+	}
+
+	return attachment, nil
+}
+
+// MSAAttachment gets called from the handleRequests method
+// It sends back the content of one attachment of an email
+func MSAAttachment(folder string) func(w http.ResponseWriter, r *http.Request) {
+
+	// This is so that we can pass in an argument (folder)
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+
+		email, err := readEmail(folder, vars["uuid"])
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
+
+		for _, attachment := range email.Attachments {
+			if attachment.ID != vars["id"] {
+				continue
+			}
+
+			disposition := mime.FormatMediaType("attachment",
+				map[string]string{"filename": attachment.Filename})
+
+			w.Header().Set("Content-Type", attachment.ContentType)
+			w.Header().Set("Content-Disposition", disposition)
+			w.Header().Set("Content-Length", strconv.Itoa(len(attachment.Data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(attachment.Data)
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// MSAAttachmentInFolder sends back one attachment of an email of the folder
+// given in the URL
+func MSAAttachmentInFolder(w http.ResponseWriter, r *http.Request) {
+	MSAAttachment(mux.Vars(r)["folder"])(w, r)
+}
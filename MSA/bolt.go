@@ -0,0 +1,385 @@
+/*
+bolt.go stores the mailbox in an embedded bbolt database
+Every change to the mailbox is a single transaction, so that the mailbox is
+never left half updated by a crash. The emails are kept in one bucket, the
+folder, flags and modification time of each email in another one, and the
+secondary index by folder lets a folder be listed, renamed or deleted
+without going through the whole mailbox
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MAILBOXDB is the database file of the mailbox with the bolt storage
+const MAILBOXDB = "Mailbox.db"
+
+var (
+	// emailsBucket maps the UUID of an email to the email as JSON
+	emailsBucket = []byte("emails")
+	// entriesBucket maps the UUID of an email to its boltEntry as JSON
+	entriesBucket = []byte("entries")
+	// foldersBucket holds the names of the user folders
+	foldersBucket = []byte("folders")
+	// byFolderBucket indexes the emails by folder, its keys are the folder and
+	// the UUID of each email separated by a zero byte
+	byFolderBucket = []byte("byfolder")
+)
+
+// boltEntry is the state of an email in the mailbox
+type boltEntry struct {
+	Folder  string
+	Flags   Flags
+	ModTime time.Time
+}
+
+// boltMailbox stores the mailbox in a bbolt database
+type boltMailbox struct {
+	db *bolt.DB
+}
+
+// openBoltMailbox opens the database at path, creating it if needed
+func openBoltMailbox(path string) (*boltMailbox, error) {
+	db, err := bolt.Open(path, 0755, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltMailbox{db}, nil
+}
+
+// folderKey returns the key of an email in the index by folder
+func folderKey(folder string, id string) []byte {
+	return []byte(folder + "\x00" + id)
+}
+
+// folderIDs lists the UUIDs of the emails of a folder from the index
+func folderIDs(tx *bolt.Tx, folder string) []string {
+	var ids []string
+
+	prefix := folderKey(folder, "")
+	cursor := tx.Bucket(byFolderBucket).Cursor()
+
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		ids = append(ids, string(key[len(prefix):]))
+	}
+
+	return ids
+}
+
+// checkFolder checks the folder exists within a transaction
+func (m *boltMailbox) checkFolder(tx *bolt.Tx, folder string) error {
+	if isSystemFolder(folder) {
+		return nil
+	} else if !validFolderName(folder) {
+		return errInvalidFolder
+	} else if tx.Bucket(foldersBucket).Get([]byte(folder)) == nil {
+		return notExist(folder)
+	}
+
+	return nil
+}
+
+// entry reads the state of an email, which has to be in the folder
+func (m *boltMailbox) entry(tx *bolt.Tx, folder string, id string) (boltEntry, error) {
+	var entry boltEntry
+
+	if err := m.checkFolder(tx, folder); err != nil {
+		return entry, err
+	}
+
+	data := tx.Bucket(entriesBucket).Get([]byte(id))
+	if data == nil {
+		return entry, notExist(folder + "/" + id)
+	}
+
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, err
+	}
+
+	if entry.Folder != folder {
+		return entry, notExist(folder + "/" + id)
+	}
+
+	return entry, nil
+}
+
+// putEntry stores the state of an email, and indexes it in its folder
+func putEntry(tx *bolt.Tx, id string, entry boltEntry) error {
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Bucket(entriesBucket).Put([]byte(id), entryJSON); err != nil {
+		return err
+	}
+
+	return tx.Bucket(byFolderBucket).Put(folderKey(entry.Folder, id), nil)
+}
+
+// deleteEntry removes an email from the mailbox
+func deleteEntry(tx *bolt.Tx, id string, entry boltEntry) error {
+	if err := tx.Bucket(byFolderBucket).Delete(folderKey(entry.Folder, id)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(entriesBucket).Delete([]byte(id)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(emailsBucket).Delete([]byte(id))
+}
+
+// Close closes the database
+func (m *boltMailbox) Close() error {
+	return m.db.Close()
+}
+
+func (m *boltMailbox) Init() error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{emailsBucket, entriesBucket,
+			foldersBucket, byFolderBucket} {
+
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (m *boltMailbox) Folders() ([]string, error) {
+	var names []string
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(foldersBucket).ForEach(func(name []byte, _ []byte) error {
+			names = append(names, string(name))
+			return nil
+		})
+	})
+
+	return names, err
+}
+
+func (m *boltMailbox) CheckFolder(folder string) error {
+	return m.db.View(func(tx *bolt.Tx) error {
+		return m.checkFolder(tx, folder)
+	})
+}
+
+func (m *boltMailbox) CreateFolder(folder string) error {
+	if !validFolderName(folder) {
+		return errInvalidFolder
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		folders := tx.Bucket(foldersBucket)
+
+		if folders.Get([]byte(folder)) != nil {
+			return errFolderExists
+		}
+
+		return folders.Put([]byte(folder), []byte{})
+	})
+}
+
+func (m *boltMailbox) RenameFolder(folder string, name string) error {
+	if !validFolderName(name) {
+		return errInvalidFolder
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if err := m.checkFolder(tx, folder); err != nil {
+			return err
+		}
+
+		folders := tx.Bucket(foldersBucket)
+		if folders.Get([]byte(name)) != nil {
+			return errFolderExists
+		}
+
+		for _, id := range folderIDs(tx, folder) {
+			entry, err := m.entry(tx, folder, id)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Bucket(byFolderBucket).Delete(folderKey(folder, id)); err != nil {
+				return err
+			}
+
+			entry.Folder = name
+			if err := putEntry(tx, id, entry); err != nil {
+				return err
+			}
+		}
+
+		if err := folders.Delete([]byte(folder)); err != nil {
+			return err
+		}
+
+		return folders.Put([]byte(name), []byte{})
+	})
+}
+
+func (m *boltMailbox) DeleteFolder(folder string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if err := m.checkFolder(tx, folder); err != nil {
+			return err
+		}
+
+		for _, id := range folderIDs(tx, folder) {
+			entry, err := m.entry(tx, folder, id)
+			if err != nil {
+				return err
+			}
+
+			if err := deleteEntry(tx, id, entry); err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(foldersBucket).Delete([]byte(folder))
+	})
+}
+
+func (m *boltMailbox) IDs(folder string) ([]string, error) {
+	var ids []string
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		if err := m.checkFolder(tx, folder); err != nil {
+			return err
+		}
+
+		ids = folderIDs(tx, folder)
+
+		return nil
+	})
+
+	return ids, err
+}
+
+func (m *boltMailbox) Read(folder string, id string) (EMail, error) {
+	var email EMail
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		if _, err := m.entry(tx, folder, id); err != nil {
+			return err
+		}
+
+		return json.Unmarshal(tx.Bucket(emailsBucket).Get([]byte(id)), &email)
+	})
+
+	return email, err
+}
+
+// Write stores the email in the folder. An email of the same UUID in another
+// folder is refused, as with the other storages
+func (m *boltMailbox) Write(folder string, email EMail) error {
+	id := email.UUID.String()
+
+	emailJSON, err := json.Marshal(email)
+	if err != nil {
+		return err
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if err := m.checkFolder(tx, folder); err != nil {
+			return err
+		}
+
+		var entry boltEntry
+
+		if data := tx.Bucket(entriesBucket).Get([]byte(id)); data != nil {
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			} else if entry.Folder != folder {
+				return errEmailExists
+			}
+		}
+
+		entry.Folder = folder
+		entry.ModTime = time.Now()
+
+		if err := tx.Bucket(emailsBucket).Put([]byte(id), emailJSON); err != nil {
+			return err
+		}
+
+		return putEntry(tx, id, entry)
+	})
+}
+
+func (m *boltMailbox) Remove(folder string, id string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		entry, err := m.entry(tx, folder, id)
+		if err != nil {
+			return err
+		}
+
+		return deleteEntry(tx, id, entry)
+	})
+}
+
+func (m *boltMailbox) Move(from string, to string, id string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		entry, err := m.entry(tx, from, id)
+		if err != nil {
+			return err
+		}
+
+		if err := m.checkFolder(tx, to); err != nil {
+			return err
+		}
+
+		if err := tx.Bucket(byFolderBucket).Delete(folderKey(from, id)); err != nil {
+			return err
+		}
+
+		entry.Folder = to
+		entry.ModTime = time.Now()
+
+		return putEntry(tx, id, entry)
+	})
+}
+
+func (m *boltMailbox) ModTime(folder string, id string) (time.Time, error) {
+	var entry boltEntry
+
+	err := m.db.View(func(tx *bolt.Tx) (err error) {
+		entry, err = m.entry(tx, folder, id)
+		return err
+	})
+
+	return entry.ModTime, err
+}
+
+func (m *boltMailbox) ReadFlags(folder string, id string) (Flags, error) {
+	var entry boltEntry
+
+	err := m.db.View(func(tx *bolt.Tx) (err error) {
+		entry, err = m.entry(tx, folder, id)
+		return err
+	})
+
+	return entry.Flags, err
+}
+
+func (m *boltMailbox) WriteFlags(folder string, id string, flags Flags) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		entry, err := m.entry(tx, folder, id)
+		if err != nil {
+			return err
+		}
+
+		entry.Flags = flags
+
+		return putEntry(tx, id, entry)
+	})
+}
@@ -0,0 +1,329 @@
+/*
+compose.go builds replies and forwards of the emails of the mailbox
+A reply goes to the Reply-To of the email, or to its sender, and a reply to
+all also goes to the other recipients of the email, in Cc. Each recipient
+gets a copy of its own in the outbox, as the MTA only delivers an email to
+its To: the Cc header only shows who else got it. Replies quote the email
+they answer, and are threaded with it through In-Reply-To and References
+A forward quotes the email with its headers and keeps its attachments, or
+attaches the whole email as message/rfc822
+The new email is placed in the outbox, and the original email is flagged as
+answered or forwarded
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// forwarded is the keyword of the emails which were forwarded
+const forwarded = "$Forwarded"
+
+// Kinds of the emails composed from another one
+const (
+	composeReply    = "reply"
+	composeReplyAll = "reply-all"
+	composeForward  = "forward"
+)
+
+var errNoRecipient = errors.New("missing recipient")
+
+// ComposeRequest struct representing the text the user adds to a reply or a
+// forward. To is the recipient of a forward, Attach tells whether a forward
+// keeps the attachments ("inline", the default) or attaches the whole email
+// ("rfc822")
+type ComposeRequest struct {
+	To     string
+	Body   string
+	HTML   string
+	Attach string
+	SendAt time.Time
+}
+
+// prefixSubject adds a prefix to a subject, unless it already starts with it
+func prefixSubject(prefix string, subject string) string {
+	if strings.HasPrefix(strings.ToLower(strings.TrimSpace(subject)),
+		strings.ToLower(prefix)) {
+		return subject
+	}
+
+	return prefix + " " + subject
+}
+
+// quoteText quotes the lines of a text, for a reply
+func quoteText(text string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ">") {
+			lines[i] = ">" + line
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// htmlBody returns the HTML of the text the user added, converting the plain
+// text if there is no HTML
+func htmlBody(request ComposeRequest) string {
+	if request.HTML != "" {
+		return request.HTML
+	}
+
+	return strings.Replace(html.EscapeString(request.Body), "\n", "<br>\n", -1)
+}
+
+// replyRecipients returns the recipient of a reply, and the other recipients
+// of a reply to all
+func replyRecipients(original EMail, all bool) (string, []string) {
+	to := original.From
+	if replyTo := emailHeader(original, "Reply-To"); replyTo != nil {
+		to = replyTo[0]
+	}
+
+	addresses := parseAddressList(to)
+	if len(addresses) == 0 {
+		return "", nil
+	}
+	to = addresses[0]
+
+	if !all {
+		return to, nil
+	}
+
+	// Every other recipient, but the user and the main recipient, only once
+	seen := map[string]bool{strings.ToLower(to): true,
+		strings.ToLower(self.Name): true}
+	var cc []string
+
+	candidates := append(parseAddressList(original.From), parseAddressList(original.To)...)
+	if others := emailHeader(original, "Cc"); others != nil {
+		candidates = append(candidates, parseAddressList(others[0])...)
+	}
+
+	for _, address := range candidates {
+		if !seen[strings.ToLower(address)] {
+			seen[strings.ToLower(address)] = true
+			cc = append(cc, address)
+		}
+	}
+
+	return to, cc
+}
+
+// composeReplyEmail builds a reply to an email
+func composeReplyEmail(original EMail, request ComposeRequest, all bool) (EMail, error) {
+	to, cc := replyRecipients(original, all)
+	if to == "" {
+		return EMail{}, errNoRecipient
+	}
+
+	attribution := "On " + original.Date.Format(time.RFC1123Z) + ", " +
+		original.From + " wrote:"
+
+	reply := EMail{
+		InReplyTo: original.MessageID,
+		From:      self.Name,
+		To:        to,
+		Subject:   prefixSubject("Re:", original.Subject),
+		Body:      request.Body + "\n\n" + attribution + "\n" + quoteText(original.Body) + "\n",
+		SendAt:    request.SendAt,
+	}
+
+	if original.HTML != "" || request.HTML != "" {
+		quoted := original.HTML
+		if quoted == "" {
+			quoted = strings.Replace(html.EscapeString(original.Body), "\n", "<br>\n", -1)
+		}
+
+		reply.HTML = htmlBody(request) + "\n<div>" + html.EscapeString(attribution) +
+			"</div>\n<blockquote type=\"cite\">\n" + quoted + "\n</blockquote>\n"
+	}
+
+	if len(cc) > 0 {
+		reply.Headers = map[string]string{"Cc": strings.Join(cc, ", ")}
+	}
+
+	if original.MessageID != "" {
+		reply.References = append(append([]string{}, original.References...),
+			original.MessageID)
+	}
+
+	return reply, nil
+}
+
+// composeForwardEmail builds a forward of an email. The groups of the address
+// book it is forwarded to are replaced with their members
+func composeForwardEmail(original EMail, request ComposeRequest) (EMail, error) {
+	addresses, err := expandRecipients(request.To)
+	if err != nil {
+		return EMail{}, err
+	} else if len(addresses) == 0 {
+		return EMail{}, errNoRecipient
+	}
+
+	forward := EMail{
+		From:    self.Name,
+		To:      addresses[0],
+		Subject: prefixSubject("Fwd:", original.Subject),
+		Body:    request.Body,
+		SendAt:  request.SendAt,
+	}
+
+	if len(addresses) > 1 {
+		forward.Headers = map[string]string{"Cc": strings.Join(addresses[1:], ", ")}
+	}
+
+	if request.Attach == "rfc822" {
+		raw, err := FormatEMail(original)
+		if err != nil {
+			return forward, err
+		}
+
+		forward.Attachments = []Attachment{{
+			Filename:         normalizeSubject(original.Subject) + ".eml",
+			ContentType:      "message/rfc822",
+			TransferEncoding: "7bit",
+			Data:             raw,
+		}}
+
+		forward.HTML = request.HTML
+		normalizeAttachments(&forward)
+
+		return forward, nil
+	}
+
+	headers := "---------- Forwarded message ----------\n" +
+		"From: " + original.From + "\n" +
+		"Date: " + original.Date.Format(time.RFC1123Z) + "\n" +
+		"Subject: " + original.Subject + "\n" +
+		"To: " + original.To + "\n"
+
+	forward.Body = request.Body + "\n\n" + headers + "\n" + original.Body
+
+	if original.HTML != "" || request.HTML != "" {
+		quoted := original.HTML
+		if quoted == "" {
+			quoted = strings.Replace(html.EscapeString(original.Body), "\n", "<br>\n", -1)
+		}
+
+		forward.HTML = htmlBody(request) + "\n<div>" +
+			strings.Replace(html.EscapeString(headers), "\n", "<br>\n", -1) +
+			"</div>\n" + quoted + "\n"
+	}
+
+	forward.Attachments = append([]Attachment{}, original.Attachments...)
+	normalizeAttachments(&forward)
+
+	return forward, nil
+}
+
+// MSACompose gets called from the handleRequests method
+// It replies to, replies to all or forwards an email of the folder, places
+// the new email in the outbox, a copy for each recipient, and sends back the
+// copy for the main recipient
+func MSACompose(folder string, kind string) func(w http.ResponseWriter, r *http.Request) {
+
+	// This is so that we can pass in arguments (folder and kind)
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["uuid"]
+
+		var request ComposeRequest
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+		if err == nil && len(body) > 0 {
+			err = json.Unmarshal(body, &request)
+		}
+		if err != nil || (request.Attach != "" && request.Attach != "inline" &&
+			request.Attach != "rfc822") {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Printf("Invalid %s request for %s\n", kind, id)
+			return
+		}
+
+		original, err := readEmail(folder, id)
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
+
+		var email EMail
+		if kind == composeForward {
+			email, err = composeForwardEmail(original, request)
+		} else {
+			email, err = composeReplyEmail(original, request, kind == composeReplyAll)
+		}
+
+		if err == errNoRecipient || err == errUnknownGroup {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		if email.UUID, err = uuid.NewUUID(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		// One copy for each recipient, the main one first
+		recipients := []string{email.To}
+		if cc := emailHeader(email, "Cc"); cc != nil {
+			recipients = append(recipients, parseAddressList(cc[0])...)
+		}
+
+		if email, err = queueCopies(email, recipients); err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
+
+		// Flag the original email, the new one is on its way
+		_, err = updateFlags(folder, id, func(flags *Flags) {
+			if kind == composeForward {
+				flags.setKeyword(forwarded, true)
+			} else {
+				flags.Answered = true
+			}
+		})
+		if err != nil {
+			log.Print(err.Error())
+		}
+
+		emailJSON, err := json.Marshal(email)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		log.Println("Sending a " + kind + " to " + email.To + " : " + email.Subject)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(emailJSON)
+	}
+}
+
+// MSAComposeInFolder replies to, replies to all or forwards an email of the
+// folder given in the URL
+func MSAComposeInFolder(kind string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		MSACompose(mux.Vars(r)["folder"], kind)(w, r)
+	}
+}
@@ -0,0 +1,614 @@
+/*
+contacts.go holds the address book of the user
+A contact has a name, any number of addresses, and belongs to groups. The
+addresses the user writes to are collected automatically, so that they can
+be completed as the user types them, the ones used most often first
+A group name can be used as the recipient of an email, which is then sent to
+each member of the group
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxSuggestions is the number of suggestions sent back at most by the
+// autocompletion
+const maxSuggestions = 50
+
+var errBadContact = errors.New("invalid contact")
+var errUnknownGroup = errors.New("unknown group")
+
+// Contact struct representing an entry of the address book. Collected
+// contacts were added automatically from the emails sent, Used counts the
+// emails sent to the contact
+type Contact struct {
+	ID        string
+	Name      string
+	Addresses []string
+	Groups    []string `json:",omitempty"`
+	Phones    []string `json:",omitempty"`
+	Notes     string   `json:",omitempty"`
+	Collected bool     `json:",omitempty"`
+	Used      int
+	LastUsed  time.Time
+	Created   time.Time
+}
+
+// ContactGroup struct representing a group of contacts, with the addresses
+// an email to the group is sent to
+type ContactGroup struct {
+	Name    string
+	Members []string
+}
+
+// Suggestion struct representing a completion of what the user typed, either
+// an address of a contact or a group
+type Suggestion struct {
+	Name    string
+	Address string `json:",omitempty"`
+	Group   bool   `json:",omitempty"`
+	Contact string `json:",omitempty"`
+}
+
+// contacts holds the address book
+var contacts struct {
+	list  []Contact
+	mutex sync.RWMutex
+}
+
+// contactsPath returns the path of the file holding the address book
+func contactsPath() string {
+	return filepath.Join(SETTINGS, "contacts.json")
+}
+
+// loadContacts reads the address book saved on disk, if any
+func loadContacts() {
+	var list []Contact
+
+	data, err := ioutil.ReadFile(contactsPath())
+	if err == nil {
+		err = json.Unmarshal(data, &list)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	contacts.mutex.Lock()
+	contacts.list = list
+	contacts.mutex.Unlock()
+}
+
+// saveContacts writes the address book to disk. The caller holds the lock
+func saveContacts(list []Contact) error {
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(contactsPath(), data)
+}
+
+// findContact returns the index of a contact. The caller holds the lock
+func findContact(id string) (int, bool) {
+	for i, contact := range contacts.list {
+		if contact.ID == id {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// findAddress returns the index of the contact of a list with an address
+func findAddress(list []Contact, address string) (int, bool) {
+	for i, contact := range list {
+		for _, candidate := range contact.Addresses {
+			if strings.EqualFold(candidate, address) {
+				return i, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// validGroupName checks a group name can't be mistaken for an address or a
+// list of them
+func validGroupName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "@,<>\"")
+}
+
+// appendUnique adds the values missing from a list, ignoring the case
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			if strings.EqualFold(existing, value) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			list = append(list, value)
+		}
+	}
+
+	return list
+}
+
+// validate checks a contact can be saved, keeping only the address part of
+// its addresses
+func (contact *Contact) validate() error {
+	contact.Name = strings.TrimSpace(contact.Name)
+
+	var addresses []string
+	for _, address := range contact.Addresses {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return errBadContact
+		}
+
+		if contact.Name == "" {
+			contact.Name = parsed.Name
+		}
+		addresses = appendUnique(addresses, parsed.Address)
+	}
+	contact.Addresses = addresses
+
+	var groups []string
+	for _, group := range contact.Groups {
+		group = strings.TrimSpace(group)
+		if !validGroupName(group) {
+			return errBadContact
+		}
+		groups = appendUnique(groups, group)
+	}
+	contact.Groups = groups
+
+	if contact.Name == "" && len(contact.Addresses) == 0 {
+		return errBadContact
+	}
+
+	return nil
+}
+
+// newContact gives a contact its ID and creation date
+func newContact(contact *Contact) error {
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return err
+	}
+
+	contact.ID = id.String()
+	contact.Created = time.Now()
+
+	return nil
+}
+
+// groupMembers returns the addresses of the members of a group, each member
+// being written to at its first address. The caller holds the lock
+func groupMembers(name string) ([]string, bool) {
+	var members []string
+	found := false
+
+	for _, contact := range contacts.list {
+		for _, group := range contact.Groups {
+			if strings.EqualFold(group, name) {
+				found = true
+				if len(contact.Addresses) > 0 {
+					members = appendUnique(members, contact.Addresses[0])
+				}
+				break
+			}
+		}
+	}
+
+	return members, found
+}
+
+// listGroups lists the groups of the address book, by name. The caller holds
+// the lock
+func listGroups() []ContactGroup {
+	groups := []ContactGroup{}
+	seen := make(map[string]bool)
+
+	for _, contact := range contacts.list {
+		for _, group := range contact.Groups {
+			if seen[strings.ToLower(group)] {
+				continue
+			}
+			seen[strings.ToLower(group)] = true
+
+			members, _ := groupMembers(group)
+			groups = append(groups, ContactGroup{group, members})
+		}
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return strings.ToLower(groups[i].Name) < strings.ToLower(groups[j].Name)
+	})
+
+	return groups
+}
+
+// splitRecipients splits a list of recipients on the commas which are
+// neither quoted nor in angle brackets
+func splitRecipients(field string) []string {
+	var recipients []string
+	var quoted bool
+	var depth int
+	start := 0
+
+	for i, c := range field {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '<' && !quoted:
+			depth++
+		case c == '>' && !quoted && depth > 0:
+			depth--
+		case c == ',' && !quoted && depth == 0:
+			recipients = append(recipients, field[start:i])
+			start = i + 1
+		}
+	}
+	recipients = append(recipients, field[start:])
+
+	var trimmed []string
+	for _, recipient := range recipients {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			trimmed = append(trimmed, recipient)
+		}
+	}
+
+	return trimmed
+}
+
+// expandRecipients replaces the group names of a list of recipients with the
+// addresses of their members. Anything else is kept as it is
+func expandRecipients(field string) ([]string, error) {
+	contacts.mutex.RLock()
+	defer contacts.mutex.RUnlock()
+
+	var recipients []string
+
+	for _, recipient := range splitRecipients(field) {
+		if strings.Contains(recipient, "@") {
+			recipients = appendUnique(recipients, recipient)
+			continue
+		}
+
+		members, ok := groupMembers(recipient)
+		if !ok {
+			return nil, errUnknownGroup
+		}
+		recipients = appendUnique(recipients, members...)
+	}
+
+	return recipients, nil
+}
+
+// collectRecipients adds the recipients of an email sent to the address book,
+// or counts one more email for the contacts already there
+func collectRecipients(email EMail) {
+	var recipients []*mail.Address
+
+	fields := []string{email.To}
+	if cc := emailHeader(email, "Cc"); cc != nil {
+		fields = append(fields, cc[0])
+	}
+
+	for _, field := range fields {
+		list, err := (&mail.AddressParser{WordDecoder: &headerDecoder}).ParseList(field)
+		if err != nil {
+			log.Print(err.Error())
+			continue
+		}
+		recipients = append(recipients, list...)
+	}
+
+	contacts.mutex.Lock()
+	defer contacts.mutex.Unlock()
+
+	list := append([]Contact{}, contacts.list...)
+	now := time.Now()
+
+	for _, recipient := range recipients {
+		if strings.EqualFold(recipient.Address, self.Name) {
+			continue
+		}
+
+		if i, ok := findAddress(list, recipient.Address); ok {
+			list[i].Used++
+			list[i].LastUsed = now
+			continue
+		}
+
+		contact := Contact{Name: recipient.Name, Addresses: []string{recipient.Address},
+			Collected: true, Used: 1, LastUsed: now}
+		if err := newContact(&contact); err != nil {
+			log.Print(err.Error())
+			continue
+		}
+
+		list = append(list, contact)
+	}
+
+	if err := saveContacts(list); err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	contacts.list = list
+}
+
+// hasWordPrefix tells whether a text, or one of its words, starts with a
+// prefix. The prefix is in lower case
+func hasWordPrefix(text string, prefix string) bool {
+	text = strings.ToLower(text)
+	if strings.HasPrefix(text, prefix) {
+		return true
+	}
+
+	for _, word := range strings.FieldsFunc(text, func(c rune) bool {
+		return c == ' ' || c == '.' || c == '-' || c == '_'
+	}) {
+		if strings.HasPrefix(word, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// autocomplete returns the addresses and the groups matching what the user
+// typed, the groups and the contacts written to most often first
+func autocomplete(prefix string, limit int) []Suggestion {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+
+	contacts.mutex.RLock()
+	defer contacts.mutex.RUnlock()
+
+	suggestions := []Suggestion{}
+
+	for _, group := range listGroups() {
+		if hasWordPrefix(group.Name, prefix) {
+			suggestions = append(suggestions, Suggestion{Name: group.Name, Group: true})
+		}
+	}
+
+	var matches []Contact
+	for _, contact := range contacts.list {
+		if hasWordPrefix(contact.Name, prefix) {
+			matches = append(matches, contact)
+			continue
+		}
+
+		// The domains are left out, most addresses would match "c" or "g"
+		for _, address := range contact.Addresses {
+			if local := strings.Split(address, "@")[0]; hasWordPrefix(local, prefix) {
+				matches = append(matches, contact)
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Used != matches[j].Used {
+			return matches[i].Used > matches[j].Used
+		}
+		return strings.ToLower(matches[i].Name) < strings.ToLower(matches[j].Name)
+	})
+
+	for _, contact := range matches {
+		for _, address := range contact.Addresses {
+			suggestions = append(suggestions, Suggestion{contact.Name, address,
+				false, contact.ID})
+		}
+	}
+
+	if len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+
+	return suggestions
+}
+
+// readContactRequest unmarshals and validates the contact sent in the body of
+// a request
+func readContactRequest(r *http.Request) (Contact, error) {
+	var contact Contact
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return contact, err
+	}
+
+	if err := json.Unmarshal(body, &contact); err != nil {
+		return contact, err
+	}
+
+	return contact, contact.validate()
+}
+
+// MSAListContacts gets called from the handleRequests method
+// It lists the contacts of the address book, by name
+func MSAListContacts(w http.ResponseWriter, r *http.Request) {
+	contacts.mutex.RLock()
+	list := append([]Contact{}, contacts.list...)
+	contacts.mutex.RUnlock()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// MSACreateContact gets called from the handleRequests method
+// It adds a contact to the address book
+func MSACreateContact(w http.ResponseWriter, r *http.Request) {
+	contact, err := readContactRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	if err := newContact(&contact); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+	contact.Collected = false
+
+	contacts.mutex.Lock()
+	defer contacts.mutex.Unlock()
+
+	list := append(append([]Contact{}, contacts.list...), contact)
+	if err := saveContacts(list); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	contacts.list = list
+
+	log.Println("Created the contact " + contact.ID + " " + contact.Name)
+	writeJSON(w, http.StatusCreated, contact)
+}
+
+// MSAReadContact gets called from the handleRequests method
+// It sends back a contact
+func MSAReadContact(w http.ResponseWriter, r *http.Request) {
+	contacts.mutex.RLock()
+	defer contacts.mutex.RUnlock()
+
+	i, ok := findContact(mux.Vars(r)["id"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, contacts.list[i])
+}
+
+// MSAUpdateContact gets called from the handleRequests method
+// It replaces a contact. Once edited, a collected contact is kept like any
+// other
+func MSAUpdateContact(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	contact, err := readContactRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	contacts.mutex.Lock()
+	defer contacts.mutex.Unlock()
+
+	i, ok := findContact(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	existing := contacts.list[i]
+	contact.ID, contact.Created = id, existing.Created
+	contact.Used, contact.LastUsed = existing.Used, existing.LastUsed
+	contact.Collected = false
+
+	list := append([]Contact{}, contacts.list...)
+	list[i] = contact
+
+	if err := saveContacts(list); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	contacts.list = list
+
+	log.Println("Updated the contact " + id)
+	writeJSON(w, http.StatusOK, contact)
+}
+
+// MSADeleteContact gets called from the handleRequests method
+// It removes a contact from the address book
+func MSADeleteContact(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	contacts.mutex.Lock()
+	defer contacts.mutex.Unlock()
+
+	i, ok := findContact(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	list := append(append([]Contact{}, contacts.list[:i]...), contacts.list[i+1:]...)
+	if err := saveContacts(list); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	contacts.list = list
+
+	log.Println("Deleted the contact " + id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSAListGroups gets called from the handleRequests method
+// It lists the groups of the address book with their members
+func MSAListGroups(w http.ResponseWriter, r *http.Request) {
+	contacts.mutex.RLock()
+	groups := listGroups()
+	contacts.mutex.RUnlock()
+
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// MSASearchContacts gets called from the handleRequests method
+// It completes the beginning of a name, an address or a group given in ?q=,
+// with at most ?limit= suggestions
+func MSASearchContacts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := 10
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println("Invalid limit " + value)
+			return
+		}
+	}
+	if limit > maxSuggestions {
+		limit = maxSuggestions
+	}
+
+	writeJSON(w, http.StatusOK, autocomplete(query.Get("q"), limit))
+}
@@ -0,0 +1,212 @@
+/*
+delivery.go keeps the delivery history of the emails sent
+The MTA reports what happens to each email of the outbox: when it attempts
+to deliver it, when it defers it and why, and whether it was delivered or
+bounced in the end. The history is kept once the email left the outbox, so
+that the sender can still read it from the Sent folder
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// Delivery statuses of the emails of the outbox
+const (
+	statusQueued     = "queued"
+	statusAttempting = "attempting"
+	statusDeferred   = "deferred"
+	statusDelivered  = "delivered"
+	statusBounced    = "bounced"
+	statusFailed     = "failed"
+	statusCancelled  = "cancelled"
+	statusExpired    = "expired"
+)
+
+// deliveryStatuses are the statuses the MTA can report
+var deliveryStatuses = map[string]bool{
+	statusAttempting: true, statusDeferred: true, statusDelivered: true,
+	statusBounced: true, statusFailed: true,
+}
+
+// mtaHeader is set by the MTA on the requests it sends, so that they can be
+// told apart from the requests of the user
+const mtaHeader = "X-MTA"
+
+// DeliveryStatus struct representing a step of the delivery of an email.
+// Server is the MTA the email was handed to
+type DeliveryStatus struct {
+	Status string
+	Reason string `json:",omitempty"`
+	Server string `json:",omitempty"`
+	Date   time.Time
+}
+
+// maxHistory is the number of statuses kept for an email, which is retried
+// as long as its destination is unavailable
+const maxHistory = 50
+
+// deliveries serialises the updates of the delivery histories
+var deliveries sync.Mutex
+
+// deliveryPath returns the path of the file holding the delivery history of
+// an email
+func deliveryPath(id string) string {
+	return filepath.Join(SETTINGS, "delivery", id+".json")
+}
+
+// readHistory reads the delivery history of an email
+func readHistory(id string) ([]DeliveryStatus, error) {
+	var history []DeliveryStatus
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, notExist(id)
+	}
+
+	data, err := ioutil.ReadFile(deliveryPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &history)
+
+	return history, err
+}
+
+// recordStatus adds a status to the delivery history of an email, unless it
+// is already the last one
+func recordStatus(id string, status DeliveryStatus) {
+	deliveries.Lock()
+	defer deliveries.Unlock()
+
+	history, err := readHistory(id)
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	if n := len(history); n > 0 && history[n-1].Status == status.Status &&
+		history[n-1].Reason == status.Reason {
+		return
+	}
+
+	if status.Date.IsZero() {
+		status.Date = time.Now()
+	}
+
+	// Keep the first status, when the email was queued, and the last ones
+	history = append(history, status)
+	if len(history) > maxHistory {
+		history = append(history[:1], history[len(history)-maxHistory+1:]...)
+	}
+
+	historyJSON, err := json.Marshal(history)
+	if err == nil {
+		CreateDirIfNotExist(filepath.Dir(deliveryPath(id)))
+		err = writeFileAtomic(deliveryPath(id), historyJSON)
+	}
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	publishStatus(id, status)
+}
+
+// lastStatus returns the last delivery status of an email
+func lastStatus(id string) string {
+	deliveries.Lock()
+	defer deliveries.Unlock()
+
+	history, _ := readHistory(id)
+	if len(history) == 0 {
+		return ""
+	}
+
+	return history[len(history)-1].Status
+}
+
+// deliveredEmail records an email moved to the Sent folder by the MTA as
+// delivered, if the MTA didn't report it already
+func deliveredEmail(id string) {
+	if lastStatus(id) != statusDelivered {
+		recordStatus(id, DeliveryStatus{Status: statusDelivered})
+	}
+}
+
+// droppedEmail records an email deleted from the outbox by the MTA as failed,
+// unless the MTA already reported why. An email the user deleted was cancelled
+func droppedEmail(id string, byMTA bool) {
+	switch status := lastStatus(id); {
+	case status == statusBounced || status == statusFailed:
+	case byMTA:
+		recordStatus(id, DeliveryStatus{Status: statusFailed})
+	default:
+		recordStatus(id, DeliveryStatus{Status: statusCancelled})
+	}
+}
+
+// MSAReportStatus gets called by the MTA
+// It adds a status to the delivery history of an email of the outbox
+func MSAReportStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+
+	var status DeliveryStatus
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &status)
+	}
+	if err != nil || !deliveryStatuses[status.Status] {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("Invalid delivery status for %s\n", id)
+		return
+	}
+
+	// Only the emails still in the outbox can be reported on
+	if _, err := readEmail(OUTBOX, id); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	status.Date = time.Now()
+	recordStatus(id, status)
+
+	log.Printf("Email %s is %s %s\n", id, status.Status, status.Reason)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSAReadStatus gets called from the handleRequests method
+// It sends back the delivery history of an email sent, oldest status first
+func MSAReadStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+
+	deliveries.Lock()
+	history, err := readHistory(id)
+	deliveries.Unlock()
+
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(historyJSON)
+}
@@ -0,0 +1,535 @@
+/*
+drafts.go handles the drafts of the user
+A draft is an email kept in the Drafts folder, which can be edited as many
+times as needed before it is sent, at which point it moves to the Outbox
+Each draft has an ETag, derived from its content, which a client sends back
+in If-Match when it changes the draft, so that it doesn't overwrite the
+changes made meanwhile by another client. Every version saved is kept, up to
+a limit, and can be read back or restored. Autosaves made in a row are merged
+into a single version
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxDraftVersions is the number of versions kept for a draft
+const maxDraftVersions = 20
+
+// autosaveInterval is the time during which autosaves replace the previous
+// autosave instead of adding a version
+const autosaveInterval = time.Minute
+
+// DraftVersion struct representing a version of a draft. The email is only
+// sent back when a single version is read
+type DraftVersion struct {
+	Version  int
+	ETag     string
+	Date     time.Time
+	Autosave bool `json:",omitempty"`
+	Subject  string
+	To       string
+	EMail    *EMail `json:",omitempty"`
+}
+
+// drafting serialises the changes of the drafts, so that checking the ETag of
+// a draft and changing it happen at once
+var drafting sync.Mutex
+
+// draftETag returns the ETag of a draft, a hash of its content
+func draftETag(email EMail) string {
+	data, _ := json.Marshal(email)
+	sum := sha256.Sum256(data)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// matchesETag tells whether the ETag of a draft is one of those of an
+// If-Match or If-None-Match header
+func matchesETag(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// versionsPath returns the path of the file holding the versions of a draft
+func versionsPath(id string) string {
+	return filepath.Join(SETTINGS, "drafts", id+".json")
+}
+
+// readVersions reads the versions of a draft, oldest first
+func readVersions(id string) ([]DraftVersion, error) {
+	var versions []DraftVersion
+
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, notExist(id)
+	}
+
+	data, err := ioutil.ReadFile(versionsPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &versions)
+
+	return versions, err
+}
+
+// removeVersions deletes the versions of a draft which isn't a draft anymore
+func removeVersions(id string) {
+	if err := os.Remove(versionsPath(id)); err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+}
+
+// recordDraft adds the draft as it is stored to its versions, and returns its
+// ETag. An autosave following another one closely replaces it. The caller
+// holds drafting
+func recordDraft(id string, autosave bool) (string, error) {
+	draft, err := readEmail(DRAFTS, id)
+	if err != nil {
+		return "", err
+	}
+
+	etag := draftETag(draft)
+
+	versions, err := readVersions(id)
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	number := 1
+	if n := len(versions); n > 0 {
+		last := versions[n-1]
+		number = last.Version + 1
+
+		if last.ETag == etag {
+			// Nothing changed since
+			return etag, nil
+		}
+
+		if autosave && last.Autosave && time.Since(last.Date) < autosaveInterval {
+			versions = versions[:n-1]
+		}
+	}
+
+	versions = append(versions, DraftVersion{Version: number, ETag: etag,
+		Date: time.Now(), Autosave: autosave, Subject: draft.Subject,
+		To: draft.To, EMail: &draft})
+	if len(versions) > maxDraftVersions {
+		versions = versions[len(versions)-maxDraftVersions:]
+	}
+
+	versionsJSON, err := json.Marshal(versions)
+	if err == nil {
+		CreateDirIfNotExist(filepath.Dir(versionsPath(id)))
+		err = writeFileAtomic(versionsPath(id), versionsJSON)
+	}
+	if err != nil {
+		// The draft itself was saved, only its history is missing
+		log.Print(err.Error())
+	}
+
+	return etag, nil
+}
+
+// saveDraft writes a draft and records the new version. The caller holds
+// drafting
+func saveDraft(draft EMail, autosave bool) (string, error) {
+	if err := writeEmail(DRAFTS, draft); err != nil {
+		return "", err
+	}
+
+	return recordDraft(draft.UUID.String(), autosave)
+}
+
+// checkDraft reads a draft and checks it still is the version given in the
+// If-Match header. The header is mandatory when required is set. It answers
+// the client and returns false if the draft can't be changed. The caller
+// holds drafting
+func checkDraft(w http.ResponseWriter, r *http.Request, id string, required bool) (EMail, bool) {
+	draft, err := readEmail(DRAFTS, id)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return draft, false
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" && !required {
+		return draft, true
+	}
+
+	etag := draftETag(draft)
+	w.Header().Set("ETag", etag)
+
+	if ifMatch == "" {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		log.Println("Draft " + id + " changed without If-Match")
+		return draft, false
+	}
+
+	if !matchesETag(ifMatch, etag) {
+		// Someone else changed the draft meanwhile
+		w.WriteHeader(http.StatusPreconditionFailed)
+		log.Println("Draft " + id + " changed since " + ifMatch)
+		return draft, false
+	}
+
+	return draft, true
+}
+
+// readEmailRequest reads the email sent in the body of a request, either as
+// JSON or as multipart/form-data
+func readEmailRequest(r *http.Request) (EMail, error) {
+	var email EMail
+
+	if isMultipart(r) {
+		return readMultipartEmail(r)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return email, err
+	}
+
+	err = json.Unmarshal(body, &email)
+	normalizeAttachments(&email)
+
+	return email, err
+}
+
+// MSASaveDraft creates a new draft and sends it back with its UUID
+// Unlike MSASend, the From and To fields are allowed to be empty
+func MSASaveDraft(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMessageSize)
+
+	draft, err := readEmailRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	draft.UUID, err = uuid.NewUUID()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	drafting.Lock()
+	defer drafting.Unlock()
+
+	etag, err := saveDraft(draft, false)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	err = writeFlags(DRAFTS, draft.UUID.String(), Flags{Seen: true, Draft: true})
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	draftJSON, err := json.Marshal(draft)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(draftJSON)
+}
+
+// MSAReadDraft sends back a draft with its ETag, or nothing if the client
+// already has this version
+func MSAReadDraft(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+
+	draft, err := readEmail(DRAFTS, id)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	etag := draftETag(draft)
+	w.Header().Set("ETag", etag)
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" &&
+		matchesETag(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	MSARead(DRAFTS)(w, r)
+}
+
+// MSAUpdateDraft replaces the content of an existing draft, as long as the
+// client holds its latest version. Autosaves are requested with ?autosave=true
+func MSAUpdateDraft(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+
+	autosave, err := strconv.ParseBool(r.URL.Query().Get("autosave"))
+	if err != nil && r.URL.Query().Get("autosave") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxMessageSize)
+
+	draft, err := readEmailRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	drafting.Lock()
+	defer drafting.Unlock()
+
+	existing, ok := checkDraft(w, r, id, true)
+	if !ok {
+		return
+	}
+
+	// The UUID of a draft never changes, whatever the client sent
+	draft.UUID = existing.UUID
+
+	etag, err := saveDraft(draft, autosave)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSADeleteDraft moves a draft to the Trash, along with its versions
+func MSADeleteDraft(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+
+	drafting.Lock()
+	defer drafting.Unlock()
+
+	if _, ok := checkDraft(w, r, id, false); !ok {
+		return
+	}
+
+	if err := trashEmail(DRAFTS, id); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	removeVersions(id)
+	publish(Event{Type: eventDeleted, Folder: DRAFTS, UUID: id})
+
+	log.Printf("Delete draft %s\n", id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSASendDraft moves a draft to the Outbox, for the MTA to pick it up. When
+// the client sends If-Match, the draft is only sent if it wasn't changed since.
+// The members of the groups it is written to get a copy each
+func MSASendDraft(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+
+	drafting.Lock()
+	defer drafting.Unlock()
+
+	draft, ok := checkDraft(w, r, id, false)
+	if !ok {
+		return
+	}
+
+	if draft.From == "" || draft.To == "" {
+		// The draft isn't finished yet, it can't be sent
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("From or To field empty.")
+		return
+	}
+
+	// As with MSASend, a group gets a copy for each of its members. The draft
+	// becomes the copy of the first one
+	recipients, err := submittedRecipients(draft)
+	if err != nil || len(recipients) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Unknown recipient " + draft.To)
+		return
+	}
+
+	copies, err := emailCopies(draft, recipients)
+	if err == nil {
+		err = checkQuota(copies...)
+	}
+	if err == nil {
+		err = queueAll(copies[1:])
+	}
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	// The email is dated from the moment it's sent, not from the moment the
+	// draft was written
+	draft = copies[0]
+	draft.Date = time.Now()
+	threadReply(&draft)
+	schedule(&draft, draft.Date)
+
+	err = writeEmail(DRAFTS, draft)
+	if err == nil {
+		// Moving the email is what sends it, the MTA only reads the Outbox
+		err = moveEmail(DRAFTS, OUTBOX, id)
+	}
+	if err != nil {
+		unqueue(copies[1:])
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	// It's not a draft anymore
+	_, err = updateFlags(OUTBOX, id, func(flags *Flags) { flags.Draft = false })
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	removeVersions(id)
+	recordStatus(id, queuedStatus(draft))
+
+	draft.To = strings.Join(recipients, ", ")
+	collectRecipients(draft)
+
+	log.Println("Sending draft " + draft.Subject)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// readDraftVersion reads a version of a draft, given in the URL
+func readDraftVersion(r *http.Request) (DraftVersion, error) {
+	vars := mux.Vars(r)
+
+	versions, err := readVersions(vars["uuid"])
+	if err != nil {
+		return DraftVersion{}, err
+	}
+
+	number, err := strconv.Atoi(vars["version"])
+	if err != nil {
+		return DraftVersion{}, notExist(vars["version"])
+	}
+
+	for _, version := range versions {
+		if version.Version == number && version.EMail != nil {
+			return version, nil
+		}
+	}
+
+	return DraftVersion{}, notExist(vars["version"])
+}
+
+// MSAListDraftVersions gets called from the handleRequests method
+// It lists the versions of a draft, oldest first, without their content
+func MSAListDraftVersions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+
+	if _, err := readEmail(DRAFTS, id); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	versions, err := readVersions(id)
+	if err != nil && !os.IsNotExist(err) {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	list := []DraftVersion{}
+	for _, version := range versions {
+		version.EMail = nil
+		list = append(list, version)
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// MSAReadDraftVersion gets called from the handleRequests method
+// It sends back a version of a draft, with its content
+func MSAReadDraftVersion(w http.ResponseWriter, r *http.Request) {
+	version, err := readDraftVersion(r)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, version)
+}
+
+// MSARestoreDraftVersion gets called from the handleRequests method
+// It brings a draft back to one of its versions, which becomes its latest
+// version. Like an update, it needs the ETag of the draft in If-Match
+func MSARestoreDraftVersion(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+
+	drafting.Lock()
+	defer drafting.Unlock()
+
+	version, err := readDraftVersion(r)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	existing, ok := checkDraft(w, r, id, true)
+	if !ok {
+		return
+	}
+
+	draft := *version.EMail
+	draft.UUID = existing.UUID
+
+	etag, err := saveDraft(draft, false)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	log.Printf("Restored draft %s to version %d\n", id, version.Version)
+	w.Header().Set("ETag", etag)
+	writeJSON(w, http.StatusOK, draft)
+}
@@ -0,0 +1,363 @@
+/*
+events.go pushes the changes of the mailbox to the clients as they happen,
+so that they don't have to poll for new emails
+Every change is an event with an increasing ID: an email received or
+deleted, flags changed, or a new delivery status of an email of the outbox.
+Clients follow the events with Server-Sent Events or a WebSocket, and can
+choose the types and the folder of the events they get
+The last events are kept, so that a client which reconnects with the ID of
+the last event it got catches up with the ones it missed. When too many were
+missed, the client is sent a "reset" event and should read the mailbox again
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Types of the events
+const (
+	eventReceived = "received"
+	eventDeleted  = "deleted"
+	eventFlags    = "flags"
+	eventStatus   = "status"
+	eventReset    = "reset"
+)
+
+// eventHistory is the number of events kept for the clients which reconnect
+const eventHistory = 1000
+
+// subscriberBuffer is the number of events a client can lag behind before it
+// is disconnected
+const subscriberBuffer = 64
+
+// heartbeatInterval is the time between two messages keeping a connection
+// alive when nothing happens
+const heartbeatInterval = 30 * time.Second
+
+// Event struct representing a change of the mailbox
+type Event struct {
+	ID      uint64
+	Type    string
+	Folder  string `json:",omitempty"`
+	UUID    string `json:",omitempty"`
+	From    string `json:",omitempty"`
+	Subject string `json:",omitempty"`
+	Flags   *Flags `json:",omitempty"`
+	Status  string `json:",omitempty"`
+	Reason  string `json:",omitempty"`
+	Date    time.Time
+}
+
+// EventFilter struct representing the events a client follows. Empty fields
+// match every event
+type EventFilter struct {
+	Types  map[string]bool
+	Folder string
+}
+
+// subscriber is a client following the events
+type subscriber struct {
+	events chan Event
+	filter EventFilter
+}
+
+// events holds the last events and the clients following them
+var events struct {
+	last        uint64
+	history     []Event
+	subscribers map[*subscriber]bool
+	mutex       sync.Mutex
+}
+
+// matches tells whether a client follows an event. The reset events concern
+// every client
+func (filter EventFilter) matches(event Event) bool {
+	if event.Type == eventReset {
+		return true
+	}
+
+	return (len(filter.Types) == 0 || filter.Types[event.Type]) &&
+		(filter.Folder == "" || filter.Folder == event.Folder)
+}
+
+// publish gives an event its ID and sends it to the clients following it, and
+// to the webhooks. A client which doesn't keep up is disconnected, it can
+// reconnect and catch up
+func publish(event Event) {
+	broadcast(&event)
+	queueWebhooks(event)
+}
+
+// broadcast gives an event its ID and sends it to the clients following it
+func broadcast(event *Event) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	events.last++
+	event.ID = events.last
+	event.Date = time.Now()
+
+	events.history = append(events.history, *event)
+	if len(events.history) > eventHistory {
+		events.history = events.history[len(events.history)-eventHistory:]
+	}
+
+	for sub := range events.subscribers {
+		if !sub.filter.matches(*event) {
+			continue
+		}
+
+		select {
+		case sub.events <- *event:
+		default:
+			delete(events.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// publishEmail publishes an event about an email of a folder
+func publishEmail(eventType string, folder string, email EMail) {
+	publish(Event{Type: eventType, Folder: folder, UUID: email.UUID.String(),
+		From: email.From, Subject: email.Subject})
+}
+
+// publishStatus publishes a change of the delivery status of an email of the
+// outbox
+func publishStatus(id string, status DeliveryStatus) {
+	publish(Event{Type: eventStatus, Folder: OUTBOX, UUID: id,
+		Status: status.Status, Reason: status.Reason})
+}
+
+// subscribe starts following the events. It returns the events following
+// lastID the client missed, or a reset event if they aren't all kept anymore
+func subscribe(filter EventFilter, lastID uint64) (*subscriber, []Event) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	sub := &subscriber{make(chan Event, subscriberBuffer), filter}
+
+	if events.subscribers == nil {
+		events.subscribers = make(map[*subscriber]bool)
+	}
+	events.subscribers[sub] = true
+
+	var missed []Event
+
+	if lastID > events.last {
+		// The MSA restarted since, the events were lost
+		missed = append(missed, Event{ID: events.last, Type: eventReset, Date: time.Now()})
+	} else if lastID > 0 && lastID < events.last {
+		if len(events.history) == 0 || events.history[0].ID > lastID+1 {
+			missed = append(missed, Event{ID: events.last, Type: eventReset, Date: time.Now()})
+		} else {
+			for _, event := range events.history {
+				if event.ID > lastID && filter.matches(event) {
+					missed = append(missed, event)
+				}
+			}
+		}
+	}
+
+	return sub, missed
+}
+
+// unsubscribe stops following the events
+func unsubscribe(sub *subscriber) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	if events.subscribers[sub] {
+		delete(events.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// readEventRequest reads the filter of a client from the query, and the ID of
+// the last event it got from the Last-Event-ID header or the query
+func readEventRequest(r *http.Request) (EventFilter, uint64, error) {
+	query := r.URL.Query()
+	filter := EventFilter{Folder: query.Get("folder")}
+
+	if types := query.Get("types"); types != "" {
+		filter.Types = make(map[string]bool)
+		for _, eventType := range strings.Split(types, ",") {
+			filter.Types[strings.TrimSpace(eventType)] = true
+		}
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("since")
+	}
+
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			return filter, 0, err
+		}
+	}
+
+	return filter, lastID, nil
+}
+
+// MSAEvents gets called from the handleRequests method
+// It streams the events of the mailbox as Server-Sent Events
+func MSAEvents(w http.ResponseWriter, r *http.Request) {
+	filter, lastID, err := readEventRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("Streaming is not supported")
+		return
+	}
+
+	sub, missed := subscribe(filter, lastID)
+	defer unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event Event) error {
+		eventJSON, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID,
+			event.Type, eventJSON)
+		flusher.Flush()
+
+		return err
+	}
+
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				log.Println("Disconnected a client lagging behind the events")
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// upgrader turns the HTTP connections into WebSockets. There is no
+// authentication anyway, so any origin is accepted
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// MSAEventsSocket gets called from the handleRequests method
+// It sends the events of the mailbox over a WebSocket, one JSON object per
+// message
+func MSAEventsSocket(w http.ResponseWriter, r *http.Request) {
+	filter, lastID, err := readEventRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already answered the client
+		log.Print(err.Error())
+		return
+	}
+	defer conn.Close()
+
+	sub, missed := subscribe(filter, lastID)
+	defer unsubscribe(sub)
+
+	// The client isn't expected to send anything, but reading tells when it
+	// goes away
+	closed := make(chan bool)
+	go func() {
+		conn.SetReadLimit(512)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	send := func(event Event) error {
+		conn.SetWriteDeadline(time.Now().Add(heartbeatInterval))
+		return conn.WriteJSON(event)
+	}
+
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				log.Println("Disconnected a client lagging behind the events")
+				return
+			}
+			if err := send(event); err != nil {
+				return
+			}
+
+		case <-heartbeat.C:
+			err := conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(heartbeatInterval))
+			if err != nil {
+				return
+			}
+
+		case <-closed:
+			return
+		}
+	}
+}
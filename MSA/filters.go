@@ -0,0 +1,472 @@
+/*
+filters.go handles the Sieve scripts of the user, and the delivery of the
+emails received through them
+The scripts are kept in the sieve directory of SETTINGS, and the name of the
+active one in its "active" file. Without an active script, every email goes
+to the Inbox
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxScriptSize is the maximum size of a Sieve script
+const maxScriptSize = 64 << 10
+
+// redirectedBy is the header listing the mailboxes which redirected an email
+const redirectedBy = "X-Sieve-Redirected-By"
+
+var errInvalidScript = errors.New("invalid script name")
+var errActiveScript = errors.New("script is active")
+
+// ScriptInfo struct representing a Sieve script of the user
+type ScriptInfo struct {
+	Name   string
+	Active bool
+}
+
+// ScriptError struct representing why a script is invalid
+type ScriptError struct {
+	Error string
+	Line  int `json:",omitempty"`
+}
+
+// sieve holds the active script, compiled
+var sieve struct {
+	active *SieveScript
+	name   string
+	mutex  sync.RWMutex
+}
+
+// sieveDir returns the directory holding the scripts
+func sieveDir() string {
+	return filepath.Join(SETTINGS, "sieve")
+}
+
+// scriptPath returns the path of a script
+func scriptPath(name string) (string, error) {
+	if name == "" || name == "active" || strings.HasPrefix(name, ".") ||
+		strings.ContainsAny(name, `/\`) {
+		return "", errInvalidScript
+	}
+
+	return filepath.Join(sieveDir(), name+".sieve"), nil
+}
+
+// loadSieve compiles the active script, if any
+func loadSieve() {
+	CreateDirIfNotExist(sieveDir())
+
+	name, err := ioutil.ReadFile(filepath.Join(sieveDir(), "active"))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	if err := activateScript(strings.TrimSpace(string(name))); err != nil {
+		log.Print(err.Error())
+	}
+}
+
+// activateScript compiles a saved script and makes it the active one. An
+// empty name deactivates the active script
+func activateScript(name string) error {
+	var script *SieveScript
+
+	if name != "" {
+		path, err := scriptPath(name)
+		if err != nil {
+			return err
+		}
+
+		source, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if script, err = CompileSieve(string(source)); err != nil {
+			return err
+		}
+	}
+
+	sieve.mutex.Lock()
+	defer sieve.mutex.Unlock()
+
+	activePath := filepath.Join(sieveDir(), "active")
+
+	if name == "" {
+		if err := os.Remove(activePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := writeFileAtomic(activePath, []byte(name)); err != nil {
+		return err
+	}
+
+	sieve.active, sieve.name = script, name
+
+	return nil
+}
+
+// deliver files a received email as the active script decides. It returns
+// the reason given by the script when it rejects the email
+func deliver(email EMail) (string, error) {
+	sieve.mutex.RLock()
+	script := sieve.active
+	sieve.mutex.RUnlock()
+
+	result := SieveResult{Keep: true}
+	if script != nil {
+		result = script.Run(email)
+	}
+
+	if result.Reject != "" {
+		log.Println("Rejected an email from " + email.From + " : " + result.Reject)
+		return result.Reject, nil
+	}
+
+	var folders []string
+	if result.Keep {
+		folders = append(folders, INBOX)
+	}
+
+	for _, folder := range result.FileInto {
+		// Emails filed to a folder which doesn't exist are kept in the Inbox
+		if err := mailbox.CheckFolder(folder); err != nil {
+			log.Print(err.Error())
+			folder = INBOX
+		}
+
+		if !containsFolder(folders, folder) {
+			folders = append(folders, folder)
+		}
+	}
+
+	// stored counts the copies of the email kept, redirected ones included
+	stored := 0
+
+	for _, address := range result.Redirect {
+		if err := redirect(email, address); err != nil {
+			log.Print(err.Error())
+			if !containsFolder(folders, INBOX) {
+				folders = append(folders, INBOX)
+			}
+		} else {
+			stored++
+		}
+	}
+
+	// Every folder gets its own copy, the first one keeping the UUID. Once a
+	// copy is stored the email is delivered: the sender mustn't get a bounce
+	// because a copy in another folder failed
+	for i, folder := range folders {
+		delivered := email
+		if i > 0 {
+			var err error
+			if delivered.UUID, err = uuid.NewUUID(); err != nil {
+				log.Print(err.Error())
+				continue
+			}
+		}
+
+		if err := writeEmail(folder, delivered); err != nil && stored == 0 {
+			return "", err
+		} else if err != nil {
+			log.Printf("Could not file a copy in %s: %s\n", folder, err.Error())
+			continue
+		}
+
+		stored++
+		publishEmail(eventReceived, folder, delivered)
+	}
+
+	if len(folders) == 0 && len(result.Redirect) == 0 {
+		log.Println("Discarded an email from " + email.From)
+	}
+
+	// The email is accepted, it can be answered. The vacation action of the
+	// script comes before the vacation settings
+	if result.Vacation != nil {
+		autoReply(email, *result.Vacation)
+	} else if reply, ok := vacationReply(time.Now()); ok {
+		autoReply(email, reply)
+	}
+
+	return "", nil
+}
+
+// containsFolder tells whether a folder is in a list of folders
+func containsFolder(folders []string, folder string) bool {
+	for _, existing := range folders {
+		if existing == folder {
+			return true
+		}
+	}
+
+	return false
+}
+
+var errRedirectLoop = errors.New("email already redirected by this mailbox")
+
+// redirect places a copy of an email in the outbox, for the MTA to send it to
+// another address. Replies still go to the original sender
+func redirect(email EMail, address string) error {
+	previous := email.Headers[redirectedBy]
+	for _, name := range strings.Split(previous, ",") {
+		if strings.EqualFold(strings.TrimSpace(name), self.Name) {
+			return errRedirectLoop
+		}
+	}
+
+	headers := make(map[string]string, len(email.Headers)+2)
+	for name, value := range email.Headers {
+		headers[name] = value
+	}
+
+	if previous != "" {
+		previous += ", "
+	}
+	headers[redirectedBy] = previous + self.Name
+
+	if _, ok := headers["Reply-To"]; !ok {
+		headers["Reply-To"] = email.From
+	}
+
+	email.Headers = headers
+	email.From = self.Name
+	email.To = address
+
+	var err error
+	if email.UUID, err = uuid.NewUUID(); err != nil {
+		return err
+	}
+
+	log.Println("Redirected an email to " + address)
+
+	return writeEmail(OUTBOX, email)
+}
+
+// writeScriptError sends back why a script is invalid
+func writeScriptError(w http.ResponseWriter, err error) {
+	scriptError := ScriptError{Error: err.Error()}
+	if sieveError, ok := err.(*SieveError); ok {
+		scriptError = ScriptError{sieveError.Message, sieveError.Line}
+	}
+
+	errorJSON, _ := json.Marshal(scriptError)
+
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(errorJSON)
+}
+
+// readScriptRequest reads a script sent to the MSA
+func readScriptRequest(w http.ResponseWriter, r *http.Request) (string, error) {
+	source, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxScriptSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return "", err
+	}
+
+	return string(source), nil
+}
+
+// MSAListScripts gets called from the handleRequests method
+// It lists the Sieve scripts of the user
+func MSAListScripts(w http.ResponseWriter, r *http.Request) {
+	sieve.mutex.RLock()
+	active := sieve.name
+	sieve.mutex.RUnlock()
+
+	files, err := ioutil.ReadDir(sieveDir())
+	if err != nil && !os.IsNotExist(err) {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	scripts := []ScriptInfo{}
+	for _, file := range files {
+		if name := strings.TrimSuffix(file.Name(), ".sieve"); name != file.Name() {
+			scripts = append(scripts, ScriptInfo{name, name == active})
+		}
+	}
+
+	sort.Slice(scripts, func(i, j int) bool {
+		return scripts[i].Name < scripts[j].Name
+	})
+
+	scriptsJSON, err := json.Marshal(scripts)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(scriptsJSON)
+}
+
+// MSAReadScript gets called from the handleRequests method
+// It sends back the source of a script
+func MSAReadScript(w http.ResponseWriter, r *http.Request) {
+	path, err := scriptPath(mux.Vars(r)["name"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sieve")
+	w.Write(source)
+}
+
+// MSAWriteScript gets called from the handleRequests method
+// It saves a script, once checked. Saving the active script replaces it
+// straight away
+func MSAWriteScript(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	path, err := scriptPath(name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	source, err := readScriptRequest(w, r)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	script, err := CompileSieve(source)
+	if err != nil {
+		writeScriptError(w, err)
+		log.Print("Invalid script " + name + " : " + err.Error())
+		return
+	}
+
+	CreateDirIfNotExist(sieveDir())
+
+	sieve.mutex.Lock()
+	defer sieve.mutex.Unlock()
+
+	if err := writeFileAtomic(path, []byte(source)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	if sieve.name == name {
+		sieve.active = script
+	}
+
+	log.Println("Saved the script " + name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSADeleteScript gets called from the handleRequests method
+// It deletes a script, which can't be the active one
+func MSADeleteScript(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	path, err := scriptPath(name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	sieve.mutex.Lock()
+	defer sieve.mutex.Unlock()
+
+	if sieve.name == name {
+		w.WriteHeader(http.StatusConflict)
+		log.Print(errActiveScript.Error() + " : " + name)
+		return
+	}
+
+	if err := os.Remove(path); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Deleted the script " + name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSAActivateScript gets called from the handleRequests method
+// It makes a saved script the one run on the emails received
+func MSAActivateScript(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if err := activateScript(name); err == errInvalidScript {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	} else if _, ok := err.(*SieveError); ok {
+		writeScriptError(w, err)
+		log.Print(err.Error())
+		return
+	} else if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Activated the script " + name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSADeactivateScript gets called from the handleRequests method
+// It stops filtering the emails received, which all go to the Inbox again
+func MSADeactivateScript(w http.ResponseWriter, r *http.Request) {
+	if err := activateScript(""); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Deactivated the Sieve script")
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSAValidateScript gets called from the handleRequests method
+// It checks a script without saving it
+func MSAValidateScript(w http.ResponseWriter, r *http.Request) {
+	source, err := readScriptRequest(w, r)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	if _, err := CompileSieve(source); err != nil {
+		writeScriptError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// useTestMailbox runs a test in a new mailbox, stored in a temporary
+// directory along with the settings
+func useTestMailbox(t *testing.T) {
+	dir := t.TempDir()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	CreateDirIfNotExist(SETTINGS)
+
+	previous := mailbox
+	if mailbox, err = newMailbox("files", dir); err != nil {
+		t.Fatal(err)
+	} else if err := mailbox.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	index.mutex.Lock()
+	index.Docs = make(map[string]*IndexedDoc)
+	index.Terms = make(map[string]map[string]Postings)
+	index.docTerms = make(map[string][]string)
+	index.mutex.Unlock()
+
+	replied.mutex.Lock()
+	replied.senders = nil
+	replied.mutex.Unlock()
+
+	t.Cleanup(func() {
+		mailbox = previous
+		quotaBytes, quotaMessages = 0, 0
+		sieve.active = nil
+		os.Chdir(cwd)
+	})
+}
+
+// useSieve makes a script the active one for a test
+func useSieve(t *testing.T, source string) {
+	script, err := CompileSieve(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sieve.active = script
+}
+
+func TestDeliverFileInto(t *testing.T) {
+	useTestMailbox(t)
+	self.Name = "stevejobs@there.com"
+	useSieve(t, `require "fileinto"; fileinto "Bills"; keep;`)
+
+	if err := mailbox.CreateFolder("Bills"); err != nil {
+		t.Fatal(err)
+	}
+
+	email := sieveEmail
+	email.UUID = newTestUUID(t)
+
+	if reason, err := deliver(email); reason != "" || err != nil {
+		t.Fatalf("got %q %v", reason, err)
+	}
+
+	for _, folder := range []string{INBOX, "Bills"} {
+		if ids, _ := mailbox.IDs(folder); len(ids) != 1 {
+			t.Errorf("%s: got %d emails, want 1", folder, len(ids))
+		}
+	}
+
+	// The Inbox copy keeps the UUID of the email
+	if _, err := mailbox.Read(INBOX, email.UUID.String()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeliverPartialCopies(t *testing.T) {
+	useTestMailbox(t)
+	self.Name = "stevejobs@there.com"
+	useSieve(t, `require "fileinto"; keep; fileinto "Bills";`)
+
+	if err := mailbox.CreateFolder("Bills"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first copy fits in the mailbox
+	quotaMessages = 1
+
+	email := sieveEmail
+	email.UUID = newTestUUID(t)
+
+	if reason, err := deliver(email); reason != "" || err != nil {
+		t.Fatalf("got %q %v, want the email delivered", reason, err)
+	}
+
+	if ids, _ := mailbox.IDs(INBOX); len(ids) != 1 {
+		t.Errorf("Inbox: got %d emails, want 1", len(ids))
+	}
+	if ids, _ := mailbox.IDs("Bills"); len(ids) != 0 {
+		t.Errorf("Bills: got %d emails, want none", len(ids))
+	}
+}
+
+func TestDeliverVacationAfterStoring(t *testing.T) {
+	useTestMailbox(t)
+	self.Name = "stevejobs@there.com"
+	useSieve(t, `require "vacation"; vacation "I am away";`)
+
+	// The email doesn't fit in the mailbox, the reply would. A mailing list
+	// is never answered, the email comes from the sender directly
+	email := sieveEmail
+	email.UUID = newTestUUID(t)
+	email.Headers = nil
+	email.Body = strings.Repeat("Too large to fit\n", 100)
+	quotaBytes = 1000
+
+	if _, err := deliver(email); err != errQuotaExceeded {
+		t.Fatalf("got %v, want the mailbox full", err)
+	}
+
+	if ids, _ := mailbox.IDs(OUTBOX); len(ids) != 0 {
+		t.Errorf("the sender got %d automatic replies to a bounced email", len(ids))
+	}
+
+	// Once the email is stored, the sender is answered
+	quotaBytes = 0
+
+	if _, err := deliver(email); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, _ := mailbox.IDs(OUTBOX)
+	if len(ids) != 1 {
+		t.Fatalf("outbox: got %d automatic replies, want 1", len(ids))
+	}
+
+	if status := lastStatus(ids[0]); status != statusQueued {
+		t.Errorf("got status %q, want %q", status, statusQueued)
+	}
+}
+
+func TestDeliverReject(t *testing.T) {
+	useTestMailbox(t)
+	useSieve(t, `require "reject"; reject "Not here";`)
+
+	email := sieveEmail
+	email.UUID = newTestUUID(t)
+
+	if reason, err := deliver(email); reason != "Not here" || err != nil {
+		t.Fatalf("got %q %v", reason, err)
+	}
+
+	if ids, _ := mailbox.IDs(INBOX); len(ids) != 0 {
+		t.Errorf("Inbox: got %d emails, want none", len(ids))
+	}
+}
+
+// newTestUUID returns a new UUID for an email of a test
+func newTestUUID(t *testing.T) uuid.UUID {
+	id, err := uuid.NewUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func TestRedirect(t *testing.T) {
+	useTestMailbox(t)
+	self.Name = "stevejobs@there.com"
+
+	if err := redirect(sieveEmail, "assistant@there.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := mailbox.IDs(OUTBOX)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("outbox: got %v %v, want one email", ids, err)
+	}
+
+	redirected, err := mailbox.Read(OUTBOX, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch {
+	case redirected.From != self.Name || redirected.To != "assistant@there.com":
+		t.Errorf("redirected from %q to %q", redirected.From, redirected.To)
+	case redirected.Headers["Reply-To"] != sieveEmail.From:
+		t.Errorf("Reply-To: got %q", redirected.Headers["Reply-To"])
+	case redirected.Headers[redirectedBy] != self.Name:
+		t.Errorf("%s: got %q", redirectedBy, redirected.Headers[redirectedBy])
+	}
+
+	// The email comes back after going round the mailboxes
+	self.Name = "assistant@there.com"
+	looped := redirected
+	looped.Headers = map[string]string{redirectedBy: "stevejobs@there.com, Assistant@there.com"}
+
+	if err := redirect(looped, "stevejobs@there.com"); err != errRedirectLoop {
+		t.Errorf("redirecting an email twice: got %v", err)
+	}
+
+	if ids, _ := mailbox.IDs(OUTBOX); len(ids) != 1 {
+		t.Errorf("outbox: got %d emails after a loop, want 1", len(ids))
+	}
+
+	if !strings.Contains(redirected.Headers[redirectedBy], "stevejobs") {
+		t.Errorf("the redirected email lost its %s header", redirectedBy)
+	}
+}
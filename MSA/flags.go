@@ -0,0 +1,176 @@
+/*
+flags.go handles the flags of the messages in the mailbox
+The flags of a message are kept by the storage of the mailbox along with the
+email, and follow the email when it is moved or copied
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Flags struct representing the state of a message in the mailbox
+type Flags struct {
+	Seen     bool
+	Flagged  bool
+	Answered bool
+	Draft    bool
+	Keywords []string `json:",omitempty"`
+}
+
+// FlagsRequest struct representing the body of a PATCH request. Each entry is
+// either one of "seen", "flagged", "answered" and "draft", or a keyword
+type FlagsRequest struct {
+	Add    []string
+	Remove []string
+}
+
+// Message struct representing an email along with its flags
+type Message struct {
+	EMail
+	Flags Flags
+}
+
+// readFlags reads the flags of an email. An email which was never flagged has
+// all its flags cleared
+func readFlags(folder string, id string) (Flags, error) {
+	return mailbox.ReadFlags(folder, id)
+}
+
+// writeFlags stores the flags of an email
+func writeFlags(folder string, id string, flags Flags) error {
+	if err := mailbox.WriteFlags(folder, id, flags); err != nil {
+		return err
+	}
+
+	index.setFlags(id, flags)
+
+	publish(Event{Type: eventFlags, Folder: folder, UUID: id, Flags: &flags})
+
+	return nil
+}
+
+// readMessage reads an email from a folder along with its flags
+func readMessage(folder string, id string) (Message, error) {
+	var message Message
+	var err error
+
+	if message.EMail, err = readEmail(folder, id); err != nil {
+		return message, err
+	}
+
+	message.Flags, err = readFlags(folder, id)
+
+	return message, err
+}
+
+// set sets or clears a flag. Any name which isn't a system flag is a keyword
+func (flags *Flags) set(name string, value bool) {
+	switch strings.ToLower(name) {
+	case "seen":
+		flags.Seen = value
+	case "flagged":
+		flags.Flagged = value
+	case "answered":
+		flags.Answered = value
+	case "draft":
+		flags.Draft = value
+	default:
+		flags.setKeyword(name, value)
+	}
+}
+
+// setKeyword adds or removes a keyword, keeping each keyword only once
+func (flags *Flags) setKeyword(keyword string, value bool) {
+	keywords := flags.Keywords[:0]
+
+	for _, existing := range flags.Keywords {
+		if existing != keyword {
+			keywords = append(keywords, existing)
+		}
+	}
+
+	if value {
+		keywords = append(keywords, keyword)
+	}
+
+	flags.Keywords = keywords
+}
+
+// updateFlags applies a function to the flags of an email and stores them
+func updateFlags(folder string, id string, update func(*Flags)) (Flags, error) {
+	// Make sure the email exists before flagging it
+	if _, err := readEmail(folder, id); err != nil {
+		return Flags{}, err
+	}
+
+	flags, err := readFlags(folder, id)
+	if err != nil {
+		return flags, err
+	}
+
+	update(&flags)
+
+	return flags, writeFlags(folder, id, flags)
+}
+
+// MSASetFlags gets called from the handleRequests method
+// It sets and clears the flags of a message, then sends back its new flags
+func MSASetFlags(folder string) func(w http.ResponseWriter, r *http.Request) {
+
+	// This is so that we can pass in an argument (folder)
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request FlagsRequest
+
+		id := mux.Vars(r)["uuid"]
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		if err := json.Unmarshal(body, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Print(err.Error())
+			return
+		}
+
+		flags, err := updateFlags(folder, id, func(flags *Flags) {
+			for _, name := range request.Add {
+				flags.set(name, true)
+			}
+			for _, name := range request.Remove {
+				flags.set(name, false)
+			}
+		})
+
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
+
+		flagsJSON, err := json.Marshal(flags)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		w.Write(flagsJSON)
+	}
+}
+
+// MSASetFlagsInFolder sets the flags of one email of the folder in the URL
+func MSASetFlagsInFolder(w http.ResponseWriter, r *http.Request) {
+	MSASetFlags(mux.Vars(r)["folder"])(w, r)
+}
@@ -0,0 +1,396 @@
+/*
+folders.go handles the folders of the mailbox
+The system folders (Inbox, Outbox, Sent, Drafts and Trash) always exist, and
+the user can create, rename and delete their own folders on top of them
+Emails can be moved or copied between any two folders
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// systemFolders are the folders which can't be renamed or deleted
+var systemFolders = []string{INBOX, OUTBOX, SENT, DRAFTS, TRASH}
+
+var errInvalidFolder = errors.New("invalid folder name")
+var errSystemFolder = errors.New("system folders can't be modified")
+var errFolderExists = errors.New("folder already exists")
+var errEmailExists = errors.New("email already in another folder")
+
+// FolderInfo struct describing a folder of the mailbox
+type FolderInfo struct {
+	Name   string
+	Total  int
+	Unread int
+}
+
+// FolderRequest struct representing the body of the folder requests, used
+// both to name a folder and to designate the destination of a move or copy
+type FolderRequest struct {
+	Name string
+}
+
+// isSystemFolder tells whether the folder is one of the system folders
+func isSystemFolder(folder string) bool {
+	for _, name := range systemFolders {
+		if name == folder {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validFolderName checks the name of a user folder can safely be used as a
+// directory name
+func validFolderName(folder string) bool {
+	return folder != "" && !strings.HasPrefix(folder, ".") &&
+		!strings.ContainsAny(folder, `/\`) && !isSystemFolder(folder)
+}
+
+// errorStatus converts an error from the mailbox to the HTTP status sent back
+func errorStatus(err error) int {
+	switch {
+	case err == errInvalidFolder:
+		return http.StatusBadRequest
+	case err == errSystemFolder:
+		return http.StatusForbidden
+	case err == errFolderExists || err == errEmailExists:
+		return http.StatusConflict
+	case err == errMessageTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case err == errQuotaExceeded:
+		return http.StatusInsufficientStorage
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	case os.IsPermission(err):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// readEmail reads a single email from a folder
+func readEmail(folder string, id string) (EMail, error) {
+	return mailbox.Read(folder, id)
+}
+
+// writeEmail writes the email to a folder, under its own UUID, as long as it
+// fits in the quota of the mailbox
+func writeEmail(folder string, email EMail) error {
+	if err := checkQuota(email); err != nil {
+		return err
+	}
+
+	if err := mailbox.Write(folder, email); err != nil {
+		return err
+	}
+
+	index.add(folder, email)
+
+	return nil
+}
+
+// listEmails reads all the emails in a folder. Emails which can't be read
+// are logged and skipped
+func listEmails(folder string) ([]EMail, error) {
+	ids, err := mailbox.IDs(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []EMail
+
+	for _, id := range ids {
+		email, err := mailbox.Read(folder, id)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		emails = append(emails, email)
+	}
+
+	return emails, nil
+}
+
+// removeEmail permanently deletes an email and its flags from a folder
+func removeEmail(folder string, id string) error {
+	if err := mailbox.Remove(folder, id); err != nil {
+		return err
+	}
+
+	index.remove(id)
+
+	return nil
+}
+
+// moveEmail moves an email and its flags from one folder to another
+func moveEmail(from string, to string, id string) error {
+	if err := mailbox.Move(from, to, id); err != nil {
+		return err
+	}
+
+	index.move(id, to)
+
+	return nil
+}
+
+// copyEmail copies an email and its flags from one folder to another. The copy
+// is given a new UUID so that both emails can be told apart
+func copyEmail(from string, to string, id string) (EMail, error) {
+	message, err := readMessage(from, id)
+	if err != nil {
+		return message.EMail, err
+	}
+
+	email := message.EMail
+	if email.UUID, err = uuid.NewUUID(); err != nil {
+		return email, err
+	}
+
+	if err := writeEmail(to, email); err != nil {
+		return email, err
+	}
+
+	return email, writeFlags(to, email.UUID.String(), message.Flags)
+}
+
+// trashEmail moves an email to the Trash, or deletes it for good if it
+// already is in the Trash
+func trashEmail(folder string, id string) error {
+	if folder == TRASH {
+		return removeEmail(folder, id)
+	}
+
+	return moveEmail(folder, TRASH, id)
+}
+
+// readFolderRequest unmarshals the body of a folder request
+func readFolderRequest(r *http.Request) (FolderRequest, error) {
+	var request FolderRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return request, err
+	}
+
+	err = json.Unmarshal(body, &request)
+
+	return request, err
+}
+
+// listFolders lists the system folders followed by the user folders
+func listFolders() ([]string, error) {
+	folders, err := mailbox.Folders()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]string{}, systemFolders...), folders...), nil
+}
+
+// MSAListFolders lists all the folders of the mailbox with their number of
+// emails
+func MSAListFolders(w http.ResponseWriter, r *http.Request) {
+	names, err := listFolders()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	var folders []FolderInfo
+
+	for _, name := range names {
+		total, unread := index.count(name)
+		folders = append(folders, FolderInfo{name, total, unread})
+	}
+
+	foldersJSON, err := json.Marshal(folders)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(foldersJSON)
+}
+
+// MSACreateFolder creates a new user folder
+func MSACreateFolder(w http.ResponseWriter, r *http.Request) {
+	request, err := readFolderRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	if !validFolderName(request.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Invalid folder name : " + request.Name)
+		return
+	}
+
+	if err := mailbox.CreateFolder(request.Name); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Created folder " + request.Name)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// MSARenameFolder renames a user folder
+func MSARenameFolder(w http.ResponseWriter, r *http.Request) {
+	folder := mux.Vars(r)["folder"]
+
+	request, err := readFolderRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	err = renameFolder(folder, request.Name)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Renamed folder " + folder + " to " + request.Name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// renameFolder renames a user folder, checking both names are valid
+func renameFolder(folder string, name string) error {
+	if isSystemFolder(folder) {
+		return errSystemFolder
+	} else if !validFolderName(name) {
+		return errInvalidFolder
+	}
+
+	if err := mailbox.RenameFolder(folder, name); err != nil {
+		return err
+	}
+
+	index.renameFolder(folder, name)
+
+	return nil
+}
+
+// MSADeleteFolder deletes a user folder, moving all its emails to the Trash
+func MSADeleteFolder(w http.ResponseWriter, r *http.Request) {
+	folder := mux.Vars(r)["folder"]
+
+	if isSystemFolder(folder) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	emails, err := listEmails(folder)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	for _, email := range emails {
+		if err := moveEmail(folder, TRASH, email.UUID.String()); err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
+	}
+
+	if err := mailbox.DeleteFolder(folder); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Deleted folder " + folder)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSAReadFolder reads all the emails of the folder given in the URL
+func MSAReadFolder(w http.ResponseWriter, r *http.Request) {
+	MSAReadAll(mux.Vars(r)["folder"])(w, r)
+}
+
+// MSAReadInFolder reads one email of the folder given in the URL
+func MSAReadInFolder(w http.ResponseWriter, r *http.Request) {
+	MSARead(mux.Vars(r)["folder"])(w, r)
+}
+
+// MSADeleteInFolder deletes one email of the folder given in the URL
+func MSADeleteInFolder(w http.ResponseWriter, r *http.Request) {
+	MSADelete(mux.Vars(r)["folder"])(w, r)
+}
+
+// MSAMove moves an email to the folder given in the body of the request
+func MSAMove(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	request, err := readFolderRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	if err := moveEmail(vars["folder"], request.Name, vars["uuid"]); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	log.Printf("Moved email %s from %s to %s\n", vars["uuid"], vars["folder"],
+		request.Name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSACopy copies an email to the folder given in the body of the request, and
+// sends back the copy
+func MSACopy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	request, err := readFolderRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	email, err := copyEmail(vars["folder"], request.Name, vars["uuid"])
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	emailJSON, err := json.Marshal(email)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	log.Printf("Copied email %s from %s to %s\n", vars["uuid"], vars["folder"],
+		request.Name)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(emailJSON)
+}
@@ -0,0 +1,279 @@
+/*
+listing.go handles the listing of the emails of a folder
+Folders are listed from the search index rather than from the disk, one page
+at a time: the emails are filtered, sorted, and only the emails of the page
+requested are read from the folder, unless a summary without the bodies is
+enough
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPageSize is the number of emails listed when no limit is given
+const defaultPageSize = 100
+
+// maxPageSize is the maximum number of emails listed at once
+const maxPageSize = 1000
+
+var errBadListing = errors.New("invalid listing parameters")
+
+// ListOptions struct representing the parameters of a folder listing
+type ListOptions struct {
+	Limit   int
+	Cursor  string
+	Sort    string
+	Desc    bool
+	From    string
+	To      string
+	Unread  bool
+	After   time.Time
+	Before  time.Time
+	Summary bool
+}
+
+// Summary struct representing an email without its body
+type Summary struct {
+	UUID string
+	IndexedDoc
+}
+
+// FolderSummary struct representing a page of a folder in summary mode
+type FolderSummary struct {
+	Emails []Summary
+	Total  int
+	Unread int
+	Next   string `json:",omitempty"`
+}
+
+// listEntry is an email of the index along with the key it is sorted by
+type listEntry struct {
+	key string
+	id  string
+	doc *IndexedDoc
+}
+
+// parseListOptions reads the parameters of a listing from the URL query:
+// limit, cursor, sort (date, from, to, subject), order (asc, desc), from, to,
+// unread, after, before and summary
+func parseListOptions(query url.Values) (ListOptions, error) {
+	options := ListOptions{
+		Limit:  defaultPageSize,
+		Cursor: query.Get("cursor"),
+		Sort:   "date",
+		From:   strings.ToLower(query.Get("from")),
+		To:     strings.ToLower(query.Get("to")),
+	}
+
+	var err error
+
+	if limit := query.Get("limit"); limit != "" {
+		options.Limit, err = strconv.Atoi(limit)
+		if err != nil || options.Limit <= 0 || options.Limit > maxPageSize {
+			return options, errBadListing
+		}
+	}
+
+	if sortBy := query.Get("sort"); sortBy != "" {
+		switch sortBy {
+		case "date", "from", "to", "subject":
+			options.Sort = sortBy
+		default:
+			return options, errBadListing
+		}
+	}
+
+	// The most recent emails come first, everything else is alphabetical
+	switch query.Get("order") {
+	case "":
+		options.Desc = options.Sort == "date"
+	case "asc":
+		options.Desc = false
+	case "desc":
+		options.Desc = true
+	default:
+		return options, errBadListing
+	}
+
+	if after := query.Get("after"); after != "" {
+		if options.After, err = parseDate(after); err != nil {
+			return options, errBadListing
+		}
+	}
+
+	if before := query.Get("before"); before != "" {
+		if options.Before, err = parseDate(before); err != nil {
+			return options, errBadListing
+		}
+	}
+
+	options.Unread = query.Get("unread") == "true"
+	options.Summary = query.Get("summary") == "true"
+
+	return options, nil
+}
+
+// parseDate parses either a day (2020-02-12) or a full RFC 3339 timestamp
+func parseDate(value string) (time.Time, error) {
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// matches tells whether an email passes the filters of the listing
+func (options ListOptions) matches(doc *IndexedDoc) bool {
+	switch {
+	case options.From != "" &&
+		!strings.Contains(strings.ToLower(doc.From), options.From):
+		return false
+	case options.To != "" &&
+		!strings.Contains(strings.ToLower(doc.To), options.To):
+		return false
+	case options.Unread && doc.Flags.Seen:
+		return false
+	case !options.After.IsZero() && doc.Date.Before(options.After):
+		return false
+	case !options.Before.IsZero() && !doc.Date.Before(options.Before):
+		return false
+	}
+
+	return true
+}
+
+// sortKey returns the value an email is sorted by. Dates are formatted so
+// that they sort in chronological order
+func sortKey(doc *IndexedDoc, sortBy string) string {
+	switch sortBy {
+	case "from":
+		return strings.ToLower(doc.From)
+	case "to":
+		return strings.ToLower(doc.To)
+	case "subject":
+		return strings.ToLower(doc.Subject)
+	default:
+		return doc.Date.UTC().Format("20060102150405.000000000")
+	}
+}
+
+// before tells whether an entry comes before a key and UUID in the listing
+// order. Emails sharing the same key are ordered by UUID
+func (entry listEntry) before(key string, id string, desc bool) bool {
+	if entry.key != key {
+		return (entry.key < key) != desc
+	}
+
+	return (entry.id < id) != desc
+}
+
+// encodeCursor builds the cursor pointing after the entry
+func encodeCursor(entry listEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(entry.key + "\x00" +
+		entry.id))
+}
+
+// decodeCursor reads the key and UUID of the entry a cursor points after
+func decodeCursor(cursor string) (string, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", errBadListing
+	}
+
+	parts := strings.SplitN(string(data), "\x00", 2)
+	if len(parts) != 2 {
+		return "", "", errBadListing
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// count returns the number of emails of a folder, and how many are unread
+func (index *SearchIndex) count(folder string) (int, int) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	total, unread := 0, 0
+
+	for _, doc := range index.Docs {
+		if doc.Folder == folder {
+			total++
+
+			if !doc.Flags.Seen {
+				unread++
+			}
+		}
+	}
+
+	return total, unread
+}
+
+// list returns a page of the emails of a folder matching the listing options,
+// along with the number of emails matching, the number of unread emails in
+// the folder, and the cursor to the next page if there is one
+func (index *SearchIndex) list(folder string, options ListOptions) (
+	[]Summary, int, int, string, error) {
+
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	var entries []listEntry
+	unread := 0
+
+	for id, doc := range index.Docs {
+		if doc.Folder != folder {
+			continue
+		}
+
+		if !doc.Flags.Seen {
+			unread++
+		}
+
+		if options.matches(doc) {
+			entries = append(entries, listEntry{sortKey(doc, options.Sort), id, doc})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].before(entries[j].key, entries[j].id, options.Desc)
+	})
+
+	start := 0
+
+	if options.Cursor != "" {
+		key, id, err := decodeCursor(options.Cursor)
+		if err != nil {
+			return nil, 0, 0, "", err
+		}
+
+		start = sort.Search(len(entries), func(i int) bool {
+			return !entries[i].before(key, id, options.Desc) &&
+				(entries[i].key != key || entries[i].id != id)
+		})
+	}
+
+	end := start + options.Limit
+	next := ""
+
+	if end < len(entries) {
+		next = encodeCursor(entries[end-1])
+	} else {
+		end = len(entries)
+	}
+
+	page := make([]Summary, 0, end-start)
+
+	for _, entry := range entries[start:end] {
+		page = append(page, Summary{UUID: entry.id, IndexedDoc: *entry.doc})
+	}
+
+	return page, len(entries), unread, next, nil
+}
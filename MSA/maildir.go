@@ -0,0 +1,529 @@
+/*
+maildir.go stores the mailbox as a Maildir++ directory
+The Inbox is the Maildir itself and every other folder is a ".<name>"
+subdirectory of it, each one with the usual tmp, new and cur directories
+An email is written to tmp and then renamed into new, so that it is never
+seen half written. Its flags are kept in its file name once it is in cur,
+the keywords being mapped to letters by the "dovecot-keywords" file of the
+folder. The emails are stored in the RFC 5322 format, and the UUID of an
+email is the unique part of its file name
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MAILDIR is the directory of the mailbox with the maildir storage
+const MAILDIR = "Maildir"
+
+// maildirFlags maps the flags of a message to the letters of the file names
+var maildirFlags = []struct {
+	letter byte
+	name   string
+}{{'D', "draft"}, {'F', "flagged"}, {'R', "answered"}, {'S', "seen"}}
+
+// keywordsMutex protects the dovecot-keywords files
+var keywordsMutex sync.Mutex
+
+// maildirMailbox stores the mailbox in the Maildir++ directory at root
+type maildirMailbox struct {
+	root string
+}
+
+// path returns the Maildir of a folder
+func (m maildirMailbox) path(folder string) (string, error) {
+	if folder == INBOX {
+		return m.root, nil
+	} else if !isSystemFolder(folder) && !validFolderName(folder) {
+		return "", errInvalidFolder
+	}
+
+	path := filepath.Join(m.root, "."+folder)
+
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// find returns the path of the file of an email, which is either in new or
+// in cur with its flags appended to its name
+func (m maildirMailbox) find(folder string, id string) (string, error) {
+	dir, err := m.path(folder)
+	if err != nil {
+		return "", err
+	}
+
+	// The UUID ends up in a glob pattern, it has to be checked first
+	if _, err := uuid.Parse(id); err != nil {
+		return "", notExist(id)
+	}
+
+	path := filepath.Join(dir, "new", id)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "cur", id+":2,*"))
+	if err != nil {
+		return "", err
+	} else if len(matches) == 0 {
+		return "", notExist(path)
+	}
+
+	return matches[0], nil
+}
+
+// create creates a Maildir with its tmp, new and cur directories
+func (maildirMailbox) create(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Init creates the system folders, and drops what is left in tmp by a
+// delivery interrupted by a crash
+func (m maildirMailbox) Init() error {
+	for _, folder := range systemFolders {
+		dir := m.root
+		if folder != INBOX {
+			dir = filepath.Join(m.root, "."+folder)
+		}
+
+		if err := m.create(dir); err != nil {
+			return err
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			os.Remove(filepath.Join(dir, "tmp", file.Name()))
+		}
+	}
+
+	return nil
+}
+
+func (m maildirMailbox) Folders() ([]string, error) {
+	files, err := ioutil.ReadDir(m.root)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, file := range files {
+		name := strings.TrimPrefix(file.Name(), ".")
+
+		if file.IsDir() && name != file.Name() && validFolderName(name) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+func (m maildirMailbox) CheckFolder(folder string) error {
+	_, err := m.path(folder)
+
+	return err
+}
+
+func (m maildirMailbox) CreateFolder(folder string) error {
+	if !validFolderName(folder) {
+		return errInvalidFolder
+	}
+
+	dir := filepath.Join(m.root, "."+folder)
+
+	if err := os.Mkdir(dir, 0755); os.IsExist(err) {
+		return errFolderExists
+	} else if err != nil {
+		return err
+	}
+
+	if err := m.create(dir); err != nil {
+		return err
+	}
+
+	// Maildir++ marks the subfolders with an empty maildirfolder file
+	return ioutil.WriteFile(filepath.Join(dir, "maildirfolder"), nil, 0755)
+}
+
+func (m maildirMailbox) RenameFolder(folder string, name string) error {
+	if !validFolderName(name) {
+		return errInvalidFolder
+	}
+
+	src, err := m.path(folder)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(m.root, "."+name)
+	if _, err := os.Stat(dst); err == nil {
+		return errFolderExists
+	}
+
+	return os.Rename(src, dst)
+}
+
+func (m maildirMailbox) DeleteFolder(folder string) error {
+	path, err := m.path(folder)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path)
+}
+
+// IDs lists the emails of new and cur. Emails delivered by another program
+// don't have a UUID for a name, they are given one
+func (m maildirMailbox) IDs(folder string) ([]string, error) {
+	dir, err := m.path(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+
+	for _, sub := range []string{"new", "cur"} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			name := file.Name()
+			if strings.HasPrefix(name, ".") || file.IsDir() {
+				continue
+			}
+
+			id, info := name, ""
+			if colon := strings.Index(name, ":"); colon >= 0 {
+				id, info = name[:colon], name[colon:]
+			}
+
+			if _, err := uuid.Parse(id); err != nil {
+				id = uuid.New().String()
+
+				err := os.Rename(filepath.Join(dir, sub, name),
+					filepath.Join(dir, sub, id+info))
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+func (m maildirMailbox) Read(folder string, id string) (EMail, error) {
+	path, err := m.find(folder, id)
+	if err != nil {
+		return EMail{}, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return EMail{}, err
+	}
+	defer file.Close()
+
+	email, err := ParseEMail(bufio.NewReader(file))
+	if err != nil {
+		return email, err
+	}
+
+	email.UUID, err = uuid.Parse(id)
+
+	return email, err
+}
+
+// Write delivers the email to new through tmp, or replaces the file of the
+// email if it already is in the folder
+func (m maildirMailbox) Write(folder string, email EMail) error {
+	dir, err := m.path(folder)
+	if err != nil {
+		return err
+	}
+
+	data, err := FormatEMail(email)
+	if err != nil {
+		return err
+	}
+
+	id := email.UUID.String()
+
+	dst, err := m.find(folder, id)
+	if os.IsNotExist(err) {
+		if found, err := inOtherFolder(m, folder, id); err != nil {
+			return err
+		} else if found {
+			return errEmailExists
+		}
+
+		dst = filepath.Join(dir, "new", id)
+	} else if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, "tmp", fmt.Sprintf("%s.%d", id, os.Getpid()))
+
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0755)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	return err
+}
+
+func (m maildirMailbox) Remove(folder string, id string) error {
+	path, err := m.find(folder, id)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Move renames the file of the email into the cur directory of the other
+// folder. The keywords are mapped to the letters of the other folder
+func (m maildirMailbox) Move(from string, to string, id string) error {
+	src, err := m.find(from, id)
+	if err != nil {
+		return err
+	}
+
+	dir, err := m.path(to)
+	if err != nil {
+		return err
+	}
+
+	flags, err := m.ReadFlags(from, id)
+	if err != nil {
+		return err
+	}
+
+	info, err := m.info(dir, flags)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(dir, "cur", id+info)
+
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+
+	// The modification time records when the email arrived in the folder, so
+	// that it can be purged from the Trash later on
+	now := time.Now()
+
+	return os.Chtimes(dst, now, now)
+}
+
+func (m maildirMailbox) ModTime(folder string, id string) (time.Time, error) {
+	path, err := m.find(folder, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// ReadFlags reads the flags from the name of the file of the email. The
+// emails still in new have not been seen by any client yet
+func (m maildirMailbox) ReadFlags(folder string, id string) (Flags, error) {
+	var flags Flags
+
+	path, err := m.find(folder, id)
+	if err != nil {
+		return flags, err
+	}
+
+	name := filepath.Base(path)
+	colon := strings.Index(name, ":2,")
+	if colon < 0 {
+		return flags, nil
+	}
+
+	keywords, err := readKeywords(filepath.Dir(filepath.Dir(path)))
+	if err != nil {
+		return flags, err
+	}
+
+	for _, letter := range []byte(name[colon+3:]) {
+		for _, flag := range maildirFlags {
+			if flag.letter == letter {
+				flags.set(flag.name, true)
+			}
+		}
+
+		if i := int(letter - 'a'); letter >= 'a' && i < len(keywords) {
+			flags.setKeyword(keywords[i], true)
+		}
+	}
+
+	return flags, nil
+}
+
+// WriteFlags renames the file of the email into cur with its new flags
+func (m maildirMailbox) WriteFlags(folder string, id string, flags Flags) error {
+	src, err := m.find(folder, id)
+	if err != nil {
+		return err
+	}
+
+	dir, err := m.path(folder)
+	if err != nil {
+		return err
+	}
+
+	info, err := m.info(dir, flags)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(src, filepath.Join(dir, "cur", id+info))
+}
+
+// info builds the part of a file name which holds the flags, the letters
+// being sorted as the Maildir specification requires
+func (m maildirMailbox) info(dir string, flags Flags) (string, error) {
+	var letters []byte
+
+	for _, flag := range maildirFlags {
+		if (flag.name == "draft" && flags.Draft) ||
+			(flag.name == "flagged" && flags.Flagged) ||
+			(flag.name == "answered" && flags.Answered) ||
+			(flag.name == "seen" && flags.Seen) {
+			letters = append(letters, flag.letter)
+		}
+	}
+
+	for _, keyword := range flags.Keywords {
+		letter, err := keywordLetter(dir, keyword)
+		if err != nil {
+			return "", err
+		}
+
+		letters = append(letters, letter)
+	}
+
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+
+	return ":2," + string(letters), nil
+}
+
+// readKeywords reads the keywords of a folder from its dovecot-keywords file,
+// the keyword at index i being stored as the letter 'a'+i
+func readKeywords(dir string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dovecot-keywords"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keywords := make([]string, 26)
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		if i, err := strconv.Atoi(fields[0]); err == nil && i >= 0 && i < len(keywords) {
+			keywords[i] = fields[1]
+		}
+	}
+
+	return keywords, nil
+}
+
+// keywordLetter returns the letter of a keyword in a folder, adding the
+// keyword to the dovecot-keywords file if it's new. A folder can only hold 26
+// keywords
+func keywordLetter(dir string, keyword string) (byte, error) {
+	keywordsMutex.Lock()
+	defer keywordsMutex.Unlock()
+
+	keywords, err := readKeywords(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	free := -1
+
+	for i, existing := range keywords {
+		if existing == keyword {
+			return byte('a' + i), nil
+		} else if existing == "" && free < 0 {
+			free = i
+		}
+	}
+
+	if keywords == nil {
+		keywords, free = make([]string, 26), 0
+	} else if free < 0 {
+		return 0, fmt.Errorf("too many keywords in %s", dir)
+	}
+
+	keywords[free] = keyword
+
+	var data bytes.Buffer
+	for i, existing := range keywords {
+		if existing != "" {
+			fmt.Fprintf(&data, "%d %s\n", i, existing)
+		}
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, "dovecot-keywords"), data.Bytes())
+
+	return byte('a' + free), err
+}
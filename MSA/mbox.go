@@ -0,0 +1,392 @@
+/*
+mbox.go handles the import and export of whole folders as mbox files
+Folders are exported in the mboxrd format: every email starts with a
+"From " line, and the lines of the emails starting with "From " are quoted
+with a ">", as are the lines which were already quoted
+The Seen, Answered, Flagged and Draft flags are kept in the Status and
+X-Status headers, as most mail clients do
+Imported emails keep their original dates, and an email whose Message-ID is
+already in the folder is skipped. The progress of an import is streamed
+back as one JSON object per line
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// progressInterval is the number of emails imported between two progress
+// reports
+const progressInterval = 100
+
+// fromLine matches the lines which have to be quoted in the mboxrd format
+var fromLine = regexp.MustCompile(`^>*From `)
+
+// ImportProgress struct representing the progress of an import
+type ImportProgress struct {
+	Imported   int
+	Duplicates int
+	Failed     int
+	Done       bool
+	Error      string `json:",omitempty"`
+}
+
+// statusHeaders adds the flags of a message to the headers of its email
+func statusHeaders(message Message) EMail {
+	email := message.EMail
+
+	status, xstatus := "O", ""
+	if message.Flags.Seen {
+		status = "RO"
+	}
+	if message.Flags.Answered {
+		xstatus += "A"
+	}
+	if message.Flags.Flagged {
+		xstatus += "F"
+	}
+	if message.Flags.Draft {
+		xstatus += "D"
+	}
+
+	email.Headers = make(map[string]string, len(message.Headers)+2)
+	for name, value := range message.Headers {
+		email.Headers[name] = value
+	}
+
+	email.Headers["Status"] = status
+	if xstatus != "" {
+		email.Headers["X-Status"] = xstatus
+	}
+
+	return email
+}
+
+// statusFlags reads the flags of an imported email from its headers, and
+// removes them from the email
+func statusFlags(email *EMail) Flags {
+	var flags Flags
+
+	flags.Seen = strings.Contains(email.Headers["Status"], "R")
+	flags.Answered = strings.Contains(email.Headers["X-Status"], "A")
+	flags.Flagged = strings.Contains(email.Headers["X-Status"], "F")
+	flags.Draft = strings.Contains(email.Headers["X-Status"], "D")
+
+	delete(email.Headers, "Status")
+	delete(email.Headers, "X-Status")
+
+	if len(email.Headers) == 0 {
+		email.Headers = nil
+	}
+
+	return flags
+}
+
+// writeMbox writes an email to an mbox file
+func writeMbox(writer io.Writer, message Message) error {
+	raw, err := FormatEMail(statusHeaders(message))
+	if err != nil {
+		return err
+	}
+
+	sender := "MAILER-DAEMON"
+	if addresses := parseAddressList(message.From); len(addresses) > 0 {
+		sender = addresses[0]
+	}
+
+	var mbox bytes.Buffer
+
+	mbox.WriteString("From " + sender + " " +
+		message.Date.UTC().Format(time.ANSIC) + "\n")
+
+	for _, line := range strings.SplitAfter(string(raw), "\n") {
+		if line == "" {
+			continue
+		}
+
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if fromLine.MatchString(line) {
+			mbox.WriteString(">")
+		}
+
+		mbox.WriteString(line + "\n")
+	}
+
+	mbox.WriteString("\n")
+
+	_, err = writer.Write(mbox.Bytes())
+
+	return err
+}
+
+// mboxReader reads the emails of an mbox file one at a time
+type mboxReader struct {
+	reader *bufio.Reader
+	from   string
+}
+
+// next reads the next email of the mbox file, along with the date of its
+// "From " line. It returns io.EOF once all the emails were read
+func (m *mboxReader) next() ([]byte, time.Time, error) {
+	// Skip anything before the first "From " line
+	for m.from == "" {
+		line, err := m.reader.ReadString('\n')
+		if strings.HasPrefix(line, "From ") {
+			m.from = line
+		} else if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	var date time.Time
+	if fields := strings.Fields(m.from); len(fields) > 2 {
+		date, _ = time.Parse(time.ANSIC, strings.Join(fields[2:], " "))
+	}
+
+	var message bytes.Buffer
+	tooLarge, blank := false, false
+
+	for {
+		line, err := m.reader.ReadString('\n')
+
+		// A "From " line following a blank line starts the next email
+		if strings.HasPrefix(line, "From ") && (blank || message.Len() == 0) {
+			m.from = line
+			break
+		}
+
+		if err != nil && line == "" {
+			m.from = ""
+			if err != io.EOF {
+				return nil, date, err
+			}
+			break
+		}
+
+		// The blank line separating two emails isn't part of the email
+		if blank {
+			message.WriteString("\n")
+		}
+		blank = strings.TrimRight(line, "\r\n") == ""
+		if blank {
+			continue
+		}
+
+		if fromLine.MatchString(line) {
+			line = line[1:]
+		}
+
+		if message.Len()+len(line) > maxMessageSize {
+			tooLarge = true
+		} else {
+			message.WriteString(line)
+		}
+	}
+
+	if tooLarge {
+		return nil, date, errMessageTooLarge
+	}
+
+	return message.Bytes(), date, nil
+}
+
+// messageIDs lists the Message-IDs of the emails of a folder
+func messageIDs(folder string) map[string]bool {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	ids := make(map[string]bool)
+
+	for _, doc := range index.Docs {
+		if doc.Folder == folder && doc.MessageID != "" {
+			ids[doc.MessageID] = true
+		}
+	}
+
+	return ids
+}
+
+// MSAExport gets called from the handleRequests method
+// It streams all the emails of a folder, the Inbox by default, as an mbox
+// file in chronological order
+func MSAExport(w http.ResponseWriter, r *http.Request) {
+	folder := r.URL.Query().Get("folder")
+	if folder == "" {
+		folder = INBOX
+	}
+
+	if format := r.URL.Query().Get("format"); format != "" && format != "mbox" {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Unknown export format : " + format)
+		return
+	}
+
+	if err := mailbox.CheckFolder(folder); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	total, _ := index.count(folder)
+
+	page, _, _, _, err := index.list(folder, ListOptions{
+		Limit: total,
+		Sort:  "date",
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/mbox")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+folder+`.mbox"`)
+	w.WriteHeader(http.StatusOK)
+
+	for _, summary := range page {
+		message, err := readMessage(folder, summary.UUID)
+		if err != nil {
+			// The email was removed since the listing, skip it
+			log.Print(err.Error())
+			continue
+		}
+
+		if err := writeMbox(w, message); err != nil {
+			// The client went away, there's no one left to tell
+			log.Print(err.Error())
+			return
+		}
+	}
+
+	log.Printf("Exported %d emails from %s\n", len(page), folder)
+}
+
+// MSAImport gets called from the handleRequests method
+// It imports the emails of an mbox file to a folder, the Inbox by default,
+// and reports its progress every progressInterval emails. The Outbox and the
+// Drafts can't be imported to: what's in the Outbox gets sent, and the Drafts
+// only hold the emails written here
+func MSAImport(w http.ResponseWriter, r *http.Request) {
+	folder := r.URL.Query().Get("folder")
+	if folder == "" {
+		folder = INBOX
+	}
+
+	if folder == OUTBOX || folder == DRAFTS {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Can't import emails to " + folder)
+		return
+	}
+
+	if err := mailbox.CheckFolder(folder); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	var progress ImportProgress
+
+	report := func() {
+		encoder.Encode(progress)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	seen := messageIDs(folder)
+	reader := mboxReader{reader: bufio.NewReader(r.Body)}
+
+	for {
+		raw, date, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err == errMessageTooLarge {
+			progress.Failed++
+			continue
+		} else if err != nil {
+			progress.Error = err.Error()
+			log.Print(err.Error())
+			break
+		}
+
+		if err := importEmail(folder, raw, date, seen, &progress); err != nil {
+			progress.Failed++
+			log.Print(err.Error())
+		}
+
+		if count := progress.Imported + progress.Duplicates + progress.Failed; count%progressInterval == 0 {
+			report()
+		}
+	}
+
+	log.Printf("Imported %d emails to %s, skipped %d duplicates, %d failed\n",
+		progress.Imported, folder, progress.Duplicates, progress.Failed)
+
+	progress.Done = true
+	report()
+}
+
+// importEmail imports one email of an mbox file, unless its Message-ID was
+// seen already. The date of the "From " line is used when the email has none
+func importEmail(folder string, raw []byte, date time.Time,
+	seen map[string]bool, progress *ImportProgress) error {
+
+	email, err := ParseEMail(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+
+	if email.From == "" {
+		return errNoAddress
+	}
+
+	if email.MessageID != "" && seen[email.MessageID] {
+		progress.Duplicates++
+		return nil
+	}
+
+	if email.UUID, err = uuid.NewUUID(); err != nil {
+		return err
+	}
+
+	if email.Date.IsZero() {
+		email.Date = date
+	}
+	if email.Date.IsZero() {
+		email.Date = time.Now()
+	}
+	if email.MessageID == "" {
+		email.MessageID = newMessageID(email.UUID)
+	}
+
+	flags := statusFlags(&email)
+
+	if err := writeEmail(folder, email); err != nil {
+		return err
+	}
+	if err := writeFlags(folder, email.UUID.String(), flags); err != nil {
+		return err
+	}
+
+	seen[email.MessageID] = true
+	progress.Imported++
+
+	return nil
+}
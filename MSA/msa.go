@@ -13,20 +13,37 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
 func main() {
-
-	if len(os.Args) < 2 {
+	trashDays := flag.Int("trash-days", 30,
+		"number of days after which emails in the Trash are purged, unless "+
+			"retention rules were saved")
+	storage := flag.String("storage", "files",
+		"storage of the mailbox: files, maildir or bolt")
+	migrate := flag.Bool("migrate", false,
+		"copy the mailbox stored as files to the storage given, then exit")
+	flag.Int64Var(&quotaBytes, "quota-bytes", 1<<30,
+		"maximum size of the mailbox in bytes, 0 for no limit")
+	flag.IntVar(&quotaMessages, "quota-messages", 100000,
+		"maximum number of emails in the mailbox, 0 for no limit")
+	undoSeconds := flag.Int("undo-seconds", 10,
+		"number of seconds during which an email sent can be cancelled")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
 		fmt.Println("To run the MSA service, please provide a user name.")
 		fmt.Println("e.g 'go run mta.go user@domain.com'")
 		fmt.Println("or with Docker: 'docker run MSA-image user@domain.com'")
@@ -34,10 +51,29 @@ func main() {
 		os.Exit(1)
 	}
 
-	CreateDirIfNotExist("Outbox")
-	CreateDirIfNotExist("Inbox")
+	undoWindow = time.Duration(*undoSeconds) * time.Second
+
+	var err error
+	if mailbox, err = newMailbox(*storage, "."); err != nil {
+		log.Fatal(err.Error() + " : " + *storage)
+	}
+
+	if *migrate {
+		if err := migrateMailbox(fileMailbox{"."}, mailbox); err != nil {
+			log.Fatal(err.Error())
+		}
+
+		log.Println("Migrated the mailbox to " + *storage)
+		return
+	}
+
+	if err := mailbox.Init(); err != nil {
+		log.Fatal(err.Error())
+	}
+	CreateDirIfNotExist(INDEX)
+	CreateDirIfNotExist(SETTINGS)
 
-	self.Name = os.Args[1]
+	self.Name = flag.Arg(0)
 
 	// Register with the correct MTA
 	self.Address = "http://" + GetOutboundIP() + ":8888/"
@@ -47,6 +83,27 @@ func main() {
 	// serving requests independently of whether the MSA and Blue Book work or not
 	go register(self)
 
+	// Catch up with the emails written since the index was last saved, then
+	// keep saving it in the background
+	index.load()
+	go saveIndex(5 * time.Second)
+
+	// Expire the emails in the background, the Trash included
+	loadRetention(*trashDays)
+	go sweepRetention(time.Hour)
+
+	// Filter the emails received with the active Sieve script, if any, and
+	// reply to them while the user is away
+	loadSieve()
+	loadVacation()
+
+	// Call the webhooks back in the background, with the deliveries left from
+	// the last run first
+	loadWebhooks()
+	go deliverWebhooks(time.Second)
+
+	loadContacts()
+
 	handleRequests()
 }
 
@@ -57,45 +114,219 @@ func handleRequests() {
 	// MTA 'service' methods
 	router.HandleFunc("/email/outbox", MSAReceive).Methods("POST")
 	router.HandleFunc("/email/outbox", MSAReadAll(OUTBOX)).Methods("GET")
+	router.HandleFunc("/email/outbox/{uuid}", MSARead(OUTBOX)).Methods("GET")
 	router.HandleFunc("/email/outbox/{uuid}", MSADelete(OUTBOX)).Methods("DELETE")
+	router.HandleFunc("/email/outbox/{uuid}/sent", MSASent).Methods("POST")
+	router.HandleFunc("/email/outbox/{uuid}/status", MSAReportStatus).Methods("POST")
+	router.HandleFunc("/email/outbox/{uuid}/status", MSAReadStatus).Methods("GET")
+
+	// Draft methods
+	router.HandleFunc("/email/drafts", MSASaveDraft).Methods("POST")
+	router.HandleFunc("/email/drafts", MSAReadAll(DRAFTS)).Methods("GET")
+	router.HandleFunc("/email/drafts/{uuid}", MSAReadDraft).Methods("GET")
+	router.HandleFunc("/email/drafts/{uuid}", MSAUpdateDraft).Methods("PUT")
+	router.HandleFunc("/email/drafts/{uuid}", MSADeleteDraft).Methods("DELETE")
+	router.HandleFunc("/email/drafts/{uuid}/send", MSASendDraft).Methods("POST")
+	router.HandleFunc("/email/drafts/{uuid}/versions", MSAListDraftVersions).Methods("GET")
+	router.HandleFunc("/email/drafts/{uuid}/versions/{version}", MSAReadDraftVersion).Methods("GET")
+	router.HandleFunc("/email/drafts/{uuid}/versions/{version}/restore", MSARestoreDraftVersion).Methods("POST")
 
 	// Client methods
+	router.HandleFunc("/email/search", MSASearch).Methods("GET")
+	router.HandleFunc("/email/scheduled", MSAListScheduled).Methods("GET")
+	router.HandleFunc("/email/scheduled/{uuid}", MSAReschedule).Methods("PUT")
+	router.HandleFunc("/email/quota", MSAQuota).Methods("GET")
+	router.HandleFunc("/email/export", MSAExport).Methods("GET")
+	router.HandleFunc("/email/import", MSAImport).Methods("POST")
 	router.HandleFunc("/email", MSASend).Methods("POST")
+	router.HandleFunc("/email/raw", MSAWriteRaw).Methods("POST")
 	router.HandleFunc("/email", MSAReadAll(INBOX)).Methods("GET")
-	router.HandleFunc("/email/{uuid}", MSARead).Methods("GET")
+	router.HandleFunc("/email/{uuid}", MSARead(INBOX)).Methods("GET")
 	router.HandleFunc("/email/{uuid}", MSADelete(INBOX)).Methods("DELETE")
+	router.HandleFunc("/email/{uuid}", MSASetFlags(INBOX)).Methods("PATCH")
+	router.HandleFunc("/email/{uuid}/attachments/{id}", MSAAttachment(INBOX)).Methods("GET")
+	router.HandleFunc("/email/{uuid}/raw", MSAReadRaw(INBOX)).Methods("GET")
+	router.HandleFunc("/email/{uuid}/hold", MSAHold(INBOX, true)).Methods("PUT")
+	router.HandleFunc("/email/{uuid}/hold", MSAHold(INBOX, false)).Methods("DELETE")
+	router.HandleFunc("/email/{uuid}/reply", MSACompose(INBOX, composeReply)).Methods("POST")
+	router.HandleFunc("/email/{uuid}/reply-all", MSACompose(INBOX, composeReplyAll)).Methods("POST")
+	router.HandleFunc("/email/{uuid}/forward", MSACompose(INBOX, composeForward)).Methods("POST")
+
+	// Thread methods
+	router.HandleFunc("/threads", MSAListThreads).Methods("GET")
+	router.HandleFunc("/threads/{id}", MSAReadThread).Methods("GET")
+
+	// Folder methods
+	router.HandleFunc("/folders", MSAListFolders).Methods("GET")
+	router.HandleFunc("/folders", MSACreateFolder).Methods("POST")
+	router.HandleFunc("/folders/{folder}", MSAReadFolder).Methods("GET")
+	router.HandleFunc("/folders/{folder}", MSARenameFolder).Methods("PUT")
+	router.HandleFunc("/folders/{folder}", MSADeleteFolder).Methods("DELETE")
+	router.HandleFunc("/folders/{folder}/{uuid}", MSAReadInFolder).Methods("GET")
+	router.HandleFunc("/folders/{folder}/{uuid}", MSADeleteInFolder).Methods("DELETE")
+	router.HandleFunc("/folders/{folder}/{uuid}", MSASetFlagsInFolder).Methods("PATCH")
+	router.HandleFunc("/folders/{folder}/{uuid}/attachments/{id}", MSAAttachmentInFolder).Methods("GET")
+	router.HandleFunc("/folders/{folder}/{uuid}/raw", MSAReadRawInFolder).Methods("GET")
+	router.HandleFunc("/folders/{folder}/{uuid}/hold", MSAHoldInFolder(true)).Methods("PUT")
+	router.HandleFunc("/folders/{folder}/{uuid}/hold", MSAHoldInFolder(false)).Methods("DELETE")
+	router.HandleFunc("/folders/{folder}/{uuid}/reply", MSAComposeInFolder(composeReply)).Methods("POST")
+	router.HandleFunc("/folders/{folder}/{uuid}/reply-all", MSAComposeInFolder(composeReplyAll)).Methods("POST")
+	router.HandleFunc("/folders/{folder}/{uuid}/forward", MSAComposeInFolder(composeForward)).Methods("POST")
+	router.HandleFunc("/folders/{folder}/{uuid}/move", MSAMove).Methods("POST")
+	router.HandleFunc("/folders/{folder}/{uuid}/copy", MSACopy).Methods("POST")
+
+	// Retention methods
+	router.HandleFunc("/retention", MSAReadRetention).Methods("GET")
+	router.HandleFunc("/retention", MSAWriteRetention).Methods("PUT")
+	router.HandleFunc("/retention/preview", MSAPreviewRetention).Methods("GET")
+
+	// Sieve methods
+	router.HandleFunc("/sieve", MSAListScripts).Methods("GET")
+	router.HandleFunc("/sieve/validate", MSAValidateScript).Methods("POST")
+	router.HandleFunc("/sieve/deactivate", MSADeactivateScript).Methods("POST")
+	router.HandleFunc("/sieve/{name}", MSAReadScript).Methods("GET")
+	router.HandleFunc("/sieve/{name}", MSAWriteScript).Methods("PUT")
+	router.HandleFunc("/sieve/{name}", MSADeleteScript).Methods("DELETE")
+	router.HandleFunc("/sieve/{name}/activate", MSAActivateScript).Methods("POST")
+
+	// Event methods
+	router.HandleFunc("/events", MSAEvents).Methods("GET")
+	router.HandleFunc("/events/ws", MSAEventsSocket).Methods("GET")
+
+	// Webhook methods
+	router.HandleFunc("/webhooks", MSAListWebhooks).Methods("GET")
+	router.HandleFunc("/webhooks", MSACreateWebhook).Methods("POST")
+	router.HandleFunc("/webhooks/deliveries", MSAWebhookLog).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", MSAReadWebhook).Methods("GET")
+	router.HandleFunc("/webhooks/{id}", MSAUpdateWebhook).Methods("PUT")
+	router.HandleFunc("/webhooks/{id}", MSADeleteWebhook).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id}/deliveries", MSAWebhookLog).Methods("GET")
+
+	// Contact methods
+	router.HandleFunc("/contacts", MSAListContacts).Methods("GET")
+	router.HandleFunc("/contacts", MSACreateContact).Methods("POST")
+	router.HandleFunc("/contacts/search", MSASearchContacts).Methods("GET")
+	router.HandleFunc("/contacts/groups", MSAListGroups).Methods("GET")
+	router.HandleFunc("/contacts/vcard", MSAExportContacts).Methods("GET")
+	router.HandleFunc("/contacts/vcard", MSAImportContacts).Methods("POST")
+	router.HandleFunc("/contacts/{id}", MSAReadContact).Methods("GET")
+	router.HandleFunc("/contacts/{id}", MSAUpdateContact).Methods("PUT")
+	router.HandleFunc("/contacts/{id}", MSADeleteContact).Methods("DELETE")
+
+	// Vacation methods
+	router.HandleFunc("/vacation", MSAReadVacation).Methods("GET")
+	router.HandleFunc("/vacation", MSAWriteVacation).Methods("PUT")
 
 	log.Fatal(http.ListenAndServe(":8888", router))
 }
 
-// MSASend gets called from the handleRequests method
-// It places the raw JSON in the outbox with a UUID, for the MTA to pick
-// it up and handle it
-func MSASend(w http.ResponseWriter, r *http.Request) {
+// queueEmail dates an email written by the user and places it in the outbox,
+// where it waits for its time, or at least for the undo window. The copies of
+// an email come with the Message-ID they share
+func queueEmail(email *EMail) error {
+	email.Date = time.Now()
+	if email.MessageID == "" {
+		email.MessageID = newMessageID(email.UUID)
+	}
+	threadReply(email)
+	schedule(email, email.Date)
 
-	var email EMail
-	rootpath := "Outbox"
+	if err := writeEmail(OUTBOX, *email); err != nil {
+		return err
+	}
 
-	//Create a UUID for the message
-	uuid, err := uuid.NewUUID()
+	recordStatus(email.UUID.String(), queuedStatus(*email))
+
+	return nil
+}
+
+// emailCopies makes a copy of an email for each of its recipients, as the MTA
+// delivers an email to its To only. Any Cc header is kept on every copy, for
+// the recipients to see who else got the email. The first copy keeps the
+// UUID of the email, and all of them share its Message-ID: it's still the one
+// message, replies to any copy belong to the same thread
+func emailCopies(email EMail, recipients []string) ([]EMail, error) {
+	copies := make([]EMail, len(recipients))
+	email.MessageID = newMessageID(email.UUID)
+
+	for i, recipient := range recipients {
+		copies[i] = email
+		copies[i].To = recipient
+
+		if i > 0 {
+			var err error
+			if copies[i].UUID, err = uuid.NewUUID(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return copies, nil
+}
+
+// queueAll places emails in the outbox, all of them or none. They are checked
+// against the quota together, and the ones already queued are taken back if
+// another can't be written, so that the client can simply send them again
+func queueAll(emails []EMail) error {
+	if err := checkQuota(emails...); err != nil {
+		return err
+	}
+
+	for i := range emails {
+		if err := queueEmail(&emails[i]); err != nil {
+			unqueue(emails[:i])
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unqueue takes emails back from the outbox, before the MTA sends them
+func unqueue(emails []EMail) {
+	for _, email := range emails {
+		id := email.UUID.String()
+		if err := removeEmail(OUTBOX, id); err != nil {
+			log.Print(err.Error())
+			continue
+		}
+		droppedEmail(id, false)
+	}
+}
+
+// queueCopies places a copy of an email in the outbox for each of its
+// recipients, and sends back the first one
+func queueCopies(email EMail, recipients []string) (EMail, error) {
+	copies, err := emailCopies(email, recipients)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return email, err
 	}
 
-	filename := uuid.String() + ".email"
-	path := filepath.Join(rootpath, filename)
+	if err := queueAll(copies); err != nil {
+		return email, err
+	}
 
-	//Write the JSON to a file, whose name is the UUID
-	bodyBytes, err := ioutil.ReadAll(r.Body)
+	collectRecipients(EMail{To: strings.Join(recipients, ", ")})
 
+	return copies[0], nil
+}
+
+// MSASend gets called from the handleRequests method
+// It places the email, sent as JSON or as multipart/form-data with its
+// attachments, in the outbox with a UUID, for the MTA to pick it up and
+// handle it
+func MSASend(w http.ResponseWriter, r *http.Request) {
+
+	//Create a UUID for the message
+	id, err := uuid.NewUUID()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		log.Print(err.Error())
 		return
 	}
 
-	err = json.Unmarshal(bodyBytes, &email)
+	//Write the JSON to a file, whose name is the UUID
+	r.Body = http.MaxBytesReader(w, r.Body, maxMessageSize)
+	email, err := readEmailRequest(r)
 
 	if err != nil {
 		// Assume the email is badly formatted and exit
@@ -109,37 +340,40 @@ func MSASend(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	email.UUID = uuid
-
-	bodyBytes, err = json.Marshal(email)
-
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Panic(err.Error())
+	// Groups of the address book are written to member by member, the MTA
+	// delivers an email to its single recipient
+	recipients, err := expandRecipients(email.To)
+	if err != nil || len(recipients) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Unknown recipient " + email.To)
 		return
 	}
 
-	if err := ioutil.WriteFile(path, bodyBytes, 0755); err == nil {
-		w.WriteHeader(http.StatusCreated)
-	} else {
-		//Could not write the message to outbox
-		w.WriteHeader(http.StatusInternalServerError)
+	email.UUID = id
+	if _, err := queueCopies(email, recipients); err != nil {
+		//Could not write the message to outbox, it may not fit in the mailbox
+		w.WriteHeader(errorStatus(err))
 		log.Print(err.Error())
+		return
 	}
+
+	w.WriteHeader(http.StatusCreated)
 }
 
 // MSAReceive unpacks a message and writes it to the inbox
 func MSAReceive(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Print(err.Error())
 		return
+	} else if len(body) > maxRequestSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Println("Received an email too large")
+		return
 	}
 
-	rootpath := "Inbox"
-
 	// if there's an error while creating a UUID, we will use the existing one
 	inboxUUID, err := uuid.NewUUID()
 
@@ -165,27 +399,30 @@ func MSAReceive(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		inboxUUID = email.UUID
 	}
 
-	filePath := filepath.Join(rootpath, inboxUUID.String())
-
-	// Update the email with the new UUID
-	emailJSON, err := json.Marshal(email)
+	if email.Date.IsZero() {
+		email.Date = time.Now()
+	}
 
-	// Problem marshalling the email into JSON... error and inform MTA
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Print(err.Error())
-		return
+	// Emails from older MSAs don't have a Message-ID, make one up
+	if email.MessageID == "" {
+		email.MessageID = newMessageID(email.UUID)
 	}
 
-	err = ioutil.WriteFile(filePath+".email", emailJSON, 0755)
+	// Deliver the email, with its new UUID, to the folders the Sieve script
+	// chooses, the inbox by default
+	reject, err := deliver(email)
 
-	// if there's an error writing to inbox, inform MTA
+	// if there's an error writing to inbox, inform MTA. A full mailbox is
+	// reported with its own status, so that the MTA can bounce the email, as
+	// is an email the script rejects, along with its reason
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(errorStatus(err))
 		log.Print(err.Error())
+	} else if reject != "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(reject))
 	} else {
 		w.WriteHeader(http.StatusOK)
 	}
@@ -194,79 +431,70 @@ func MSAReceive(w http.ResponseWriter, r *http.Request) {
 }
 
 // MSAReadAll gets called from the handleRequests method
-// It reads all the messages in the Inbox folder of the specified user
-// It then sends as a response the UUID and object of each message
-func MSAReadAll(folder int) func(w http.ResponseWriter, r *http.Request) {
+// It reads one page of the messages in the specified folder of the user,
+// filtered and sorted as requested in the URL query (see parseListOptions)
+// It then sends as a response the UUID and object of each message, or only
+// their summary if the bodies aren't needed
+func MSAReadAll(folder string) func(w http.ResponseWriter, r *http.Request) {
 
 	// This is so that we can pass in an argument (folder)
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		// Handle whether we are reading from Inbox or Outbox
-		var rootpath string
-		if folder == INBOX {
-			rootpath = "Inbox"
-		} else if folder == OUTBOX {
-			rootpath = "Outbox"
-		} else {
-			// Not inbox or outbox ? Then nothing.
+		// DEBUG:
+		log.Println("Read all in " + folder)
+
+		options, err := parseListOptions(r.URL.Query())
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
+			log.Print(err.Error())
 			return
 		}
 
-		// DEBUG:
-		log.Println("Read all in " + rootpath)
+		// Make sure the folder exists, the index only knows about its emails
+		if err := mailbox.CheckFolder(folder); err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
 
-		// Read a list of all files in the directory
-		files, err := ioutil.ReadDir(rootpath)
-		log.Printf("There's %d email in %s", len(files), rootpath)
+		page, total, unread, next, err := index.list(folder, options)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			w.WriteHeader(http.StatusBadRequest)
 			log.Print(err.Error())
 			return
 		}
 
-		// Put all the emails in a struct, to be formatted in JSON
-		var folder Folder
+		log.Printf("There's %d email in %s", total, folder)
 
-		for _, file := range files {
-			path := filepath.Join(rootpath, file.Name())
-			fmt.Println(path)
-			var email EMail
-			if data, err := ioutil.ReadFile(path); err == nil {
+		var response interface{}
 
-				err = json.Unmarshal(data, &email)
+		if options.Summary {
+			response = FolderSummary{page, total, unread, next}
+		} else {
+			// Put the emails of the page in a struct, to be formatted in JSON
+			emails := Folder{Total: total, Unread: unread, Next: next}
 
+			for _, summary := range page {
+				message, err := readMessage(folder, summary.UUID)
 				if err != nil {
-					log.Println(err.Error())
+					// The email was removed since the listing, skip it
+					log.Print(err.Error())
 					continue
 				}
 
-				log.Printf("%+v\n", email)
-				folder.Emails = append(folder.Emails, email)
-			} else {
-
-				if os.IsNotExist(err) {
-					w.WriteHeader(http.StatusNotFound)
-					log.Print(err.Error())
-					return
-				} else if os.IsPermission(err) {
-					w.WriteHeader(http.StatusForbidden)
-					log.Print(err.Error())
-					return
-				} else {
-					w.WriteHeader(http.StatusInternalServerError)
-					log.Print(err.Error())
-					return
-				}
+				emails.Emails = append(emails.Emails, message)
 			}
+
+			response = emails
 		}
 
 		// Format the fodler as JSON
-		folderJSON, err := json.Marshal(folder)
+		folderJSON, err := json.Marshal(response)
 
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			log.Print(err.Error())
+			return
 		}
 
 		// Send the response
@@ -275,44 +503,51 @@ func MSAReadAll(folder int) func(w http.ResponseWriter, r *http.Request) {
 }
 
 // MSARead gets called from the handleRequests method
-// It reads a specific message in the inbox
-// It then returns the email metadata and contents
-func MSARead(w http.ResponseWriter, r *http.Request) {
+// It reads a specific message in the specified folder and marks it as seen
+// It then returns the email metadata, contents and flags
+func MSARead(folder string) func(w http.ResponseWriter, r *http.Request) {
 
-	vars := mux.Vars(r)
-	uuid := vars["uuid"]
+	// This is so that we can pass in an argument (folder)
+	return func(w http.ResponseWriter, r *http.Request) {
 
-	rootpath := "Inbox"
+		vars := mux.Vars(r)
+		uuid := vars["uuid"]
 
-	filename := uuid + ".email"
-	path := filepath.Join(rootpath, filename)
-	log.Print(path)
+		log.Printf("Read email %s in %s\n", uuid, folder)
 
-	// Read the data contained in the email
-	files, _ := filepath.Glob("Inbox/*.*")
-	log.Print(files)
+		// Read the data contained in the email
+		message, err := readMessage(folder, uuid)
+		if err != nil {
+			log.Print(err.Error())
+			w.WriteHeader(errorStatus(err))
+			return
+		}
 
-	if data, err := ioutil.ReadFile(path); err == nil {
+		if !message.Flags.Seen {
+			message.Flags.Seen = true
 
-		// Send email data back to user
-		w.WriteHeader(http.StatusOK)
-		w.Write(data)
-	} else if err != nil {
-		log.Print(err.Error())
+			if err := writeFlags(folder, uuid, message.Flags); err != nil {
+				log.Print(err.Error())
+			}
+		}
 
-		if os.IsNotExist(err) {
-			w.WriteHeader(http.StatusNotFound)
-		} else if os.IsPermission(err) {
-			w.WriteHeader(http.StatusForbidden)
-		} else {
+		data, err := json.Marshal(message)
+		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
 		}
+
+		// Send email data back to user
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
 	}
 }
 
 // MSADelete gets called from the handleRequests method
-// It deletes a specific message in the user's Inbox
-func MSADelete(folder int) func(w http.ResponseWriter, r *http.Request) {
+// It moves a specific message of the user to the Trash. Emails already in
+// the Trash, and emails deleted from the Outbox by the MTA are removed for good
+func MSADelete(folder string) func(w http.ResponseWriter, r *http.Request) {
 
 	// This is so that we can pass in an argument (folder)
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -320,36 +555,59 @@ func MSADelete(folder int) func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		uuid := vars["uuid"]
 
-		// Handle whether we are reading from Inbox or Outbox
-		var rootpath string
-		if folder == INBOX {
-			rootpath = "Inbox"
+		log.Printf("Delete email %s in %s\n", uuid, folder)
+
+		var err error
+		if folder == OUTBOX && pendingEmail(uuid) {
+			// The email wasn't sent yet, the user changed their mind
+			if err = cancelSend(uuid); err == nil {
+				log.Printf("Cancelled sending %s\n", uuid)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
 		} else if folder == OUTBOX {
-			rootpath = "Outbox"
+			err = removeEmail(folder, uuid)
 		} else {
-			// Not inbox or outbox ? Then nothing.
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			err = trashEmail(folder, uuid)
 		}
 
-		log.Printf("Delete email %s in %s\n", uuid, rootpath)
-
-		filename := uuid + ".email"
-		path := filepath.Join(rootpath, filename)
-
-		// Delete the email
-		if err := os.Remove(path); err == nil {
+		// Delete the email. The MTA deletes the emails of the outbox it
+		// couldn't deliver
+		if err == nil {
+			if folder == OUTBOX {
+				droppedEmail(uuid, r.Header.Get(mtaHeader) != "")
+			} else {
+				publish(Event{Type: eventDeleted, Folder: folder, UUID: uuid})
+			}
 			w.WriteHeader(http.StatusOK)
 		} else {
 
 			// Or tell us what happened if we can't !
-			if os.IsNotExist(err) {
-				w.WriteHeader(http.StatusNotFound)
-			} else if os.IsPermission(err) {
-				w.WriteHeader(http.StatusForbidden)
-			} else {
-				w.WriteHeader(http.StatusInternalServerError)
-			}
+			log.Print(err.Error())
+			w.WriteHeader(errorStatus(err))
 		}
 	}
 }
+
+// MSASent gets called by the MTA once an email of the Outbox has been
+// delivered, it moves the email to the Sent folder
+func MSASent(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+
+	if err := moveEmail(OUTBOX, SENT, uuid); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	// The user wrote this email, no need to show it as unread
+	_, err := updateFlags(SENT, uuid, func(flags *Flags) { flags.Seen = true })
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	deliveredEmail(uuid)
+
+	log.Printf("Email %s was delivered\n", uuid)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// useTestGroup makes the address book hold a group of two members
+func useTestGroup(t *testing.T) {
+	previous := contacts.list
+	contacts.list = []Contact{
+		{ID: "1", Addresses: []string{"tim@apple.com"}, Groups: []string{"Team"}},
+		{ID: "2", Addresses: []string{"larry@oracle.com"}, Groups: []string{"Team"}},
+	}
+
+	t.Cleanup(func() { contacts.list = previous })
+}
+
+// outboxRecipients lists the recipients of the emails in the outbox
+func outboxRecipients(t *testing.T) []string {
+	emails, err := listEmails(OUTBOX)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recipients []string
+	for _, email := range emails {
+		recipients = append(recipients, email.To)
+	}
+	sort.Strings(recipients)
+
+	return recipients
+}
+
+func TestSendToGroup(t *testing.T) {
+	useTestMailbox(t)
+	useTestGroup(t)
+
+	w := httptest.NewRecorder()
+	MSASend(w, httptest.NewRequest("POST", "/email",
+		strings.NewReader(`{"From":"me@here.com","To":"team, steve@there.com","Subject":"Hi"}`)))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d", w.Code)
+	}
+
+	want := "larry@oracle.com steve@there.com tim@apple.com"
+	if got := strings.Join(outboxRecipients(t), " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSendAllOrNone(t *testing.T) {
+	useTestMailbox(t)
+	useTestGroup(t)
+
+	// Only one of the two copies fits in the mailbox
+	quotaMessages = 1
+
+	w := httptest.NewRecorder()
+	MSASend(w, httptest.NewRequest("POST", "/email",
+		strings.NewReader(`{"From":"me@here.com","To":"team","Subject":"Hi"}`)))
+
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("got status %d", w.Code)
+	}
+
+	if recipients := outboxRecipients(t); len(recipients) != 0 {
+		t.Errorf("got %v queued, want none", recipients)
+	}
+}
+
+func TestSendDraftToGroup(t *testing.T) {
+	useTestMailbox(t)
+	useTestGroup(t)
+
+	draft := EMail{From: "me@here.com", To: "Team", Subject: "Draft"}
+	draft.UUID = newTestUUID(t)
+	if err := writeEmail(DRAFTS, draft); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	MSASendDraft(w, mux.SetURLVars(httptest.NewRequest("POST", "/", nil),
+		map[string]string{"uuid": draft.UUID.String()}))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d", w.Code)
+	}
+
+	want := "larry@oracle.com tim@apple.com"
+	if got := strings.Join(outboxRecipients(t), " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if ids, _ := mailbox.IDs(DRAFTS); len(ids) != 0 {
+		t.Errorf("got %d drafts left", len(ids))
+	}
+}
+
+func TestWriteRawToOutbox(t *testing.T) {
+	useTestMailbox(t)
+	useTestGroup(t)
+
+	raw := "From: me@here.com\r\n" +
+		"To: Team, Steve <steve@there.com>\r\n" +
+		"Cc: bill@here.com\r\n" +
+		"Subject: Raw\r\n" +
+		"\r\n" +
+		"Hello\r\n"
+
+	w := httptest.NewRecorder()
+	MSAWriteRaw(w, httptest.NewRequest("POST", "/email/raw", strings.NewReader(raw)))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d", w.Code)
+	}
+
+	want := "bill@here.com larry@oracle.com steve@there.com tim@apple.com"
+	if got := strings.Join(outboxRecipients(t), " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	emails, err := listEmails(OUTBOX)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, email := range emails {
+		if email.SendAt.IsZero() {
+			t.Errorf("%s: not scheduled", email.To)
+		}
+		if status := lastStatus(email.UUID.String()); status != statusQueued {
+			t.Errorf("%s: got status %q, want %q", email.To, status, statusQueued)
+		}
+	}
+}
+
+func TestCancelSendToGroup(t *testing.T) {
+	useTestMailbox(t)
+	useTestGroup(t)
+
+	undoWindow = time.Minute
+	defer func() { undoWindow = 0 }()
+
+	w := httptest.NewRecorder()
+	MSASend(w, httptest.NewRequest("POST", "/email",
+		strings.NewReader(`{"From":"me@here.com","To":"team, steve@there.com","Subject":"Hi"}`)))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d", w.Code)
+	}
+
+	emails, err := listEmails(OUTBOX)
+	if err != nil || len(emails) != 3 {
+		t.Fatalf("got %d emails queued, %v", len(emails), err)
+	}
+
+	for _, email := range emails[1:] {
+		if email.MessageID != emails[0].MessageID {
+			t.Errorf("got Message-IDs %s and %s", emails[0].MessageID, email.MessageID)
+		}
+	}
+
+	if err := cancelSend(emails[1].UUID.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	if recipients := outboxRecipients(t); len(recipients) != 0 {
+		t.Errorf("got %v left queued, want none", recipients)
+	}
+
+	drafts, err := listEmails(DRAFTS)
+	if err != nil || len(drafts) != 1 {
+		t.Fatalf("got %d drafts, %v", len(drafts), err)
+	}
+
+	recipients := strings.Split(drafts[0].To, ", ")
+	sort.Strings(recipients)
+	want := "larry@oracle.com steve@there.com tim@apple.com"
+	if got := strings.Join(recipients, " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, email := range emails {
+		if status := lastStatus(email.UUID.String()); status != statusCancelled {
+			t.Errorf("%s: got status %q, want %q", email.To, status, statusCancelled)
+		}
+	}
+}
+
+func TestImportToOutbox(t *testing.T) {
+	useTestMailbox(t)
+
+	mbox := "From me@here.com Mon Jan  1 00:00:00 2024\n" +
+		"From: me@here.com\n" +
+		"To: steve@there.com\n" +
+		"Subject: Old\n" +
+		"\n" +
+		"Hello\n"
+
+	for _, folder := range []string{OUTBOX, DRAFTS} {
+		w := httptest.NewRecorder()
+		MSAImport(w, httptest.NewRequest("POST", "/email/import?folder="+folder,
+			strings.NewReader(mbox)))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", folder, w.Code)
+		}
+	}
+
+	if recipients := outboxRecipients(t); len(recipients) != 0 {
+		t.Errorf("got %v queued, want none", recipients)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+quota.go handles the limits on the size of the mailbox
+A mailbox holds at most quotaBytes of emails and quotaMessages emails, every
+folder included, and no email can be larger than maxMessageSize. An email
+which doesn't fit is refused with the status 507 (Insufficient Storage),
+which the MTA turns into a "mailbox full" bounce
+The size of an email is the size of its content: addresses, subject, bodies,
+headers and attachments
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// maxRequestSize is the maximum size of a JSON email sent to the MSA, the
+// attachments growing by a third once encoded in base64
+const maxRequestSize = maxMessageSize/3*4 + maxFieldSize
+
+var errQuotaExceeded = errors.New("mailbox quota exceeded")
+var errMessageTooLarge = errors.New("message too large")
+
+// quotaBytes and quotaMessages are the limits of the mailbox, set at startup.
+// A limit of 0 means no limit
+var quotaBytes int64
+var quotaMessages int
+
+// Quota struct representing the usage and limits of the mailbox
+type Quota struct {
+	UsedBytes      int64
+	MaxBytes       int64
+	UsedMessages   int
+	MaxMessages    int
+	MaxMessageSize int
+}
+
+// emailSize returns the size of the content of an email
+func emailSize(email EMail) int {
+	size := len(email.From) + len(email.To) + len(email.Subject) +
+		len(email.Body) + len(email.HTML)
+
+	for name, value := range email.Headers {
+		size += len(name) + len(value)
+	}
+
+	for _, attachment := range email.Attachments {
+		size += len(attachment.Filename) + len(attachment.Data)
+	}
+
+	return size
+}
+
+// usage returns the size and the number of the emails of the mailbox
+func (index *SearchIndex) usage() (int64, int) {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	var size int64
+
+	for _, doc := range index.Docs {
+		size += int64(doc.Size)
+	}
+
+	return size, len(index.Docs)
+}
+
+// checkQuota checks emails can be written to the mailbox, all of them. An
+// email which replaces a previous version of itself only counts for the
+// difference
+func checkQuota(emails ...EMail) error {
+	usedBytes, usedMessages := index.usage()
+
+	for _, email := range emails {
+		size := emailSize(email)
+		if size > maxMessageSize {
+			return errMessageTooLarge
+		}
+
+		index.mutex.RLock()
+		if doc, ok := index.Docs[email.UUID.String()]; ok {
+			usedBytes -= int64(doc.Size)
+			usedMessages--
+		}
+		index.mutex.RUnlock()
+
+		usedBytes += int64(size)
+		usedMessages++
+	}
+
+	if (quotaBytes > 0 && usedBytes > quotaBytes) ||
+		(quotaMessages > 0 && usedMessages > quotaMessages) {
+		return errQuotaExceeded
+	}
+
+	return nil
+}
+
+// MSAQuota gets called from the handleRequests method
+// It sends back the usage and the limits of the mailbox
+func MSAQuota(w http.ResponseWriter, r *http.Request) {
+	usedBytes, usedMessages := index.usage()
+
+	quotaJSON, err := json.Marshal(Quota{
+		UsedBytes:      usedBytes,
+		MaxBytes:       quotaBytes,
+		UsedMessages:   usedMessages,
+		MaxMessages:    quotaMessages,
+		MaxMessageSize: maxMessageSize,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(quotaJSON)
+}
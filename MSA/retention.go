@@ -0,0 +1,362 @@
+/*
+retention.go handles the expiry of the emails of the mailbox
+Each folder can be given retention rules: its emails are deleted, or
+archived to another folder, once they have been in the folder for a number
+of days, or once they aren't among the most recent emails of the folder. A
+deleted email goes to the Trash, and is only removed for good by the rule of
+the Trash
+The rules are saved in the SETTINGS directory. Without any saved rule, the
+Trash is emptied of the emails older than the -trash-days flag
+Emails under legal hold are never expired, whatever the rules
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SETTINGS is the directory holding the settings of the mailbox
+const SETTINGS = "Settings"
+
+// ARCHIVE is the folder the emails are archived to by default
+const ARCHIVE = "Archive"
+
+// legalHold is the keyword of the emails under legal hold
+const legalHold = "$LegalHold"
+
+var errBadRule = errors.New("invalid retention rule")
+
+// RetentionRule struct representing a retention rule of a folder. Emails
+// expire after Days in the folder, or when they aren't among the KeepLast most
+// recent emails of the folder. Expired emails are either deleted or archived
+// to the ArchiveTo folder
+type RetentionRule struct {
+	Folder    string
+	Action    string
+	Days      int    `json:",omitempty"`
+	KeepLast  int    `json:",omitempty"`
+	ArchiveTo string `json:",omitempty"`
+}
+
+// Expiry struct representing an email expired by a retention rule
+type Expiry struct {
+	UUID   string
+	Folder string
+	Action string
+	Target string `json:",omitempty"`
+	Reason string
+}
+
+// retention holds the retention rules of the mailbox
+var retention struct {
+	rules []RetentionRule
+	mutex sync.RWMutex
+}
+
+// defaultRetention returns the rules used when none were saved
+func defaultRetention(trashDays int) []RetentionRule {
+	return []RetentionRule{{Folder: TRASH, Action: "delete", Days: trashDays}}
+}
+
+// retentionPath returns the path of the file holding the retention rules
+func retentionPath() string {
+	return filepath.Join(SETTINGS, "retention.json")
+}
+
+// loadRetention reads the retention rules saved on disk, or uses the default
+// rules if there are none
+func loadRetention(trashDays int) {
+	rules := defaultRetention(trashDays)
+
+	data, err := ioutil.ReadFile(retentionPath())
+	if err == nil {
+		err = json.Unmarshal(data, &rules)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	retention.mutex.Lock()
+	retention.rules = rules
+	retention.mutex.Unlock()
+}
+
+// validate checks a rule can be applied, and fills in its default target
+func (rule *RetentionRule) validate() error {
+	if !isSystemFolder(rule.Folder) && !validFolderName(rule.Folder) {
+		return errBadRule
+	} else if rule.Days < 0 || rule.KeepLast < 0 ||
+		(rule.Days == 0 && rule.KeepLast == 0) {
+		return errBadRule
+	}
+
+	switch rule.Action {
+	case "delete":
+		rule.ArchiveTo = ""
+	case "archive":
+		if rule.ArchiveTo == "" {
+			rule.ArchiveTo = ARCHIVE
+		}
+		if rule.ArchiveTo == rule.Folder {
+			return errBadRule
+		}
+	default:
+		return errBadRule
+	}
+
+	return nil
+}
+
+// expire lists the emails expired by a rule, given the emails of its folder
+func (rule RetentionRule) expire(docs map[string]*IndexedDoc, now time.Time) []Expiry {
+	var ids []string
+	for id, doc := range docs {
+		if doc.Folder == rule.Folder {
+			ids = append(ids, id)
+		}
+	}
+
+	// The most recent emails first
+	sort.Slice(ids, func(i, j int) bool {
+		return docs[ids[i]].Date.After(docs[ids[j]].Date)
+	})
+
+	var expired []Expiry
+
+	for rank, id := range ids {
+		reason := ""
+
+		if rule.KeepLast > 0 && rank >= rule.KeepLast {
+			reason = "not among the last emails of the folder"
+		} else if rule.Days > 0 {
+			// The storage keeps the time the email arrived in the folder
+			arrived, err := mailbox.ModTime(rule.Folder, id)
+			if err != nil {
+				continue
+			}
+
+			if now.Sub(arrived) >= time.Duration(rule.Days)*24*time.Hour {
+				reason = "in the folder for too long"
+			}
+		}
+
+		if reason == "" {
+			continue
+		}
+
+		if hasKeyword(docs[id].Flags, legalHold) {
+			continue
+		}
+
+		expired = append(expired, Expiry{id, rule.Folder, rule.Action,
+			rule.ArchiveTo, reason})
+	}
+
+	return expired
+}
+
+// hasKeyword tells whether the flags include a keyword
+func hasKeyword(flags Flags, keyword string) bool {
+	for _, existing := range flags.Keywords {
+		if existing == keyword {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expiredEmails lists the emails expired by the retention rules
+func expiredEmails() []Expiry {
+	retention.mutex.RLock()
+	rules := retention.rules
+	retention.mutex.RUnlock()
+
+	docs := snapshotDocs()
+	now := time.Now()
+
+	var expired []Expiry
+	for _, rule := range rules {
+		expired = append(expired, rule.expire(docs, now)...)
+	}
+
+	return expired
+}
+
+// sweep applies the retention rules once. An email taken out of the outbox
+// won't be sent, its delivery history tells why
+func sweep() {
+	for _, expiry := range expiredEmails() {
+		var err error
+
+		if expiry.Folder == OUTBOX {
+			recordStatus(expiry.UUID, DeliveryStatus{Status: statusExpired,
+				Reason: expiry.Reason})
+		}
+
+		switch expiry.Action {
+		case "delete":
+			log.Println("Expire " + expiry.UUID + " from " + expiry.Folder)
+			err = trashEmail(expiry.Folder, expiry.UUID)
+		case "archive":
+			log.Println("Archive " + expiry.UUID + " from " + expiry.Folder +
+				" to " + expiry.Target)
+			err = moveEmail(expiry.Folder, expiry.Target, expiry.UUID)
+		}
+
+		if err != nil {
+			log.Print(err.Error())
+		}
+	}
+}
+
+// sweepRetention periodically applies the retention rules
+func sweepRetention(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		sweep()
+		<-ticker.C
+	}
+}
+
+// MSAReadRetention gets called from the handleRequests method
+// It sends back the retention rules of the mailbox
+func MSAReadRetention(w http.ResponseWriter, r *http.Request) {
+	retention.mutex.RLock()
+	rulesJSON, err := json.Marshal(retention.rules)
+	retention.mutex.RUnlock()
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(rulesJSON)
+}
+
+// MSAWriteRetention gets called from the handleRequests method
+// It replaces the retention rules of the mailbox
+func MSAWriteRetention(w http.ResponseWriter, r *http.Request) {
+	var rules []RetentionRule
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Print(err.Error())
+		return
+	}
+
+	if err := json.Unmarshal(body, &rules); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Printf("Invalid retention rule for %s\n", rules[i].Folder)
+			return
+		}
+
+		// The emails can only be archived to a folder which exists
+		if rules[i].Action == "archive" {
+			if err := mailbox.CheckFolder(rules[i].ArchiveTo); err != nil {
+				w.WriteHeader(errorStatus(err))
+				log.Print(err.Error())
+				return
+			}
+		}
+	}
+
+	rulesJSON, err := json.Marshal(rules)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	retention.mutex.Lock()
+	defer retention.mutex.Unlock()
+
+	if err := writeFileAtomic(retentionPath(), rulesJSON); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	retention.rules = rules
+
+	log.Printf("Saved %d retention rules\n", len(rules))
+	w.Write(rulesJSON)
+}
+
+// MSAPreviewRetention gets called from the handleRequests method
+// It lists the emails the retention rules would expire now, without
+// expiring them
+func MSAPreviewRetention(w http.ResponseWriter, r *http.Request) {
+	expired := expiredEmails()
+	if expired == nil {
+		expired = []Expiry{}
+	}
+
+	expiredJSON, err := json.Marshal(expired)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(expiredJSON)
+}
+
+// MSAHold gets called from the handleRequests method
+// It places an email of the folder under legal hold, or releases it
+func MSAHold(folder string, hold bool) func(w http.ResponseWriter, r *http.Request) {
+
+	// This is so that we can pass in arguments (folder and hold)
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["uuid"]
+
+		_, err := updateFlags(folder, id, func(flags *Flags) {
+			flags.setKeyword(legalHold, hold)
+		})
+
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
+
+		if hold {
+			log.Println("Placed " + id + " under legal hold")
+		} else {
+			log.Println("Released " + id + " from legal hold")
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// MSAHoldInFolder places an email of the folder given in the URL under legal
+// hold, or releases it
+func MSAHoldInFolder(hold bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		MSAHold(mux.Vars(r)["folder"], hold)(w, r)
+	}
+}
@@ -0,0 +1,714 @@
+/*
+rfc5322.go converts emails to and from the Internet Message Format (RFC 5322)
+so that they can be exchanged with any other mail tool
+Emails with an HTML alternative or attachments are written as MIME multipart
+messages (RFC 2045/2046), and the headers which aren't plain ASCII are written
+as encoded-words (RFC 2047)
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxLineLength is the length headers and encoded bodies are folded at
+const maxLineLength = 76
+
+var errNoAddress = errors.New("missing address")
+
+// structuralHeaders are the headers generated from the fields of an email,
+// any other header is kept in the Headers of the email
+var structuralHeaders = map[string]bool{
+	"Date": true, "From": true, "To": true, "Subject": true,
+	"Message-Id": true, "In-Reply-To": true, "References": true,
+	"Mime-Version": true, "Content-Type": true,
+	"Content-Transfer-Encoding": true, "Content-Disposition": true,
+	"X-Send-At": true, "Received": true,
+}
+
+// headerDecoder decodes the encoded-words of the headers. Besides UTF-8 and
+// US-ASCII, which are handled by the standard library, ISO-8859-1 is understood
+var headerDecoder = mime.WordDecoder{CharsetReader: charsetReader}
+
+// charsetReader converts text in a supported charset to UTF-8
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "us-ascii", "":
+		return input, nil
+	case "iso-8859-1", "latin1":
+		data, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+
+		return strings.NewReader(string(runes)), nil
+	default:
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+}
+
+// foldHeader writes a header, folding it on whitespace so that no line is
+// longer than maxLineLength whenever possible
+func foldHeader(buffer *bytes.Buffer, name string, value string) {
+	line := name + ":"
+
+	for _, word := range strings.Fields(value) {
+		// A word longer than a line is left on a line of its own
+		if len(line)+1+len(word) > maxLineLength && line != name+":" {
+			buffer.WriteString(line + "\r\n")
+			line = ""
+		}
+
+		line += " " + word
+	}
+
+	buffer.WriteString(line + "\r\n")
+}
+
+// encodeHeader encodes the text of a header as encoded-words if it isn't
+// plain ASCII
+func encodeHeader(text string) string {
+	return mime.QEncoding.Encode("utf-8", text)
+}
+
+// isASCII tells whether a text is made of ASCII characters only
+func isASCII(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// base64Lines wraps base64 encoded data into lines of maxLineLength
+type base64Lines struct {
+	writer io.Writer
+	column int
+}
+
+func (lines *base64Lines) Write(data []byte) (int, error) {
+	for written := 0; written < len(data); {
+		n := maxLineLength - lines.column
+		if n > len(data)-written {
+			n = len(data) - written
+		}
+
+		if _, err := lines.writer.Write(data[written : written+n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		lines.column += n
+
+		if lines.column == maxLineLength {
+			if _, err := io.WriteString(lines.writer, "\r\n"); err != nil {
+				return written, err
+			}
+			lines.column = 0
+		}
+	}
+
+	return len(data), nil
+}
+
+// encodeBody writes data with a Content-Transfer-Encoding: base64,
+// quoted-printable, or 7bit/8bit which leave the data as it is
+func encodeBody(writer io.Writer, data []byte, encoding string) error {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		encoder := base64.NewEncoder(base64.StdEncoding, &base64Lines{writer: writer})
+		if _, err := encoder.Write(data); err != nil {
+			return err
+		}
+		return encoder.Close()
+	case "quoted-printable":
+		encoder := quotedprintable.NewWriter(writer)
+		if _, err := encoder.Write(data); err != nil {
+			return err
+		}
+		return encoder.Close()
+	default:
+		_, err := writer.Write(data)
+		return err
+	}
+}
+
+// decodeBody reads data written with a Content-Transfer-Encoding
+func decodeBody(reader io.Reader, encoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding,
+			&stripSpaces{reader: reader}))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(reader))
+	default:
+		return ioutil.ReadAll(reader)
+	}
+}
+
+// stripSpaces drops the line breaks and spaces of base64 encoded data
+type stripSpaces struct {
+	reader io.Reader
+}
+
+func (strip *stripSpaces) Read(data []byte) (int, error) {
+	n, err := strip.reader.Read(data)
+
+	kept := 0
+	for _, b := range data[:n] {
+		if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+			data[kept] = b
+			kept++
+		}
+	}
+
+	return kept, err
+}
+
+// textEncoding chooses the Content-Transfer-Encoding of a text
+func textEncoding(text string) string {
+	if !isASCII(text) {
+		return "quoted-printable"
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		if len(line) > 998 {
+			return "quoted-printable"
+		}
+	}
+
+	return "7bit"
+}
+
+// attachmentEncoding returns the Content-Transfer-Encoding of an attachment.
+// Text attachments are only encoded when they need to be, anything else is
+// sent as base64 unless it was given an encoding which suits it
+func attachmentEncoding(attachment Attachment) string {
+	encoding := strings.ToLower(attachment.TransferEncoding)
+	isText := strings.HasPrefix(attachment.ContentType, "text/")
+
+	switch {
+	case encoding == "base64" || encoding == "quoted-printable":
+		return encoding
+	case isText:
+		return textEncoding(string(attachment.Data))
+	case encoding != "" && textEncoding(string(attachment.Data)) == "7bit":
+		return "7bit"
+	}
+
+	return "base64"
+}
+
+// writeTextPart writes a text/plain or text/html part
+func writeTextPart(writer *multipart.Writer, contentType string, text string) error {
+	encoding := textEncoding(text)
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {encoding},
+	})
+	if err != nil {
+		return err
+	}
+
+	return encodeBody(part, []byte(crlf(text)), encoding)
+}
+
+// crlf converts the line breaks of a text to CRLF
+func crlf(text string) string {
+	return strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+// writeAlternative writes the text/plain and text/html versions of the body
+// as a multipart/alternative part
+func writeAlternative(writer *multipart.Writer, email EMail) error {
+	var alternative bytes.Buffer
+
+	inner := multipart.NewWriter(&alternative)
+
+	if err := writeTextPart(inner, "text/plain", email.Body); err != nil {
+		return err
+	}
+	if err := writeTextPart(inner, "text/html", email.HTML); err != nil {
+		return err
+	}
+	if err := inner.Close(); err != nil {
+		return err
+	}
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + inner.Boundary()},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = part.Write(alternative.Bytes())
+
+	return err
+}
+
+// FormatEMail writes an email in the Internet Message Format
+func FormatEMail(email EMail) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	// The trace comes first, the latest hop at the top
+	for _, received := range email.Received {
+		foldHeader(&buffer, "Received", received)
+	}
+
+	date := email.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	buffer.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	foldHeader(&buffer, "From", email.From)
+	foldHeader(&buffer, "To", email.To)
+
+	if email.Subject != "" {
+		foldHeader(&buffer, "Subject", encodeHeader(email.Subject))
+	}
+	if email.MessageID != "" {
+		foldHeader(&buffer, "Message-ID", email.MessageID)
+	}
+	if email.InReplyTo != "" {
+		foldHeader(&buffer, "In-Reply-To", email.InReplyTo)
+	}
+	if len(email.References) > 0 {
+		foldHeader(&buffer, "References", strings.Join(email.References, " "))
+	}
+	if !email.SendAt.IsZero() {
+		foldHeader(&buffer, "X-Send-At", email.SendAt.Format(time.RFC3339Nano))
+	}
+
+	// The other headers are written in alphabetical order, so that the same
+	// email is always written the same way
+	names := make([]string, 0, len(email.Headers))
+	for name := range email.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		foldHeader(&buffer, textproto.CanonicalMIMEHeaderKey(name),
+			encodeHeader(email.Headers[name]))
+	}
+
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+
+	// A plain text email doesn't need to be multipart
+	if email.HTML == "" && len(email.Attachments) == 0 {
+		encoding := textEncoding(email.Body)
+
+		buffer.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buffer.WriteString("Content-Transfer-Encoding: " + encoding + "\r\n\r\n")
+
+		err := encodeBody(&buffer, []byte(crlf(email.Body)), encoding)
+
+		return buffer.Bytes(), err
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	mediaType := "multipart/mixed"
+	if len(email.Attachments) == 0 {
+		mediaType = "multipart/alternative"
+	}
+
+	var err error
+
+	switch {
+	case email.HTML == "":
+		err = writeTextPart(writer, "text/plain", email.Body)
+	case len(email.Attachments) == 0:
+		err = writeTextPart(writer, "text/plain", email.Body)
+		if err == nil {
+			err = writeTextPart(writer, "text/html", email.HTML)
+		}
+	default:
+		err = writeAlternative(writer, email)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range email.Attachments {
+		encoding := attachmentEncoding(attachment)
+
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {attachment.ContentType},
+			"Content-Disposition": {mime.FormatMediaType("attachment",
+				map[string]string{"filename": attachment.Filename})},
+			"Content-Transfer-Encoding": {encoding},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if err := encodeBody(part, attachment.Data, encoding); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	buffer.WriteString("Content-Type: " + mediaType + "; boundary=" +
+		writer.Boundary() + "\r\n\r\n")
+	buffer.Write(body.Bytes())
+
+	return buffer.Bytes(), nil
+}
+
+// parseAddressList reads the addresses of an address header, keeping only
+// the address itself and not the display name
+func parseAddressList(header string) []string {
+	parser := &mail.AddressParser{WordDecoder: &headerDecoder}
+
+	list, err := parser.ParseList(header)
+	if err != nil {
+		// Not a valid address list, keep the recipients which aren't
+		// addresses as they are, the groups of the address book for instance
+		var addresses []string
+		for _, recipient := range splitRecipients(header) {
+			if address, err := parser.Parse(recipient); err == nil {
+				recipient = address.Address
+			}
+			addresses = append(addresses, recipient)
+		}
+		return addresses
+	}
+
+	addresses := make([]string, len(list))
+	for i, address := range list {
+		addresses[i] = address.Address
+	}
+
+	return addresses
+}
+
+// ParseEMail reads an email in the Internet Message Format
+// The email can only have one recipient: any other recipient of the To header
+// is added to the Cc header
+func ParseEMail(reader io.Reader) (EMail, error) {
+	var email EMail
+
+	message, err := mail.ReadMessage(bufio.NewReader(reader))
+	if err != nil {
+		return email, err
+	}
+
+	header := message.Header
+
+	// Drafts may not have a sender yet, the emails imported must have one
+	if from := parseAddressList(header.Get("From")); len(from) > 0 {
+		email.From = from[0]
+	}
+
+	to := parseAddressList(header.Get("To"))
+	if len(to) > 0 {
+		email.To = to[0]
+	}
+
+	if email.Subject, err = headerDecoder.DecodeHeader(header.Get("Subject")); err != nil {
+		email.Subject = header.Get("Subject")
+	}
+
+	if date, err := mail.ParseDate(header.Get("Date")); err == nil {
+		email.Date = date
+	}
+
+	email.MessageID = strings.TrimSpace(header.Get("Message-Id"))
+	email.InReplyTo = strings.TrimSpace(header.Get("In-Reply-To"))
+	if references := strings.Fields(header.Get("References")); len(references) > 0 {
+		email.References = references
+	}
+	email.Received = header["Received"]
+
+	if sendAt, err := time.Parse(time.RFC3339Nano, header.Get("X-Send-At")); err == nil {
+		email.SendAt = sendAt
+	}
+
+	for name, values := range header {
+		if structuralHeaders[name] {
+			continue
+		}
+
+		if email.Headers == nil {
+			email.Headers = make(map[string]string)
+		}
+
+		value := strings.Join(values, ", ")
+		if decoded, err := headerDecoder.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+
+		email.Headers[name] = value
+	}
+
+	if len(to) > 1 {
+		cc := strings.Join(to[1:], ", ")
+		if existing := email.Headers["Cc"]; existing != "" {
+			cc = existing + ", " + cc
+		}
+
+		if email.Headers == nil {
+			email.Headers = make(map[string]string)
+		}
+		email.Headers["Cc"] = cc
+	}
+
+	err = parsePart(&email, textproto.MIMEHeader(header), message.Body)
+
+	return email, err
+}
+
+// parsePart reads one part of the body of an email: the first text/plain
+// and text/html parts are the body of the email, the other parts are
+// attachments
+func parsePart(email *EMail, header textproto.MIMEHeader, body io.Reader) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			// The multipart reader decodes quoted-printable parts itself, the
+			// other transfer encodings are decoded below
+			if err := parsePart(email, part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := decodeBody(body, header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(
+		header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	isAttachment := disposition == "attachment" || filename != ""
+
+	if !isAttachment && (mediaType == "text/plain" || mediaType == "text/html") {
+		reader, err := charsetReader(params["charset"], bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+
+		text, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+
+		normalized := strings.Replace(string(text), "\r\n", "\n", -1)
+
+		if mediaType == "text/plain" && email.Body == "" {
+			email.Body = normalized
+			return nil
+		} else if mediaType == "text/html" && email.HTML == "" {
+			email.HTML = normalized
+			return nil
+		}
+	}
+
+	attachment := Attachment{
+		ID:          strconv.Itoa(len(email.Attachments) + 1),
+		Filename:    filename,
+		ContentType: mediaType,
+		TransferEncoding: strings.ToLower(strings.TrimSpace(
+			header.Get("Content-Transfer-Encoding"))),
+		Size: len(data),
+		Data: data,
+	}
+
+	// The encoding of a quoted-printable part was hidden by the multipart
+	// reader, pick one which suits the data
+	if attachment.TransferEncoding == "" {
+		attachment.TransferEncoding = attachmentEncoding(attachment)
+	}
+
+	email.Attachments = append(email.Attachments, attachment)
+
+	return nil
+}
+
+// MSAReadRaw gets called from the handleRequests method
+// It sends back an email of the folder in the Internet Message Format
+func MSAReadRaw(folder string) func(w http.ResponseWriter, r *http.Request) {
+
+	// This is so that we can pass in an argument (folder)
+	return func(w http.ResponseWriter, r *http.Request) {
+		email, err := readEmail(folder, mux.Vars(r)["uuid"])
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
+
+		raw, err := FormatEMail(email)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.WriteHeader(http.StatusOK)
+		w.Write(raw)
+	}
+}
+
+// MSAReadRawInFolder sends back an email of the folder given in the URL in the
+// Internet Message Format
+func MSAReadRawInFolder(w http.ResponseWriter, r *http.Request) {
+	MSAReadRaw(mux.Vars(r)["folder"])(w, r)
+}
+
+// submittedRecipients lists the recipients of an email submitted in the
+// Internet Message Format, in To and in Cc, with the groups of the address
+// book replaced with their members
+func submittedRecipients(email EMail) ([]string, error) {
+	recipients, err := expandRecipients(email.To)
+	if err != nil {
+		return nil, err
+	}
+
+	if cc := emailHeader(email, "Cc"); cc != nil {
+		copied, err := expandRecipients(cc[0])
+		if err != nil {
+			return nil, err
+		}
+		recipients = appendUnique(recipients, copied...)
+	}
+
+	return recipients, nil
+}
+
+// MSAWriteRaw gets called from the handleRequests method
+// It reads an email in the Internet Message Format. By default the email is
+// submitted, and queued in the Outbox like with MSASend, a copy for each of
+// its recipients. Given a "folder" in the URL query, the email is imported as
+// it is to that folder instead
+func MSAWriteRaw(w http.ResponseWriter, r *http.Request) {
+	folder := r.URL.Query().Get("folder")
+	if folder == "" {
+		folder = OUTBOX
+	}
+
+	email, err := ParseEMail(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err == nil && email.From == "" {
+		err = errNoAddress
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	if email.UUID, err = uuid.NewUUID(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	if folder == OUTBOX {
+		if email.To == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println("To field empty.")
+			return
+		}
+
+		// ParseEMail keeps the first address of To and moves the others to
+		// Cc, every one of them gets a copy, the groups member by member
+		recipients, err := submittedRecipients(email)
+		if err != nil || len(recipients) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println("Unknown recipient " + email.To)
+			return
+		}
+
+		if email, err = queueCopies(email, recipients); err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
+	} else {
+		if email.Date.IsZero() {
+			email.Date = time.Now()
+		}
+		if email.MessageID == "" {
+			email.MessageID = newMessageID(email.UUID)
+		}
+
+		if err := writeEmail(folder, email); err != nil {
+			w.WriteHeader(errorStatus(err))
+			log.Print(err.Error())
+			return
+		}
+	}
+
+	emailJSON, err := json.Marshal(email)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Imported " + email.Subject + " to " + folder)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(emailJSON)
+}
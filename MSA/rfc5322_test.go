@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatParseRoundTrip(t *testing.T) {
+	long := make([]string, 8)
+	for i := range long {
+		long[i] = "<reference-" + strings.Repeat("x", 20) + string(rune('a'+i)) + "@there.com>"
+	}
+
+	for _, test := range []struct {
+		name  string
+		email EMail
+	}{
+		{"plain ASCII", EMail{
+			From:    "billgates@here.com",
+			To:      "stevejobs@there.com",
+			Subject: "Hello",
+			Body:    "Hello,\nHow are you?\n",
+		}},
+		{"encoded-words and quoted-printable", EMail{
+			From:    "billgates@here.com",
+			To:      "stevejobs@there.com",
+			Subject: "Café à côté, ça marche ?",
+			Body:    "Rendez-vous au café à midi.\nÀ bientôt\n",
+			Headers: map[string]string{"Organization": "Société Générale"},
+		}},
+		{"folded headers", EMail{
+			MessageID:  "<reply@here.com>",
+			InReplyTo:  long[len(long)-1],
+			References: long,
+			From:       "billgates@here.com",
+			To:         "stevejobs@there.com",
+			Subject:    strings.Repeat("A rather long subject, ", 8) + "really",
+			Body:       "Threaded\n",
+			Headers:    map[string]string{"Cc": "tim@apple.com, larry@oracle.com, sundar@google.com, satya@microsoft.com"},
+		}},
+		{"long line", EMail{
+			From: "billgates@here.com",
+			To:   "stevejobs@there.com",
+			Body: strings.Repeat("word ", 300) + "\n",
+		}},
+		{"alternative", EMail{
+			From: "billgates@here.com",
+			To:   "stevejobs@there.com",
+			Body: "Plain text\n",
+			HTML: "<p>Some <b>HTML</b> é</p>\n",
+		}},
+		{"attachments", EMail{
+			From: "billgates@here.com",
+			To:   "stevejobs@there.com",
+			Body: "See attached\n",
+			HTML: "<p>See attached</p>\n",
+			Attachments: []Attachment{
+				{Filename: "data.bin", ContentType: "application/octet-stream",
+					Data: []byte{0, 1, 2, 250, 255, '\r', '\n'}},
+				{Filename: "notes.txt", ContentType: "text/plain",
+					Data: []byte("Some notes\r\nwith accents: é\r\n")},
+				{Filename: "résumé final.pdf", ContentType: "application/pdf",
+					Data: bytes.Repeat([]byte("%PDF"), 100)},
+			},
+		}},
+		{"schedule and trace", EMail{
+			MessageID: "<scheduled@here.com>",
+			From:      "billgates@here.com",
+			To:        "stevejobs@there.com",
+			Subject:   "Later",
+			Body:      "Sent later\n",
+			SendAt:    time.Date(2099, 1, 1, 8, 0, 0, 123456789, time.UTC),
+			Received: []string{
+				"from 192.168.1.5 by there.com with HTTP id <scheduled@here.com> for <stevejobs@there.com>; Wed, 12 Feb 2020 10:30:02 +0000",
+				"from billgates@here.com by here.com with HTTP id <scheduled@here.com> for <stevejobs@there.com>; Wed, 12 Feb 2020 10:30:01 +0000",
+			},
+		}},
+	} {
+		want := test.email
+		want.Date = time.Date(2020, 2, 12, 10, 30, 0, 0, time.UTC)
+
+		raw, err := FormatEMail(want)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		// Bodies are encoded so that no line is longer than the format allows
+		for _, line := range strings.Split(string(raw), "\r\n") {
+			if len(line) > 998 {
+				t.Errorf("%s: line of %d characters: %q", test.name, len(line), line)
+			}
+		}
+
+		got, err := ParseEMail(bytes.NewReader(raw))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		// The UUID isn't part of the format
+		got.UUID = want.UUID
+
+		if err := sameEmail(got, want); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+func TestParseEMail(t *testing.T) {
+	raw := "Received: from 192.168.1.5 by there.com with HTTP id <1@here.com>;\r\n" +
+		" Wed, 12 Feb 2020 10:30:02 +0000\r\n" +
+		"Received: from billgates@here.com by here.com with HTTP id <1@here.com>;\r\n" +
+		" Wed, 12 Feb 2020 10:30:01 +0000\r\n" +
+		"Date: Wed, 12 Feb 2020 10:30:00 +0000\r\n" +
+		"From: =?ISO-8859-1?Q?Ren=E9?= <rene@here.com>\r\n" +
+		"To: Steve <stevejobs@there.com>, tim@apple.com\r\n" +
+		"Cc: larry@oracle.com\r\n" +
+		"Subject: =?ISO-8859-1?Q?Caf=E9?=\r\n" +
+		" =?UTF-8?B?IMOgIG1pZGk=?=\r\n" +
+		"Message-ID: <1@here.com>\r\n" +
+		"X-Mailer: Test\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"frontier\"\r\n" +
+		"\r\n" +
+		"--frontier\r\n" +
+		"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Caf=E9 =C0 midi, avec une ligne tr=\r\n" +
+		"=E8s longue\r\n" +
+		"--frontier\r\n" +
+		"Content-Type: image/png; name=\"dot.png\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--frontier--\r\n"
+
+	email, err := ParseEMail(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := EMail{
+		MessageID: "<1@here.com>",
+		From:      "rene@here.com",
+		To:        "stevejobs@there.com",
+		Subject:   "Café à midi",
+		Body:      "Café À midi, avec une ligne très longue",
+		Date:      time.Date(2020, 2, 12, 10, 30, 0, 0, time.UTC),
+		Headers: map[string]string{
+			"Cc":       "larry@oracle.com, tim@apple.com",
+			"X-Mailer": "Test",
+		},
+		Received: []string{
+			"from 192.168.1.5 by there.com with HTTP id <1@here.com>; Wed, 12 Feb 2020 10:30:02 +0000",
+			"from billgates@here.com by here.com with HTTP id <1@here.com>; Wed, 12 Feb 2020 10:30:01 +0000",
+		},
+		Attachments: []Attachment{{
+			Filename:    "dot.png",
+			ContentType: "image/png",
+			Data:        []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'},
+		}},
+	}
+
+	if err := sameEmail(email, want); err != nil {
+		t.Error(err)
+	}
+
+	if attachment := email.Attachments[0]; attachment.ID != "1" ||
+		attachment.TransferEncoding != "base64" || attachment.Size != 8 {
+		t.Errorf("attachment: got %+v", attachment)
+	}
+}
+
+func TestFoldHeader(t *testing.T) {
+	var buffer bytes.Buffer
+
+	foldHeader(&buffer, "References", strings.Repeat("<0123456789@here.com> ", 10))
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\r\n"), "\r\n")
+	if len(lines) < 3 {
+		t.Fatalf("got %d lines, want the header folded", len(lines))
+	}
+
+	for i, line := range lines {
+		if len(line) > maxLineLength {
+			t.Errorf("line %d has %d characters", i, len(line))
+		} else if i > 0 && !strings.HasPrefix(line, " ") {
+			t.Errorf("line %d doesn't start with a space: %q", i, line)
+		}
+	}
+
+	// A word longer than a line can't be folded
+	buffer.Reset()
+	foldHeader(&buffer, "X-Long", strings.Repeat("x", 100))
+
+	if want := "X-Long: " + strings.Repeat("x", 100) + "\r\n"; buffer.String() != want {
+		t.Errorf("got %q", buffer.String())
+	}
+
+	if !reflect.DeepEqual(parseAddressList("Steve <stevejobs@there.com>, tim@apple.com"),
+		[]string{"stevejobs@there.com", "tim@apple.com"}) {
+		t.Error("parseAddressList didn't keep the addresses only")
+	}
+
+	if !reflect.DeepEqual(parseAddressList("Team, Steve <stevejobs@there.com>"),
+		[]string{"Team", "stevejobs@there.com"}) {
+		t.Error("parseAddressList didn't keep the group name")
+	}
+}
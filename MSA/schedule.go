@@ -0,0 +1,245 @@
+/*
+schedule.go handles the emails sent later
+An email of the outbox isn't sent by the MTA before its SendAt time. Emails
+can be scheduled for later, and every email sent waits for the undo window,
+during which deleting it from the outbox cancels it and brings it back to the
+drafts. Scheduled emails can be listed and rescheduled until they are sent
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// undoWindow is the time during which an email sent can still be cancelled,
+// set at startup
+var undoWindow time.Duration
+
+// ScheduledEmail struct representing an email of the outbox waiting for its
+// time to be sent
+type ScheduledEmail struct {
+	UUID    string
+	To      string
+	Subject string
+	SendAt  time.Time
+}
+
+// ScheduleRequest struct representing a request to reschedule an email. A
+// zero SendAt sends the email straight away
+type ScheduleRequest struct {
+	SendAt time.Time
+}
+
+// schedule sets the time an email sent at now is to be sent, no earlier than
+// the end of the undo window. An email scheduled for later is dated from then
+func schedule(email *EMail, now time.Time) {
+	if email.SendAt.After(now) {
+		email.Date = email.SendAt
+	} else {
+		email.SendAt = now
+	}
+
+	if undo := now.Add(undoWindow); email.SendAt.Before(undo) {
+		email.SendAt = undo
+	}
+}
+
+// queuedStatus returns the delivery status of an email placed in the outbox
+func queuedStatus(email EMail) DeliveryStatus {
+	status := DeliveryStatus{Status: statusQueued}
+	if email.SendAt.After(time.Now().Add(undoWindow)) {
+		status.Reason = "scheduled for " + email.SendAt.Format(time.RFC1123Z)
+	}
+
+	return status
+}
+
+// isPending tells whether an email of the outbox is still waiting to be sent
+func isPending(email EMail) bool {
+	return email.SendAt.After(time.Now())
+}
+
+// pendingEmail tells whether an email is in the outbox, still waiting to be
+// sent
+func pendingEmail(id string) bool {
+	email, err := readEmail(OUTBOX, id)
+
+	return err == nil && isPending(email)
+}
+
+// pendingCopies lists the other copies of an email, sharing its Message-ID,
+// which are still waiting in the outbox
+func pendingCopies(email EMail) []EMail {
+	if email.MessageID == "" {
+		return nil
+	}
+
+	var ids []string
+	index.mutex.RLock()
+	for id, doc := range index.Docs {
+		if doc.Folder == OUTBOX && doc.MessageID == email.MessageID &&
+			id != email.UUID.String() {
+			ids = append(ids, id)
+		}
+	}
+	index.mutex.RUnlock()
+
+	var copies []EMail
+	for _, id := range ids {
+		if sibling, err := readEmail(OUTBOX, id); err == nil && isPending(sibling) {
+			copies = append(copies, sibling)
+		}
+	}
+
+	return copies
+}
+
+// cancelSend brings an email of the outbox which wasn't sent yet back to the
+// drafts. The copies made for its other recipients are taken back with it,
+// and their recipients added back to the To of the draft, unless they were in
+// Cc
+func cancelSend(id string) error {
+	email, err := readEmail(OUTBOX, id)
+	if err != nil {
+		return err
+	}
+
+	drafting.Lock()
+	defer drafting.Unlock()
+
+	copies := pendingCopies(email)
+	unqueue(copies)
+
+	var copied []string
+	if cc := emailHeader(email, "Cc"); cc != nil {
+		copied, _ = expandRecipients(cc[0])
+	}
+	recipients := []string{email.To}
+	for _, sibling := range copies {
+		if len(appendUnique(copied, sibling.To)) > len(copied) {
+			recipients = appendUnique(recipients, sibling.To)
+		}
+	}
+	email.To = strings.Join(recipients, ", ")
+
+	// Out of the outbox first: once its SendAt is cleared, the email is due
+	// and the MTA would send it
+	if err := moveEmail(OUTBOX, DRAFTS, id); err != nil {
+		return err
+	}
+
+	email.SendAt = time.Time{}
+	if err := writeEmail(DRAFTS, email); err != nil {
+		return err
+	}
+
+	if _, err := updateFlags(DRAFTS, id, func(flags *Flags) { flags.Draft = true }); err != nil {
+		log.Print(err.Error())
+	}
+
+	if _, err := recordDraft(id, false); err != nil {
+		log.Print(err.Error())
+	}
+
+	recordStatus(id, DeliveryStatus{Status: statusCancelled})
+
+	return nil
+}
+
+// MSAListScheduled gets called from the handleRequests method
+// It lists the emails of the outbox waiting to be sent, the next one first
+func MSAListScheduled(w http.ResponseWriter, r *http.Request) {
+	emails, err := listEmails(OUTBOX)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	scheduled := []ScheduledEmail{}
+	for _, email := range emails {
+		if isPending(email) {
+			scheduled = append(scheduled, ScheduledEmail{email.UUID.String(),
+				email.To, email.Subject, email.SendAt})
+		}
+	}
+
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].SendAt.Before(scheduled[j].SendAt)
+	})
+
+	scheduledJSON, err := json.Marshal(scheduled)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(scheduledJSON)
+}
+
+// MSAReschedule gets called from the handleRequests method
+// It changes the time an email of the outbox is to be sent, as long as it
+// wasn't sent yet
+func MSAReschedule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["uuid"]
+
+	var request ScheduleRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	email, err := readEmail(OUTBOX, id)
+	if err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	// The MTA may be sending it already
+	if !isPending(email) {
+		w.WriteHeader(http.StatusConflict)
+		log.Println("Email " + id + " is being sent, too late to reschedule it")
+		return
+	}
+
+	now := time.Now()
+	email.SendAt = request.SendAt
+	email.Date = now
+	schedule(&email, now)
+
+	if err := writeEmail(OUTBOX, email); err != nil {
+		w.WriteHeader(errorStatus(err))
+		log.Print(err.Error())
+		return
+	}
+
+	recordStatus(id, queuedStatus(email))
+
+	scheduledJSON, err := json.Marshal(ScheduledEmail{id, email.To,
+		email.Subject, email.SendAt})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Rescheduled " + id + " for " + email.SendAt.Format(time.RFC1123Z))
+	w.Write(scheduledJSON)
+}
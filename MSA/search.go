@@ -0,0 +1,855 @@
+/*
+search.go handles the full-text search over the mailbox
+Every email written to, moved in or removed from the mailbox updates an
+inverted index of the From, To, Subject and Body fields. The index lives in
+memory and is regularly saved to disk, when it is loaded back at startup it
+is brought up to date with the emails of the mailbox
+
+The search queries support:
+  - words and "quoted phrases", matched against any field
+  - field qualifiers: from:, to:, subject:, body:, in: (the folder)
+  - dates: after:2020-02-12, before:2020-02-12, date:2020-02-01..2020-02-12
+  - boolean operators: AND (implicit), OR, NOT (or a leading -), parentheses
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// INDEX is the directory holding the search index
+const INDEX = "Index"
+
+// indexVersion is bumped every time the content of the index changes, an
+// index saved by an older version is rebuilt from scratch
+const indexVersion = 4
+
+// searchFields are the fields of an email which get indexed
+var searchFields = []string{"from", "to", "subject", "body"}
+
+// fieldWeights boost the score of the words found in the shortest fields
+var fieldWeights = map[string]float64{
+	"from": 2, "to": 2, "subject": 3, "body": 1,
+}
+
+var errBadQuery = errors.New("invalid search query")
+
+// IndexedDoc struct representing an email in the index
+type IndexedDoc struct {
+	Folder     string
+	MessageID  string   `json:",omitempty"`
+	InReplyTo  string   `json:",omitempty"`
+	References []string `json:",omitempty"`
+	From       string
+	To         string
+	Subject    string
+	Date       time.Time
+	SendAt     time.Time
+	Size       int
+	Flags      Flags
+}
+
+// Postings struct listing the positions of a term in each field of an email
+type Postings map[string][]int
+
+// SearchIndex struct representing the inverted index of the mailbox
+type SearchIndex struct {
+	Version int
+	Docs    map[string]*IndexedDoc
+	Terms   map[string]map[string]Postings
+
+	// docTerms lists the terms of each email, so that an email is dropped
+	// from its own postings only. It's rebuilt from Terms when loaded
+	docTerms map[string][]string
+
+	// changes counts the updates of the index, saved is the count it was
+	// last written to disk at
+	changes int
+	saved   int
+
+	mutex sync.RWMutex
+}
+
+// SearchResult struct representing an email matching a search query
+type SearchResult struct {
+	UUID  string
+	Score float64
+	IndexedDoc
+}
+
+// SearchResults struct representing the response to a search query
+type SearchResults struct {
+	Total   int
+	Results []SearchResult
+}
+
+// index of the mailbox
+var index = SearchIndex{
+	Version: indexVersion,
+	Docs:    make(map[string]*IndexedDoc),
+	Terms:   make(map[string]map[string]Postings),
+
+	docTerms: make(map[string][]string),
+}
+
+// tokenize splits a text into lower case words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+}
+
+// emailFields returns the text of each indexed field of the email
+func emailFields(email EMail) map[string]string {
+	return map[string]string{
+		"from":    email.From,
+		"to":      email.To,
+		"subject": email.Subject,
+		"body":    email.Body + " " + htmlText(email.HTML),
+	}
+}
+
+// add indexes an email of a folder, replacing any previous version of it
+func (index *SearchIndex) add(folder string, email EMail) {
+	id := email.UUID.String()
+
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	// Rewriting an email doesn't change its flags
+	var flags Flags
+	if doc, ok := index.Docs[id]; ok {
+		flags = doc.Flags
+	}
+
+	index.removeLocked(id)
+
+	index.Docs[id] = &IndexedDoc{
+		Folder:     folder,
+		MessageID:  email.MessageID,
+		InReplyTo:  email.InReplyTo,
+		References: email.References,
+		From:       email.From,
+		To:         email.To,
+		Subject:    email.Subject,
+		Date:       email.Date,
+		SendAt:     email.SendAt,
+		Size:       emailSize(email),
+		Flags:      flags,
+	}
+
+	for field, text := range emailFields(email) {
+		for position, term := range tokenize(text) {
+			postings, ok := index.Terms[term]
+			if !ok {
+				postings = make(map[string]Postings)
+				index.Terms[term] = postings
+			}
+
+			if postings[id] == nil {
+				postings[id] = make(Postings)
+				index.docTerms[id] = append(index.docTerms[id], term)
+			}
+
+			postings[id][field] = append(postings[id][field], position)
+		}
+	}
+
+	index.changes++
+}
+
+// remove drops an email from the index
+func (index *SearchIndex) remove(id string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	index.removeLocked(id)
+}
+
+// removeLocked drops an email from the index, the caller must hold the lock
+func (index *SearchIndex) removeLocked(id string) {
+	if _, ok := index.Docs[id]; !ok {
+		return
+	}
+
+	delete(index.Docs, id)
+
+	for _, term := range index.docTerms[id] {
+		postings := index.Terms[term]
+		delete(postings, id)
+
+		if len(postings) == 0 {
+			delete(index.Terms, term)
+		}
+	}
+	delete(index.docTerms, id)
+
+	index.changes++
+}
+
+// move records an email now belongs to another folder
+func (index *SearchIndex) move(id string, folder string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if doc, ok := index.Docs[id]; ok {
+		doc.Folder = folder
+		index.changes++
+	}
+}
+
+// setFlags records the new flags of an email
+func (index *SearchIndex) setFlags(id string, flags Flags) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	if doc, ok := index.Docs[id]; ok {
+		doc.Flags = flags
+		index.changes++
+	}
+}
+
+// renameFolder records all the emails of a folder now belong to another one
+func (index *SearchIndex) renameFolder(folder string, name string) {
+	index.mutex.Lock()
+	defer index.mutex.Unlock()
+
+	for _, doc := range index.Docs {
+		if doc.Folder == folder {
+			doc.Folder = name
+			index.changes++
+		}
+	}
+}
+
+// load reads the index saved on disk, then indexes the emails which were
+// written since it was saved and drops the ones which were removed. The flags
+// of every email are read again, as they change more often than the emails
+func (index *SearchIndex) load() {
+	path := filepath.Join(INDEX, "search.json")
+
+	if data, err := ioutil.ReadFile(path); err == nil {
+		index.mutex.Lock()
+		index.Version = 0
+		err = json.Unmarshal(data, index)
+
+		if err != nil || index.Version != indexVersion {
+			// A corrupted or outdated index is simply rebuilt from the mailbox
+			log.Println("Rebuilding the search index")
+			index.Version = indexVersion
+			index.Docs = make(map[string]*IndexedDoc)
+			index.Terms = make(map[string]map[string]Postings)
+		}
+
+		index.docTerms = make(map[string][]string)
+		for term, postings := range index.Terms {
+			for id := range postings {
+				index.docTerms[id] = append(index.docTerms[id], term)
+			}
+		}
+		index.mutex.Unlock()
+	} else if !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	folders, err := listFolders()
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	found := make(map[string]bool)
+
+	for _, folder := range folders {
+		ids, err := mailbox.IDs(folder)
+		if err != nil {
+			log.Print(err.Error())
+			continue
+		}
+
+		for _, id := range ids {
+			found[id] = true
+
+			index.mutex.RLock()
+			doc, ok := index.Docs[id]
+			index.mutex.RUnlock()
+
+			if !ok || doc.Folder != folder {
+				if email, err := readEmail(folder, id); err == nil {
+					index.add(folder, email)
+				} else {
+					log.Print(err.Error())
+					continue
+				}
+			}
+
+			if flags, err := readFlags(folder, id); err == nil {
+				index.setFlags(id, flags)
+			} else {
+				log.Print(err.Error())
+			}
+		}
+	}
+
+	index.mutex.RLock()
+	var removed []string
+	for id := range index.Docs {
+		if !found[id] {
+			removed = append(removed, id)
+		}
+	}
+	index.mutex.RUnlock()
+
+	for _, id := range removed {
+		index.remove(id)
+	}
+
+	log.Printf("Search index loaded with %d emails\n", len(found))
+}
+
+// save writes the index to disk if it changed since it was last saved. The
+// index is written to a temporary file first, so that a crash never leaves
+// a partial index behind. It's only read locked while it's serialised, the
+// mailbox goes on being updated meanwhile
+func (index *SearchIndex) save() error {
+	index.mutex.RLock()
+	changes := index.changes
+	if changes == index.saved {
+		index.mutex.RUnlock()
+		return nil
+	}
+
+	data, err := json.Marshal(index)
+	index.mutex.RUnlock()
+
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(INDEX, "search.json")
+
+	if err := ioutil.WriteFile(path+".tmp", data, 0755); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	// The updates made while it was written are saved the next time
+	index.mutex.Lock()
+	index.saved = changes
+	index.mutex.Unlock()
+
+	return nil
+}
+
+// saveIndex periodically saves the search index to disk
+func saveIndex(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		if err := index.save(); err != nil {
+			log.Println("Could not save the search index " + err.Error())
+		}
+	}
+}
+
+// Query is a node of a parsed search query, it returns the emails matching it
+type Query interface {
+	match(index *SearchIndex) map[string]bool
+}
+
+// termQuery matches the emails containing a word or a phrase, in one field or
+// in any of them
+type termQuery struct {
+	field string
+	terms []string
+}
+
+// dateQuery matches the emails sent within [after, before)
+type dateQuery struct {
+	after  time.Time
+	before time.Time
+}
+
+// folderQuery matches the emails of a folder
+type folderQuery struct {
+	folder string
+}
+
+// andQuery matches the emails matching both its queries
+type andQuery struct {
+	left  Query
+	right Query
+}
+
+// orQuery matches the emails matching any of its queries
+type orQuery struct {
+	left  Query
+	right Query
+}
+
+// notQuery matches the emails which don't match its query
+type notQuery struct {
+	query Query
+}
+
+func (query termQuery) match(index *SearchIndex) map[string]bool {
+	matches := make(map[string]bool)
+
+	if len(query.terms) == 0 {
+		return matches
+	}
+
+	for id, postings := range index.Terms[query.terms[0]] {
+		for field, positions := range postings {
+			if query.field != "" && query.field != field {
+				continue
+			}
+
+			if index.phraseAt(id, field, positions, query.terms[1:]) {
+				matches[id] = true
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// phraseAt tells whether the rest of a phrase follows any of the positions
+// of its first word in a field of an email
+func (index *SearchIndex) phraseAt(id string, field string, positions []int,
+	rest []string) bool {
+
+	for _, position := range positions {
+		found := true
+
+		for offset, term := range rest {
+			if !containsInt(index.Terms[term][id][field], position+offset+1) {
+				found = false
+				break
+			}
+		}
+
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsInt tells whether a list of integers contains a value
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (query dateQuery) match(index *SearchIndex) map[string]bool {
+	matches := make(map[string]bool)
+
+	for id, doc := range index.Docs {
+		if !query.after.IsZero() && doc.Date.Before(query.after) {
+			continue
+		}
+		if !query.before.IsZero() && !doc.Date.Before(query.before) {
+			continue
+		}
+
+		matches[id] = true
+	}
+
+	return matches
+}
+
+func (query folderQuery) match(index *SearchIndex) map[string]bool {
+	matches := make(map[string]bool)
+
+	for id, doc := range index.Docs {
+		if strings.EqualFold(doc.Folder, query.folder) {
+			matches[id] = true
+		}
+	}
+
+	return matches
+}
+
+func (query andQuery) match(index *SearchIndex) map[string]bool {
+	left := query.left.match(index)
+	right := query.right.match(index)
+
+	for id := range left {
+		if !right[id] {
+			delete(left, id)
+		}
+	}
+
+	return left
+}
+
+func (query orQuery) match(index *SearchIndex) map[string]bool {
+	left := query.left.match(index)
+
+	for id := range query.right.match(index) {
+		left[id] = true
+	}
+
+	return left
+}
+
+func (query notQuery) match(index *SearchIndex) map[string]bool {
+	excluded := query.query.match(index)
+	matches := make(map[string]bool)
+
+	for id := range index.Docs {
+		if !excluded[id] {
+			matches[id] = true
+		}
+	}
+
+	return matches
+}
+
+// queryParser parses a search query, collecting the terms used to rank the
+// matching emails
+type queryParser struct {
+	tokens []string
+	pos    int
+	terms  []termQuery
+}
+
+// lexQuery splits a search query into words, quoted phrases and parentheses
+// A qualifier stays attached to its phrase, e.g. subject:"hello world"
+func lexQuery(text string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+
+	quoted := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, c := range text {
+		switch {
+		case c == '"':
+			current.WriteRune(c)
+			quoted = !quoted
+		case quoted:
+			current.WriteRune(c)
+		case c == '(' || c == ')':
+			flush()
+			tokens = append(tokens, string(c))
+		case unicode.IsSpace(c):
+			flush()
+		default:
+			current.WriteRune(c)
+		}
+	}
+
+	if quoted {
+		return nil, errBadQuery
+	}
+
+	flush()
+
+	return tokens, nil
+}
+
+// parseQuery parses a search query into a tree of queries, and returns the
+// terms it contains
+func parseQuery(text string) (Query, []termQuery, error) {
+	tokens, err := lexQuery(text)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parser := queryParser{tokens: tokens}
+
+	query, err := parser.parseOr()
+	if err != nil {
+		return nil, nil, err
+	} else if parser.pos < len(parser.tokens) {
+		return nil, nil, errBadQuery
+	}
+
+	return query, parser.terms, nil
+}
+
+func (parser *queryParser) peek() string {
+	if parser.pos < len(parser.tokens) {
+		return parser.tokens[parser.pos]
+	}
+
+	return ""
+}
+
+// parseOr parses: and ("OR" and)*
+func (parser *queryParser) parseOr() (Query, error) {
+	left, err := parser.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for parser.peek() == "OR" {
+		parser.pos++
+
+		right, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = orQuery{left, right}
+	}
+
+	return left, nil
+}
+
+// parseAnd parses: unary (["AND"] unary)*
+func (parser *queryParser) parseAnd() (Query, error) {
+	left, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		next := parser.peek()
+
+		if next == "" || next == "OR" || next == ")" {
+			return left, nil
+		} else if next == "AND" {
+			parser.pos++
+		}
+
+		right, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = andQuery{left, right}
+	}
+}
+
+// parseUnary parses: ("NOT" | "-") unary | "(" or ")" | term
+func (parser *queryParser) parseUnary() (Query, error) {
+	token := parser.peek()
+
+	switch {
+	case token == "" || token == ")" || token == "OR" || token == "AND":
+		return nil, errBadQuery
+	case token == "NOT":
+		parser.pos++
+
+		query, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return notQuery{query}, nil
+	case len(token) > 1 && token[0] == '-':
+		parser.tokens[parser.pos] = token[1:]
+
+		query, err := parser.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return notQuery{query}, nil
+	case token == "(":
+		parser.pos++
+
+		query, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		} else if parser.peek() != ")" {
+			return nil, errBadQuery
+		}
+
+		parser.pos++
+
+		return query, nil
+	}
+
+	parser.pos++
+
+	return parser.parseTerm(token)
+}
+
+// parseTerm parses a word or phrase, with its optional qualifier
+func (parser *queryParser) parseTerm(token string) (Query, error) {
+	qualifier := ""
+
+	if i := strings.Index(token, ":"); i > 0 && token[0] != '"' {
+		qualifier, token = strings.ToLower(token[:i]), token[i+1:]
+	}
+
+	value := strings.Trim(token, `"`)
+
+	switch qualifier {
+	case "after":
+		date, err := time.Parse("2006-01-02", value)
+		return dateQuery{after: date}, err
+	case "before":
+		date, err := time.Parse("2006-01-02", value)
+		return dateQuery{before: date}, err
+	case "date":
+		return parseDateRange(value)
+	case "in":
+		return folderQuery{value}, nil
+	case "", "from", "to", "subject", "body":
+		// A word made of several tokens, like an email address, is looked up as
+		// a phrase
+		query := termQuery{field: qualifier, terms: tokenize(value)}
+		if len(query.terms) == 0 {
+			return nil, errBadQuery
+		}
+
+		parser.terms = append(parser.terms, query)
+
+		return query, nil
+	default:
+		return nil, errBadQuery
+	}
+}
+
+// parseDateRange parses either a single day (2020-02-12) or a range of days
+// (2020-02-01..2020-02-12), both ends included
+func parseDateRange(value string) (Query, error) {
+	bounds := strings.SplitN(value, "..", 2)
+	if len(bounds) == 1 {
+		bounds = append(bounds, bounds[0])
+	}
+
+	var query dateQuery
+	var err error
+
+	if bounds[0] != "" {
+		if query.after, err = time.Parse("2006-01-02", bounds[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	if bounds[1] != "" {
+		if query.before, err = time.Parse("2006-01-02", bounds[1]); err != nil {
+			return nil, err
+		}
+
+		query.before = query.before.AddDate(0, 0, 1)
+	}
+
+	return query, nil
+}
+
+// score ranks an email against the terms of a query using tf-idf, weighted by
+// the field where each term was found
+func (index *SearchIndex) score(id string, terms []termQuery) float64 {
+	score := 0.0
+	total := float64(len(index.Docs))
+
+	for _, query := range terms {
+		for _, term := range query.terms {
+			postings := index.Terms[term]
+			if len(postings) == 0 {
+				continue
+			}
+
+			idf := math.Log(1 + total/float64(len(postings)))
+
+			for field, positions := range postings[id] {
+				if query.field != "" && query.field != field {
+					continue
+				}
+
+				score += fieldWeights[field] * float64(len(positions)) * idf
+			}
+		}
+	}
+
+	return score
+}
+
+// search runs a query against the index, and returns the matching emails
+// ranked by decreasing score, then by decreasing date
+func (index *SearchIndex) search(text string) ([]SearchResult, error) {
+	query, terms, err := parseQuery(text)
+	if err != nil {
+		return nil, errBadQuery
+	}
+
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	var results []SearchResult
+
+	for id := range query.match(index) {
+		results = append(results, SearchResult{
+			UUID:       id,
+			Score:      index.score(id, terms),
+			IndexedDoc: *index.Docs[id],
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+
+		return results[i].Date.After(results[j].Date)
+	})
+
+	return results, nil
+}
+
+// MSASearch gets called from the handleRequests method
+// It searches the mailbox with the query given in the "q" parameter, and
+// sends back at most "limit" results
+func MSASearch(w http.ResponseWriter, r *http.Request) {
+	text := r.URL.Query().Get("q")
+
+	results, err := index.search(text)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Invalid search query : " + text)
+		return
+	}
+
+	response := SearchResults{Total: len(results), Results: results}
+
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil &&
+		limit >= 0 && limit < len(results) {
+		response.Results = results[:limit]
+	}
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(responseJSON)
+}
@@ -0,0 +1,1037 @@
+/*
+sieve.go implements the subset of the Sieve language (RFC 5228) used to
+filter the emails received by the MSA
+Supported:
+  - control: require, if / elsif / else, stop
+  - actions: keep, discard, fileinto, redirect, reject, vacation (RFC 5230)
+  - tests: true, false, not, allof, anyof, exists, header, address, body
+    (RFC 5173) and size
+  - match types :is, :contains and :matches, the comparators i;octet and
+    i;ascii-casemap, and the address parts :all, :localpart and :domain
+A script is compiled once, which checks it completely, then run on each
+email to decide what to do with it
+*/
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// sieveExtensions are the extensions a script can require
+var sieveExtensions = map[string]bool{
+	"fileinto": true, "reject": true, "vacation": true, "body": true,
+}
+
+// sieveActionExtensions are the extensions each action needs
+var sieveActionExtensions = map[string]string{
+	"fileinto": "fileinto", "reject": "reject", "vacation": "vacation",
+}
+
+// SieveError struct representing an error in a script, with its line
+type SieveError struct {
+	Line    int
+	Message string
+}
+
+func (err *SieveError) Error() string {
+	return fmt.Sprintf("line %d: %s", err.Line, err.Message)
+}
+
+// sieveErrorf builds the error of a line of a script
+func sieveErrorf(line int, format string, args ...interface{}) error {
+	return &SieveError{line, fmt.Sprintf(format, args...)}
+}
+
+// Kinds of the tokens of a script
+const (
+	sieveIdentifier = iota
+	sieveTag
+	sieveString
+	sieveNumber
+	sievePunctuation
+	sieveEnd
+)
+
+// sieveToken is a token of a script
+type sieveToken struct {
+	kind   int
+	text   string
+	number int64
+	line   int
+}
+
+// lexSieve splits a script into tokens, dropping the comments
+func lexSieve(script string) ([]sieveToken, error) {
+	var tokens []sieveToken
+
+	line := 1
+	runes := []rune(script)
+
+	for i := 0; i < len(runes); {
+		c := runes[i]
+
+		switch {
+		case c == '\n':
+			line++
+			i++
+
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '#':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+
+		case c == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			start := line
+			for i += 2; i+1 < len(runes) && !(runes[i] == '*' && runes[i+1] == '/'); i++ {
+				if runes[i] == '\n' {
+					line++
+				}
+			}
+
+			if i+1 >= len(runes) {
+				return nil, sieveErrorf(start, "unterminated comment")
+			}
+			i += 2
+
+		case c == '"':
+			start := line
+			var text strings.Builder
+
+			for i++; ; i++ {
+				if i >= len(runes) {
+					return nil, sieveErrorf(start, "unterminated string")
+				} else if runes[i] == '"' {
+					i++
+					break
+				} else if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+
+				if runes[i] == '\n' {
+					line++
+				}
+				text.WriteRune(runes[i])
+			}
+
+			tokens = append(tokens, sieveToken{kind: sieveString,
+				text: text.String(), line: start})
+
+		case c == ':' && i+1 < len(runes) && isSieveLetter(runes[i+1]):
+			start := i
+			for i++; i < len(runes) && isSieveLetter(runes[i]); i++ {
+			}
+
+			tokens = append(tokens, sieveToken{kind: sieveTag,
+				text: strings.ToLower(string(runes[start:i])), line: line})
+
+		case c >= '0' && c <= '9':
+			start := i
+			for ; i < len(runes) && runes[i] >= '0' && runes[i] <= '9'; i++ {
+			}
+
+			number, err := strconv.ParseInt(string(runes[start:i]), 10, 64)
+			if err != nil {
+				return nil, sieveErrorf(line, "invalid number")
+			}
+
+			// Numbers can be given in kilo, mega or giga
+			if i < len(runes) {
+				switch unicode.ToUpper(runes[i]) {
+				case 'K':
+					number, i = number<<10, i+1
+				case 'M':
+					number, i = number<<20, i+1
+				case 'G':
+					number, i = number<<30, i+1
+				}
+			}
+
+			tokens = append(tokens, sieveToken{kind: sieveNumber,
+				number: number, line: line})
+
+		case isSieveLetter(c):
+			start := i
+			for ; i < len(runes) && isSieveLetter(runes[i]); i++ {
+			}
+
+			word := strings.ToLower(string(runes[start:i]))
+
+			// A multi-line string starts with "text:" and ends with a line
+			// holding a single dot
+			if word == "text" && i < len(runes) && runes[i] == ':' {
+				text, lines, length, err := lexMultiline(runes[i+1:], line)
+				if err != nil {
+					return nil, err
+				}
+
+				tokens = append(tokens, sieveToken{kind: sieveString,
+					text: text, line: line})
+				line += lines
+				i += 1 + length
+				continue
+			}
+
+			tokens = append(tokens, sieveToken{kind: sieveIdentifier,
+				text: word, line: line})
+
+		case strings.ContainsRune(";,()[]{}", c):
+			tokens = append(tokens, sieveToken{kind: sievePunctuation,
+				text: string(c), line: line})
+			i++
+
+		default:
+			return nil, sieveErrorf(line, "unexpected character %q", c)
+		}
+	}
+
+	return append(tokens, sieveToken{kind: sieveEnd, line: line}), nil
+}
+
+// isSieveLetter tells whether a character can be part of an identifier
+func isSieveLetter(c rune) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9')
+}
+
+// lexMultiline reads a multi-line string, following "text:". It returns the
+// string, the number of lines it spans and the number of characters read
+func lexMultiline(runes []rune, line int) (string, int, int, error) {
+	rest := string(runes)
+
+	// The rest of the "text:" line can only hold a comment
+	newline := strings.Index(rest, "\n")
+	if newline < 0 {
+		return "", 0, 0, sieveErrorf(line, "unterminated multi-line string")
+	}
+
+	first := strings.TrimSpace(rest[:newline])
+	if first != "" && !strings.HasPrefix(first, "#") {
+		return "", 0, 0, sieveErrorf(line, "unexpected text after text:")
+	}
+
+	var text strings.Builder
+	offset := newline + 1
+	lines := 1
+
+	for {
+		end := strings.Index(rest[offset:], "\n")
+		if end < 0 {
+			return "", 0, 0, sieveErrorf(line, "unterminated multi-line string")
+		}
+
+		current := strings.TrimSuffix(rest[offset:offset+end], "\r")
+		offset += end + 1
+		lines++
+
+		if current == "." {
+			break
+		}
+
+		// Lines starting with a dot are dot-stuffed
+		text.WriteString(strings.TrimPrefix(current, ".") + "\n")
+	}
+
+	return text.String(), lines, len([]rune(rest[:offset])), nil
+}
+
+// sieveArgument is an argument of a command or a test: a tag, a number, or
+// a list of strings (a single string being a list of one)
+type sieveArgument struct {
+	tag     string
+	number  int64
+	strings []string
+	kind    int
+	line    int
+}
+
+// sieveTest is a compiled test
+type sieveTest struct {
+	name        string
+	tests       []sieveTest
+	matchType   string
+	comparator  string
+	addressPart string
+	bodyPart    string
+	contentType []string
+	headers     []string
+	keys        []string
+	over        bool
+	size        int64
+}
+
+// sieveBranch is a branch of an if command, the else branch having no test
+type sieveBranch struct {
+	test  *sieveTest
+	block []sieveCommand
+}
+
+// sieveCommand is a compiled command
+type sieveCommand struct {
+	name     string
+	argument string
+	vacation *VacationReply
+	branches []sieveBranch
+	line     int
+}
+
+// SieveScript struct representing a compiled script
+type SieveScript struct {
+	commands []sieveCommand
+}
+
+// sieveParser compiles the tokens of a script
+type sieveParser struct {
+	tokens   []sieveToken
+	position int
+	required map[string]bool
+}
+
+func (p *sieveParser) peek() sieveToken {
+	return p.tokens[p.position]
+}
+
+func (p *sieveParser) next() sieveToken {
+	token := p.tokens[p.position]
+	if token.kind != sieveEnd {
+		p.position++
+	}
+
+	return token
+}
+
+// isPunctuation tells whether the next token is the given punctuation
+func (p *sieveParser) isPunctuation(text string) bool {
+	token := p.peek()
+
+	return token.kind == sievePunctuation && token.text == text
+}
+
+// expect reads the given punctuation
+func (p *sieveParser) expect(text string) error {
+	token := p.next()
+	if token.kind != sievePunctuation || token.text != text {
+		return sieveErrorf(token.line, "expected %q", text)
+	}
+
+	return nil
+}
+
+// CompileSieve checks and compiles a script
+func CompileSieve(script string) (*SieveScript, error) {
+	tokens, err := lexSieve(script)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := sieveParser{tokens: tokens, required: make(map[string]bool)}
+
+	commands, err := parser.commands(true)
+	if err != nil {
+		return nil, err
+	}
+
+	if token := parser.peek(); token.kind != sieveEnd {
+		return nil, sieveErrorf(token.line, "unexpected %q", token.text)
+	}
+
+	return &SieveScript{commands}, nil
+}
+
+// commands compiles commands up to the end of the script or of a block
+func (p *sieveParser) commands(top bool) ([]sieveCommand, error) {
+	var commands []sieveCommand
+	first := true
+
+	for {
+		token := p.peek()
+		if token.kind == sieveEnd || (token.kind == sievePunctuation && token.text == "}") {
+			return commands, nil
+		}
+
+		if token.kind != sieveIdentifier {
+			return nil, sieveErrorf(token.line, "expected a command")
+		}
+
+		// require is only allowed at the start of the script
+		if token.text == "require" {
+			if !top || !first {
+				return nil, sieveErrorf(token.line, "require must come first")
+			}
+			if err := p.require(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		first = false
+
+		command, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+
+		commands = append(commands, command)
+	}
+}
+
+// require reads the extensions the script requires
+func (p *sieveParser) require() error {
+	token := p.next()
+
+	arguments, err := p.arguments()
+	if err != nil {
+		return err
+	}
+
+	if len(arguments) != 1 || arguments[0].kind != sieveString {
+		return sieveErrorf(token.line, "require expects a list of extensions")
+	}
+
+	for _, extension := range arguments[0].strings {
+		if !sieveExtensions[strings.ToLower(extension)] {
+			return sieveErrorf(token.line, "unsupported extension %q", extension)
+		}
+
+		p.required[strings.ToLower(extension)] = true
+	}
+
+	return p.expect(";")
+}
+
+// arguments reads the arguments of a command or a test
+func (p *sieveParser) arguments() ([]sieveArgument, error) {
+	var arguments []sieveArgument
+
+	for {
+		token := p.peek()
+
+		switch {
+		case token.kind == sieveTag:
+			p.next()
+			arguments = append(arguments, sieveArgument{tag: token.text,
+				kind: sieveTag, line: token.line})
+
+		case token.kind == sieveNumber:
+			p.next()
+			arguments = append(arguments, sieveArgument{number: token.number,
+				kind: sieveNumber, line: token.line})
+
+		case token.kind == sieveString:
+			p.next()
+			arguments = append(arguments, sieveArgument{strings: []string{token.text},
+				kind: sieveString, line: token.line})
+
+		case token.kind == sievePunctuation && token.text == "[":
+			p.next()
+			list, err := p.stringList()
+			if err != nil {
+				return nil, err
+			}
+
+			arguments = append(arguments, sieveArgument{strings: list,
+				kind: sieveString, line: token.line})
+
+		default:
+			return arguments, nil
+		}
+	}
+}
+
+// stringList reads a list of strings, after its opening bracket
+func (p *sieveParser) stringList() ([]string, error) {
+	var list []string
+
+	for {
+		token := p.next()
+		if token.kind != sieveString {
+			return nil, sieveErrorf(token.line, "expected a string")
+		}
+
+		list = append(list, token.text)
+
+		if p.isPunctuation("]") {
+			p.next()
+			return list, nil
+		}
+
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// command compiles a command
+func (p *sieveParser) command() (sieveCommand, error) {
+	token := p.next()
+	command := sieveCommand{name: token.text, line: token.line}
+
+	if extension, ok := sieveActionExtensions[command.name]; ok && !p.required[extension] {
+		return command, sieveErrorf(token.line, "%s requires the %q extension",
+			command.name, extension)
+	}
+
+	if command.name == "if" {
+		return p.ifCommand(command)
+	} else if command.name == "elsif" || command.name == "else" {
+		return command, sieveErrorf(token.line, "%s without if", command.name)
+	}
+
+	arguments, err := p.arguments()
+	if err != nil {
+		return command, err
+	}
+
+	switch command.name {
+	case "keep", "discard", "stop":
+		if len(arguments) != 0 {
+			return command, sieveErrorf(token.line, "%s takes no argument", command.name)
+		}
+
+	case "fileinto", "redirect", "reject":
+		if len(arguments) != 1 || arguments[0].kind != sieveString ||
+			len(arguments[0].strings) != 1 {
+			return command, sieveErrorf(token.line, "%s expects a string", command.name)
+		}
+
+		command.argument = arguments[0].strings[0]
+
+		if command.name == "redirect" && !strings.Contains(command.argument, "@") {
+			return command, sieveErrorf(token.line, "invalid address %q", command.argument)
+		}
+
+	case "vacation":
+		if command.vacation, err = vacationArguments(arguments, token.line); err != nil {
+			return command, err
+		}
+
+	default:
+		return command, sieveErrorf(token.line, "unknown command %q", command.name)
+	}
+
+	return command, p.expect(";")
+}
+
+// vacationArguments reads the arguments of the vacation action
+func vacationArguments(arguments []sieveArgument, line int) (*VacationReply, error) {
+	reply := VacationReply{Days: defaultVacationDays}
+
+	for i := 0; i < len(arguments); i++ {
+		argument := arguments[i]
+
+		if argument.kind != sieveTag {
+			if i != len(arguments)-1 || len(argument.strings) != 1 {
+				return nil, sieveErrorf(line, "vacation expects a reason last")
+			}
+
+			reply.Reason = argument.strings[0]
+			return &reply, nil
+		}
+
+		if argument.tag == ":mime" {
+			continue
+		}
+
+		if i+1 >= len(arguments) {
+			return nil, sieveErrorf(line, "%s expects a value", argument.tag)
+		}
+		i++
+		value := arguments[i]
+
+		switch {
+		case argument.tag == ":days" && value.kind == sieveNumber:
+			reply.Days = int(value.number)
+		case argument.tag == ":addresses" && value.kind == sieveString:
+			reply.Addresses = value.strings
+		case argument.tag == ":subject" && value.kind == sieveString && len(value.strings) == 1:
+			reply.Subject = value.strings[0]
+		case argument.tag == ":from" && value.kind == sieveString && len(value.strings) == 1:
+			reply.From = value.strings[0]
+		case argument.tag == ":handle" && value.kind == sieveString && len(value.strings) == 1:
+			reply.Handle = value.strings[0]
+		default:
+			return nil, sieveErrorf(line, "invalid vacation argument %s", argument.tag)
+		}
+	}
+
+	return nil, sieveErrorf(line, "vacation expects a reason")
+}
+
+// ifCommand compiles an if command with its elsif and else branches
+func (p *sieveParser) ifCommand(command sieveCommand) (sieveCommand, error) {
+	for keyword := "if"; ; {
+		branch := sieveBranch{}
+
+		if keyword != "else" {
+			test, err := p.test()
+			if err != nil {
+				return command, err
+			}
+			branch.test = &test
+		}
+
+		if err := p.expect("{"); err != nil {
+			return command, err
+		}
+
+		block, err := p.commands(false)
+		if err != nil {
+			return command, err
+		}
+
+		if err := p.expect("}"); err != nil {
+			return command, err
+		}
+
+		branch.block = block
+		command.branches = append(command.branches, branch)
+
+		next := p.peek()
+		if keyword == "else" || next.kind != sieveIdentifier ||
+			(next.text != "elsif" && next.text != "else") {
+			return command, nil
+		}
+
+		keyword = p.next().text
+	}
+}
+
+// test compiles a test
+func (p *sieveParser) test() (sieveTest, error) {
+	token := p.next()
+	test := sieveTest{name: token.text, matchType: ":is",
+		comparator: "i;ascii-casemap", addressPart: ":all", bodyPart: ":text"}
+
+	if token.kind != sieveIdentifier {
+		return test, sieveErrorf(token.line, "expected a test")
+	}
+
+	switch test.name {
+	case "not":
+		inner, err := p.test()
+		test.tests = []sieveTest{inner}
+		return test, err
+
+	case "allof", "anyof":
+		if err := p.expect("("); err != nil {
+			return test, err
+		}
+
+		for {
+			inner, err := p.test()
+			if err != nil {
+				return test, err
+			}
+			test.tests = append(test.tests, inner)
+
+			if p.isPunctuation(")") {
+				p.next()
+				return test, nil
+			}
+			if err := p.expect(","); err != nil {
+				return test, err
+			}
+		}
+	}
+
+	arguments, err := p.arguments()
+	if err != nil {
+		return test, err
+	}
+
+	// Tags come first, then the positional arguments
+	var positional []sieveArgument
+
+	for i := 0; i < len(arguments); i++ {
+		argument := arguments[i]
+
+		if argument.kind != sieveTag {
+			positional = append(positional, argument)
+			continue
+		} else if len(positional) > 0 {
+			return test, sieveErrorf(argument.line, "%s after the arguments", argument.tag)
+		}
+
+		switch argument.tag {
+		case ":is", ":contains", ":matches":
+			test.matchType = argument.tag
+		case ":all", ":localpart", ":domain":
+			test.addressPart = argument.tag
+		case ":over", ":under":
+			test.over = argument.tag == ":over"
+			test.matchType = argument.tag
+		case ":raw", ":text":
+			test.bodyPart = argument.tag
+		case ":comparator", ":content":
+			if i+1 >= len(arguments) || arguments[i+1].kind != sieveString {
+				return test, sieveErrorf(argument.line, "%s expects a string", argument.tag)
+			}
+			i++
+
+			if argument.tag == ":content" {
+				test.bodyPart = ":content"
+				test.contentType = arguments[i].strings
+				break
+			}
+
+			test.comparator = strings.ToLower(arguments[i].strings[0])
+			if test.comparator != "i;octet" && test.comparator != "i;ascii-casemap" {
+				return test, sieveErrorf(argument.line, "unsupported comparator %q",
+					test.comparator)
+			}
+		default:
+			return test, sieveErrorf(argument.line, "unknown tag %s", argument.tag)
+		}
+	}
+
+	// strings checks the positional arguments are n lists of strings
+	stringArguments := func(n int) error {
+		if len(positional) != n {
+			return sieveErrorf(token.line, "%s expects %d arguments", test.name, n)
+		}
+
+		for _, argument := range positional {
+			if argument.kind != sieveString {
+				return sieveErrorf(argument.line, "%s expects strings", test.name)
+			}
+		}
+
+		return nil
+	}
+
+	// Only size compares numbers
+	if test.name != "size" && (test.matchType == ":over" || test.matchType == ":under") {
+		return test, sieveErrorf(token.line, "%s expects :is, :contains or :matches", test.name)
+	}
+
+	switch test.name {
+	case "true", "false":
+		err = stringArguments(0)
+
+	case "exists":
+		if err = stringArguments(1); err == nil {
+			test.headers = positional[0].strings
+		}
+
+	case "header", "address":
+		if err = stringArguments(2); err == nil {
+			test.headers, test.keys = positional[0].strings, positional[1].strings
+		}
+
+	case "body":
+		if !p.required["body"] {
+			return test, sieveErrorf(token.line, "body requires the \"body\" extension")
+		}
+		if err = stringArguments(1); err == nil {
+			test.keys = positional[0].strings
+		}
+
+	case "size":
+		if test.matchType != ":over" && test.matchType != ":under" {
+			return test, sieveErrorf(token.line, "size expects :over or :under")
+		} else if len(positional) != 1 || positional[0].kind != sieveNumber {
+			return test, sieveErrorf(token.line, "size expects a number")
+		}
+		test.size = positional[0].number
+
+	default:
+		return test, sieveErrorf(token.line, "unknown test %q", test.name)
+	}
+
+	return test, err
+}
+
+// SieveResult struct representing what a script decided to do with an email
+type SieveResult struct {
+	Keep     bool
+	FileInto []string
+	Redirect []string
+	Reject   string
+	Vacation *VacationReply
+}
+
+// Run runs the script on an email. Unless the script cancels it, the email
+// is kept in the Inbox
+func (script *SieveScript) Run(email EMail) SieveResult {
+	result := SieveResult{}
+	implicitKeep := true
+
+	runSieve(script.commands, email, &result, &implicitKeep)
+
+	result.Keep = result.Keep || implicitKeep
+
+	// A rejected email is never delivered
+	if result.Reject != "" {
+		result.Keep, result.FileInto, result.Redirect = false, nil, nil
+	}
+
+	return result
+}
+
+// runSieve runs a block of commands. It returns false once the script stops
+func runSieve(commands []sieveCommand, email EMail, result *SieveResult,
+	implicitKeep *bool) bool {
+
+	for _, command := range commands {
+		switch command.name {
+		case "stop":
+			return false
+		case "keep":
+			result.Keep = true
+		case "discard":
+			*implicitKeep = false
+		case "fileinto":
+			result.FileInto = append(result.FileInto, command.argument)
+			*implicitKeep = false
+		case "redirect":
+			result.Redirect = append(result.Redirect, command.argument)
+			*implicitKeep = false
+		case "reject":
+			result.Reject = command.argument
+			*implicitKeep = false
+		case "vacation":
+			result.Vacation = command.vacation
+		case "if":
+			for _, branch := range command.branches {
+				if branch.test == nil || branch.test.eval(email) {
+					if !runSieve(branch.block, email, result, implicitKeep) {
+						return false
+					}
+					break
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// emailHeader returns the values of a header of an email, whether it comes
+// from a field of the email or from its other headers
+func emailHeader(email EMail, name string) []string {
+	var value string
+
+	switch strings.ToLower(name) {
+	case "from":
+		value = email.From
+	case "to":
+		value = email.To
+	case "subject":
+		value = email.Subject
+	case "message-id":
+		value = email.MessageID
+	case "in-reply-to":
+		value = email.InReplyTo
+	case "references":
+		value = strings.Join(email.References, " ")
+	case "received":
+		// Each MTA the email went through added its own trace
+		return email.Received
+	case "date":
+		if !email.Date.IsZero() {
+			value = email.Date.Format("Mon, 02 Jan 2006 15:04:05 -0700")
+		}
+	default:
+		for header, headerValue := range email.Headers {
+			if strings.EqualFold(header, name) {
+				value = headerValue
+			}
+		}
+	}
+
+	if value == "" {
+		return nil
+	}
+
+	return []string{value}
+}
+
+// eval evaluates a test on an email
+func (test sieveTest) eval(email EMail) bool {
+	switch test.name {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "not":
+		return !test.tests[0].eval(email)
+
+	case "allof":
+		for _, inner := range test.tests {
+			if !inner.eval(email) {
+				return false
+			}
+		}
+		return true
+
+	case "anyof":
+		for _, inner := range test.tests {
+			if inner.eval(email) {
+				return true
+			}
+		}
+		return false
+
+	case "exists":
+		for _, header := range test.headers {
+			if emailHeader(email, header) == nil {
+				return false
+			}
+		}
+		return true
+
+	case "header":
+		var values []string
+		for _, header := range test.headers {
+			values = append(values, emailHeader(email, header)...)
+		}
+		return test.matchAny(values)
+
+	case "address":
+		var values []string
+		for _, header := range test.headers {
+			for _, value := range emailHeader(email, header) {
+				for _, address := range parseAddressList(value) {
+					values = append(values, addressPart(address, test.addressPart))
+				}
+			}
+		}
+		return test.matchAny(values)
+
+	case "body":
+		return test.matchAny(bodyParts(email, test.bodyPart, test.contentType))
+
+	case "size":
+		size := int64(emailSize(email))
+		if test.over {
+			return size > test.size
+		}
+		return size < test.size
+	}
+
+	return false
+}
+
+// addressPart returns a part of an address
+func addressPart(address string, part string) string {
+	at := strings.LastIndex(address, "@")
+
+	switch {
+	case part == ":localpart" && at >= 0:
+		return address[:at]
+	case part == ":domain" && at >= 0:
+		return address[at+1:]
+	case part == ":domain":
+		return ""
+	}
+
+	return address
+}
+
+// bodyParts returns the parts of the body of an email a body test looks at
+func bodyParts(email EMail, part string, contentTypes []string) []string {
+	switch part {
+	case ":raw":
+		raw, err := FormatEMail(email)
+		if err != nil {
+			return nil
+		}
+		return []string{string(raw)}
+
+	case ":content":
+		var parts []string
+
+		for _, contentType := range contentTypes {
+			contentType = strings.ToLower(contentType)
+
+			// An empty type, "text" or "text/plain" all match the text body
+			matches := func(mediaType string) bool {
+				return contentType == "" || contentType == mediaType ||
+					strings.HasPrefix(mediaType, contentType+"/")
+			}
+
+			if matches("text/plain") {
+				parts = append(parts, email.Body)
+			}
+			if email.HTML != "" && matches("text/html") {
+				parts = append(parts, email.HTML)
+			}
+			for _, attachment := range email.Attachments {
+				if matches(strings.ToLower(attachment.ContentType)) &&
+					strings.HasPrefix(attachment.ContentType, "text/") {
+					parts = append(parts, string(attachment.Data))
+				}
+			}
+		}
+
+		return parts
+	}
+
+	return []string{email.Body + "\n" + htmlText(email.HTML)}
+}
+
+// matchAny tells whether any of the values matches any of the keys
+func (test sieveTest) matchAny(values []string) bool {
+	for _, value := range values {
+		for _, key := range test.keys {
+			if test.match(value, key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// match compares a value to a key with the match type and the comparator of
+// the test
+func (test sieveTest) match(value string, key string) bool {
+	if test.comparator == "i;ascii-casemap" {
+		value, key = strings.ToLower(value), strings.ToLower(key)
+	}
+
+	switch test.matchType {
+	case ":contains":
+		return strings.Contains(value, key)
+	case ":matches":
+		return wildcard(key).MatchString(value)
+	}
+
+	return value == key
+}
+
+// wildcard converts the key of a :matches test to a regular expression. A
+// "*" matches any text, a "?" matches a single character, and a backslash
+// escapes the next character
+func wildcard(key string) *regexp.Regexp {
+	var pattern strings.Builder
+	pattern.WriteString("(?s)^")
+
+	runes := []rune(key)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+			}
+			pattern.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+
+	pattern.WriteString("$")
+
+	return regexp.MustCompile(pattern.String())
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sieveEmail is the email the scripts of the tests are run on
+var sieveEmail = EMail{
+	From:    "Bill Gates <billgates@here.com>",
+	To:      "stevejobs@there.com",
+	Subject: "Your Invoice for March",
+	Body:    "Hello,\nPlease find the invoice attached.\n",
+	HTML:    "<p>Please pay <b>today</b></p>",
+	Date:    time.Date(2020, 2, 12, 10, 30, 0, 0, time.UTC),
+	Headers: map[string]string{
+		"List-Id": "<team.here.com>",
+		"Cc":      "Tim <tim@apple.com>, larry@oracle.com",
+	},
+	Received: []string{
+		"from 192.168.1.5 by there.com with HTTP id <1@here.com>; Wed, 12 Feb 2020 10:30:02 +0000",
+		"from billgates@here.com by here.com with HTTP id <1@here.com>; Wed, 12 Feb 2020 10:30:01 +0000",
+	},
+}
+
+func TestSieveRun(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		script string
+		want   SieveResult
+	}{
+		{"empty script", ``, SieveResult{Keep: true}},
+		{"comments only", "# nothing to do\n/* not even\n this */", SieveResult{Keep: true}},
+		{"discard", `discard;`, SieveResult{}},
+		{"discard then keep", `discard; keep;`, SieveResult{Keep: true}},
+		{"stop", `stop; discard;`, SieveResult{Keep: true}},
+		{
+			"header :contains is case insensitive",
+			`require "fileinto";
+			if header :contains "subject" "INVOICE" { fileinto "Bills"; }`,
+			SieveResult{FileInto: []string{"Bills"}},
+		},
+		{
+			"header :contains with i;octet",
+			`require "fileinto";
+			if header :contains :comparator "i;octet" "subject" "INVOICE" { fileinto "Bills"; }`,
+			SieveResult{Keep: true},
+		},
+		{
+			"header :is",
+			`require "fileinto";
+			if header :is "list-id" "<team.here.com>" { fileinto "Team"; stop; }
+			fileinto "Other";`,
+			SieveResult{FileInto: []string{"Team"}},
+		},
+		{
+			":matches with a star",
+			`require "fileinto";
+			if header :matches "subject" "your * for ma?ch" { fileinto "Bills"; }`,
+			SieveResult{FileInto: []string{"Bills"}},
+		},
+		{
+			":matches the whole value",
+			`require "fileinto";
+			if header :matches "subject" "invoice*" { fileinto "Bills"; }`,
+			SieveResult{Keep: true},
+		},
+		{
+			":matches with escaped wildcards",
+			`require "fileinto";
+			if header :matches "subject" "Your Invoice for March\\*" { fileinto "Bills"; }`,
+			SieveResult{Keep: true},
+		},
+		{
+			"address :domain",
+			`require "fileinto";
+			if address :domain "from" "here.com" { fileinto "Local"; }`,
+			SieveResult{FileInto: []string{"Local"}},
+		},
+		{
+			"address :localpart of a header with several addresses",
+			`require "fileinto";
+			if address :localpart "cc" "larry" { fileinto "Oracle"; }`,
+			SieveResult{FileInto: []string{"Oracle"}},
+		},
+		{
+			"address :all ignores the display name",
+			`if address :is "from" "billgates@here.com" { discard; }`,
+			SieveResult{},
+		},
+		{
+			"exists",
+			`if exists ["list-id", "cc"] { discard; }`,
+			SieveResult{},
+		},
+		{
+			"exists with a missing header",
+			`if exists ["list-id", "x-spam"] { discard; }`,
+			SieveResult{Keep: true},
+		},
+		{
+			"received trace",
+			`if header :contains "received" "by here.com" { discard; }`,
+			SieveResult{},
+		},
+		{
+			"size :over",
+			`if size :over 50 { discard; }`,
+			SieveResult{},
+		},
+		{
+			"size :under with a unit",
+			`if size :under 1K { discard; }`,
+			SieveResult{},
+		},
+		{
+			"size :over with a unit",
+			`if size :over 1K { discard; }`,
+			SieveResult{Keep: true},
+		},
+		{
+			"not, anyof and allof",
+			`if allof (not exists "x-spam", anyof (false, header :contains "from" "gates")) { discard; }`,
+			SieveResult{},
+		},
+		{
+			"elsif and else",
+			`require "fileinto";
+			if header :is "subject" "nope" { fileinto "A"; }
+			elsif header :contains "subject" "nope" { fileinto "B"; }
+			else { fileinto "C"; }`,
+			SieveResult{FileInto: []string{"C"}},
+		},
+		{
+			"body :text searches the HTML too",
+			`require "body";
+			if body :contains "today" { discard; }`,
+			SieveResult{},
+		},
+		{
+			"body :content",
+			`require "body";
+			if body :content "text/html" :contains "<b>" { discard; }`,
+			SieveResult{},
+		},
+		{
+			"redirect and keep",
+			`redirect "assistant@here.com"; keep;`,
+			SieveResult{Keep: true, Redirect: []string{"assistant@here.com"}},
+		},
+		{
+			"reject cancels the other actions",
+			`require ["reject", "fileinto"];
+			fileinto "Bills"; reject "No invoices please";`,
+			SieveResult{Reject: "No invoices please"},
+		},
+		{
+			"multi-line reject",
+			"require \"reject\";\nreject text:\nNo invoices.\n..Really.\n.\n;",
+			SieveResult{Reject: "No invoices.\n.Really.\n"},
+		},
+		{
+			"vacation",
+			`require "vacation";
+			vacation :days 3 :subject "Away" :addresses ["steve@there.com"] "I am away";`,
+			SieveResult{Keep: true, Vacation: &VacationReply{Days: 3, Subject: "Away",
+				Addresses: []string{"steve@there.com"}, Reason: "I am away"}},
+		},
+	} {
+		script, err := CompileSieve(test.script)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if got := script.Run(sieveEmail); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCompileSieveErrors(t *testing.T) {
+	for _, test := range []struct {
+		script string
+		line   int
+	}{
+		{`fileinto "Bills";`, 1},
+		{`require "imap4flags";`, 1},
+		{"keep;\nfrobnicate;", 2},
+		{"keep;\nif header :is \"subject\" { discard; }", 2},
+		{`if size 10 { discard; }`, 1},
+		{`if header :contains :comparator "i;unicode" "subject" "x" { discard; }`, 1},
+		{`redirect "nobody";`, 1},
+		{"keep;\n\n\"unterminated", 3},
+		{"/* unterminated", 1},
+		{"require \"reject\";\nreject text: oops\n.\n;", 2},
+		{"require \"reject\";\nreject text:\nno end\n", 2},
+		{`keep`, 1},
+		{`if true { keep;`, 1},
+		{`require "body"; if body :raw :over "x" { keep; }`, 1},
+	} {
+		_, err := CompileSieve(test.script)
+
+		sieveErr, ok := err.(*SieveError)
+		if !ok {
+			t.Errorf("%q: got %v, want a SieveError", test.script, err)
+		} else if sieveErr.Line != test.line {
+			t.Errorf("%q: error %q on line %d, want line %d", test.script,
+				sieveErr.Message, sieveErr.Line, test.line)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+/*
+storage.go handles where the mailbox is stored on disk
+The rest of the MSA goes through the Mailbox interface, so that the emails
+can be stored in different layouts chosen at startup:
+  - files: every email is a "<uuid>.email" JSON file in the directory of its
+    folder, with its flags in a "<uuid>.flags" file
+  - maildir: a Maildir++ directory, readable by other mail tools
+  - bolt: an embedded transactional key/value database
+Every storage must pass the checks of storage_test.go
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Mailbox is the storage of the folders and emails of the mailbox. Errors
+// about missing folders or emails satisfy os.IsNotExist
+type Mailbox interface {
+	// Init creates the system folders if they don't exist yet
+	Init() error
+
+	// Folders lists the user folders
+	Folders() ([]string, error)
+	// CheckFolder checks the folder exists
+	CheckFolder(folder string) error
+	CreateFolder(folder string) error
+	RenameFolder(folder string, name string) error
+	// DeleteFolder deletes a user folder along with the emails left in it
+	DeleteFolder(folder string) error
+
+	// IDs lists the UUIDs of the emails of a folder
+	IDs(folder string) ([]string, error)
+	Read(folder string, id string) (EMail, error)
+	// Write writes the email under its own UUID, replacing any previous
+	// version of the email but keeping its flags. A UUID is unique in the
+	// whole mailbox: writing an email of another folder fails with
+	// errEmailExists, it has to be moved
+	Write(folder string, email EMail) error
+	Remove(folder string, id string) error
+	// Move moves an email and its flags to another folder
+	Move(from string, to string, id string) error
+	// ModTime returns when the email was written or moved to its folder
+	ModTime(folder string, id string) (time.Time, error)
+
+	ReadFlags(folder string, id string) (Flags, error)
+	WriteFlags(folder string, id string, flags Flags) error
+}
+
+// mailbox is the storage chosen at startup
+var mailbox Mailbox = fileMailbox{"."}
+
+var errUnknownStorage = errors.New("unknown storage")
+
+// newMailbox opens the storage of the given name, in the directory dir
+func newMailbox(storage string, dir string) (Mailbox, error) {
+	switch storage {
+	case "files":
+		return fileMailbox{dir}, nil
+	case "maildir":
+		return maildirMailbox{filepath.Join(dir, MAILDIR)}, nil
+	case "bolt":
+		return openBoltMailbox(filepath.Join(dir, MAILBOXDB))
+	default:
+		return nil, errUnknownStorage
+	}
+}
+
+// notExist builds the error returned for an email or a folder which doesn't
+// exist
+func notExist(path string) error {
+	return &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+}
+
+// writeFileAtomic writes a file through a temporary file renamed over it, so
+// that the file is never read half written, even after a crash
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0755)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// migrateMailbox copies every folder, email and flag of a mailbox to another
+// one. Emails already in the destination are written again, so that an
+// interrupted migration can simply be run again
+func migrateMailbox(from Mailbox, to Mailbox) error {
+	if err := to.Init(); err != nil {
+		return err
+	}
+
+	folders, err := from.Folders()
+	if err != nil {
+		return err
+	}
+
+	for _, folder := range folders {
+		err := to.CreateFolder(folder)
+		if err != nil && err != errFolderExists {
+			return err
+		}
+	}
+
+	for _, folder := range append(append([]string{}, systemFolders...), folders...) {
+		ids, err := from.IDs(folder)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			email, err := from.Read(folder, id)
+			if err != nil {
+				// Skip the emails which can't be read rather than losing the
+				// rest of the mailbox
+				log.Print(err.Error())
+				continue
+			}
+
+			flags, err := from.ReadFlags(folder, id)
+			if err != nil {
+				return err
+			}
+
+			// An email found in two folders by an older MSA is only
+			// migrated once
+			if err := to.Write(folder, email); err == errEmailExists {
+				log.Printf("Skipped email %s, already migrated\n", id)
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := to.WriteFlags(folder, id, flags); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Migrated %d emails from %s\n", len(ids), folder)
+	}
+
+	return nil
+}
+
+// inOtherFolder tells whether an email is in another folder than the one
+// given, for the storages which keep each folder apart
+func inOtherFolder(m Mailbox, folder string, id string) (bool, error) {
+	folders, err := m.Folders()
+	if err != nil {
+		return false, err
+	}
+
+	for _, other := range append(append([]string{}, systemFolders...), folders...) {
+		if other == folder {
+			continue
+		}
+
+		if _, err := m.ModTime(other, id); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// fileMailbox stores the system folders at the root of the mailbox and the
+// user folders in FOLDERS, with one JSON file per email
+type fileMailbox struct {
+	root string
+}
+
+// path returns the directory holding the emails of the folder
+func (m fileMailbox) path(folder string) (string, error) {
+	if isSystemFolder(folder) {
+		return filepath.Join(m.root, folder), nil
+	} else if !validFolderName(folder) {
+		return "", errInvalidFolder
+	}
+
+	path := filepath.Join(m.root, FOLDERS, folder)
+
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// file returns the path of a file of the email in the folder, either the
+// email itself (".email") or its flags (".flags")
+func (m fileMailbox) file(folder string, id string, ext string) (string, error) {
+	dir, err := m.path(folder)
+	if err != nil {
+		return "", err
+	}
+
+	// The UUID ends up in a path, it mustn't lead out of the folder
+	if _, err := uuid.Parse(id); err != nil {
+		return "", notExist(id)
+	}
+
+	return filepath.Join(dir, id+ext), nil
+}
+
+func (m fileMailbox) Init() error {
+	for _, folder := range append([]string{FOLDERS}, systemFolders...) {
+		if err := os.MkdirAll(filepath.Join(m.root, folder), 0755); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m fileMailbox) Folders() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(m.root, FOLDERS))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, file := range files {
+		if file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func (m fileMailbox) CheckFolder(folder string) error {
+	_, err := m.path(folder)
+
+	return err
+}
+
+func (m fileMailbox) CreateFolder(folder string) error {
+	if !validFolderName(folder) {
+		return errInvalidFolder
+	}
+
+	err := os.Mkdir(filepath.Join(m.root, FOLDERS, folder), 0755)
+	if os.IsExist(err) {
+		return errFolderExists
+	}
+
+	return err
+}
+
+func (m fileMailbox) RenameFolder(folder string, name string) error {
+	if !validFolderName(name) {
+		return errInvalidFolder
+	}
+
+	src, err := m.path(folder)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(m.root, FOLDERS, name)
+	if _, err := os.Stat(dst); err == nil {
+		return errFolderExists
+	}
+
+	return os.Rename(src, dst)
+}
+
+func (m fileMailbox) DeleteFolder(folder string) error {
+	path, err := m.path(folder)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path)
+}
+
+func (m fileMailbox) IDs(folder string) ([]string, error) {
+	dir, err := m.path(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+
+	for _, file := range files {
+		if filepath.Ext(file.Name()) == ".email" {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".email"))
+		}
+	}
+
+	return ids, nil
+}
+
+func (m fileMailbox) Read(folder string, id string) (EMail, error) {
+	var email EMail
+
+	path, err := m.file(folder, id, ".email")
+	if err != nil {
+		return email, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return email, err
+	}
+
+	err = json.Unmarshal(data, &email)
+
+	return email, err
+}
+
+func (m fileMailbox) Write(folder string, email EMail) error {
+	path, err := m.file(folder, email.UUID.String(), ".email")
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if found, err := inOtherFolder(m, folder, email.UUID.String()); err != nil {
+			return err
+		} else if found {
+			return errEmailExists
+		}
+	}
+
+	emailJSON, err := json.Marshal(email)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, emailJSON)
+}
+
+func (m fileMailbox) Remove(folder string, id string) error {
+	path, err := m.file(folder, id, ".email")
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	// Drop the flags along with the email
+	if path, err = m.file(folder, id, ".flags"); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (m fileMailbox) Move(from string, to string, id string) error {
+	for _, ext := range []string{".email", ".flags"} {
+		src, err := m.file(from, id, ext)
+		if err != nil {
+			return err
+		}
+
+		dst, err := m.file(to, id, ext)
+		if err != nil {
+			return err
+		}
+
+		// An email which was never flagged has no flags to move
+		err = os.Rename(src, dst)
+		if err != nil && (ext == ".email" || !os.IsNotExist(err)) {
+			return err
+		}
+
+		// The modification time records when the email arrived in the
+		// folder, so that it can be purged from the Trash later on
+		if ext == ".email" {
+			now := time.Now()
+			if err := os.Chtimes(dst, now, now); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m fileMailbox) ModTime(folder string, id string) (time.Time, error) {
+	path, err := m.file(folder, id, ".email")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+func (m fileMailbox) ReadFlags(folder string, id string) (Flags, error) {
+	var flags Flags
+
+	path, err := m.file(folder, id, ".flags")
+	if err != nil {
+		return flags, err
+	}
+
+	// An email which was never flagged has all its flags cleared
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return flags, nil
+	} else if err != nil {
+		return flags, err
+	}
+
+	err = json.Unmarshal(data, &flags)
+
+	return flags, err
+}
+
+func (m fileMailbox) WriteFlags(folder string, id string, flags Flags) error {
+	path, err := m.file(folder, id, ".flags")
+	if err != nil {
+		return err
+	}
+
+	flagsJSON, err := json.Marshal(flags)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, flagsJSON)
+}
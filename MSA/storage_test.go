@@ -0,0 +1,563 @@
+/*
+storage_test.go checks every storage behaves the way the MSA expects from a
+Mailbox. Each check is given a new empty mailbox, and fails with the first
+difference it finds
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// storages are the storages every check is run on
+var storages = []string{"files", "maildir", "bolt"}
+
+// conformanceChecks are the checks every storage must pass
+var conformanceChecks = []struct {
+	name  string
+	check func(Mailbox) error
+}{
+	{"system folders", checkSystemFolders},
+	{"write and read", checkWriteRead},
+	{"rewrite", checkRewrite},
+	{"flags", checkFlags},
+	{"move", checkMove},
+	{"write to another folder", checkWriteElsewhere},
+	{"send time", checkSendAt},
+	{"remove", checkRemove},
+	{"user folders", checkUserFolders},
+	{"missing emails and folders", checkMissing},
+}
+
+func TestStorageConformance(t *testing.T) {
+	for _, storage := range storages {
+		for _, conformance := range conformanceChecks {
+			storage, conformance := storage, conformance
+
+			t.Run(storage+"/"+conformance.name, func(t *testing.T) {
+				m, err := newMailbox(storage, t.TempDir())
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if closer, ok := m.(io.Closer); ok {
+					defer closer.Close()
+				}
+
+				if err := m.Init(); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := conformance.check(m); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+// testEmail builds an email using every field a storage has to keep
+func testEmail(subject string) EMail {
+	return EMail{
+		UUID:       uuid.New(),
+		MessageID:  "<" + uuid.New().String() + "@here.com>",
+		InReplyTo:  "<parent@there.com>",
+		References: []string{"<root@there.com>", "<parent@there.com>"},
+		From:       "billgates@here.com",
+		To:         "stevejobs@there.com",
+		Subject:    subject,
+		Body:       "Hello,\nThis is a test with some accents: é à ü\n",
+		HTML:       "<p>Hello, this is a test</p>\n",
+		Attachments: []Attachment{{
+			ID:          "1",
+			Filename:    "test.bin",
+			ContentType: "application/octet-stream",
+			Size:        4,
+			Data:        []byte{0, 1, 2, 250},
+		}},
+		Date:    time.Date(2020, 2, 12, 10, 30, 0, 0, time.UTC),
+		Headers: map[string]string{"X-Test": "conformance"},
+		Received: []string{
+			"from 192.168.1.5 by there.com with HTTP id <parent@there.com>; Wed, 12 Feb 2020 10:30:02 +0000",
+			"from billgates@here.com by here.com with HTTP id <parent@there.com>; Wed, 12 Feb 2020 10:30:01 +0000",
+		},
+	}
+}
+
+// sameEmail compares an email read from a storage with the one written. A
+// storage may change how an attachment is encoded, but not its content
+func sameEmail(got EMail, want EMail) error {
+	switch {
+	case got.UUID != want.UUID:
+		return fmt.Errorf("UUID: got %s, want %s", got.UUID, want.UUID)
+	case got.MessageID != want.MessageID || got.InReplyTo != want.InReplyTo ||
+		!reflect.DeepEqual(got.References, want.References):
+		return fmt.Errorf("threading: got %q %q %q", got.MessageID,
+			got.InReplyTo, got.References)
+	case !reflect.DeepEqual(got.Received, want.Received):
+		return fmt.Errorf("trace: got %q", got.Received)
+	case got.From != want.From || got.To != want.To:
+		return fmt.Errorf("addresses: got %q to %q", got.From, got.To)
+	case got.Subject != want.Subject:
+		return fmt.Errorf("subject: got %q", got.Subject)
+	case got.Body != want.Body || got.HTML != want.HTML:
+		return fmt.Errorf("body: got %q and %q", got.Body, got.HTML)
+	case !got.Date.Equal(want.Date):
+		return fmt.Errorf("date: got %s, want %s", got.Date, want.Date)
+	case !got.SendAt.Equal(want.SendAt):
+		return fmt.Errorf("send time: got %s, want %s", got.SendAt, want.SendAt)
+	case !reflect.DeepEqual(got.Headers, want.Headers):
+		return fmt.Errorf("headers: got %v", got.Headers)
+	case len(got.Attachments) != len(want.Attachments):
+		return fmt.Errorf("attachments: got %d", len(got.Attachments))
+	}
+
+	for i, attachment := range got.Attachments {
+		expected := want.Attachments[i]
+
+		if attachment.Filename != expected.Filename ||
+			attachment.ContentType != expected.ContentType ||
+			!reflect.DeepEqual(attachment.Data, expected.Data) {
+			return fmt.Errorf("attachment %d: got %q %q %v", i,
+				attachment.Filename, attachment.ContentType, attachment.Data)
+		}
+	}
+
+	return nil
+}
+
+// expectIDs checks a folder holds exactly the given emails
+func expectIDs(m Mailbox, folder string, want ...string) error {
+	ids, err := m.IDs(folder)
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]bool)
+	for _, id := range ids {
+		found[id] = true
+	}
+
+	if len(ids) != len(want) || len(found) != len(want) {
+		return fmt.Errorf("%s: got %v, want %v", folder, ids, want)
+	}
+
+	for _, id := range want {
+		if !found[id] {
+			return fmt.Errorf("%s: got %v, want %v", folder, ids, want)
+		}
+	}
+
+	return nil
+}
+
+// expectNotExist checks an error tells something doesn't exist
+func expectNotExist(err error, what string) error {
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("%s: got %v, want a missing file error", what, err)
+	}
+
+	return nil
+}
+
+func checkSystemFolders(m Mailbox) error {
+	for _, folder := range systemFolders {
+		if err := m.CheckFolder(folder); err != nil {
+			return err
+		}
+		if err := expectIDs(m, folder); err != nil {
+			return err
+		}
+	}
+
+	// Initialising an existing mailbox must keep it as it is
+	email := testEmail("init")
+	if err := m.Write(INBOX, email); err != nil {
+		return err
+	}
+	if err := m.Init(); err != nil {
+		return err
+	}
+
+	return expectIDs(m, INBOX, email.UUID.String())
+}
+
+func checkWriteRead(m Mailbox) error {
+	email := testEmail("write and read")
+
+	if err := m.Write(INBOX, email); err != nil {
+		return err
+	}
+
+	if err := expectIDs(m, INBOX, email.UUID.String()); err != nil {
+		return err
+	}
+
+	got, err := m.Read(INBOX, email.UUID.String())
+	if err != nil {
+		return err
+	}
+
+	if err := sameEmail(got, email); err != nil {
+		return err
+	}
+
+	flags, err := m.ReadFlags(INBOX, email.UUID.String())
+	if err != nil {
+		return err
+	} else if !reflect.DeepEqual(flags, Flags{}) {
+		return fmt.Errorf("a new email has flags %+v", flags)
+	}
+
+	return nil
+}
+
+func checkRewrite(m Mailbox) error {
+	email := testEmail("rewrite")
+	id := email.UUID.String()
+	flags := Flags{Seen: true, Draft: true}
+
+	if err := m.Write(DRAFTS, email); err != nil {
+		return err
+	}
+	if err := m.WriteFlags(DRAFTS, id, flags); err != nil {
+		return err
+	}
+
+	email.Subject = "rewritten"
+	if err := m.Write(DRAFTS, email); err != nil {
+		return err
+	}
+
+	if err := expectIDs(m, DRAFTS, id); err != nil {
+		return err
+	}
+
+	got, err := m.Read(DRAFTS, id)
+	if err != nil {
+		return err
+	} else if err := sameEmail(got, email); err != nil {
+		return err
+	}
+
+	kept, err := m.ReadFlags(DRAFTS, id)
+	if err != nil {
+		return err
+	} else if !reflect.DeepEqual(kept, flags) {
+		return fmt.Errorf("rewriting changed the flags to %+v", kept)
+	}
+
+	return nil
+}
+
+func checkFlags(m Mailbox) error {
+	email := testEmail("flags")
+	id := email.UUID.String()
+
+	if err := m.Write(INBOX, email); err != nil {
+		return err
+	}
+
+	for _, flags := range []Flags{
+		{Seen: true},
+		{Seen: true, Flagged: true, Answered: true, Keywords: []string{"work"}},
+		{Draft: true, Keywords: []string{"work", "$Forwarded", "two words"}},
+		{},
+	} {
+		if err := m.WriteFlags(INBOX, id, flags); err != nil {
+			return err
+		}
+
+		got, err := m.ReadFlags(INBOX, id)
+		if err != nil {
+			return err
+		}
+
+		// Keywords may come back in any order
+		found := make(map[string]bool)
+		for _, keyword := range got.Keywords {
+			found[keyword] = true
+		}
+
+		same := len(got.Keywords) == len(flags.Keywords)
+		for _, keyword := range flags.Keywords {
+			same = same && found[keyword]
+		}
+
+		got.Keywords, flags.Keywords = nil, nil
+
+		if !same || !reflect.DeepEqual(got, flags) {
+			return fmt.Errorf("wrote flags %+v, read %+v", flags, got)
+		}
+	}
+
+	return nil
+}
+
+func checkMove(m Mailbox) error {
+	email := testEmail("move")
+	id := email.UUID.String()
+	flags := Flags{Seen: true, Keywords: []string{"moved"}}
+
+	if err := m.Write(INBOX, email); err != nil {
+		return err
+	}
+	if err := m.WriteFlags(INBOX, id, flags); err != nil {
+		return err
+	}
+
+	before := time.Now().Add(-time.Second)
+
+	if err := m.Move(INBOX, TRASH, id); err != nil {
+		return err
+	}
+
+	if err := expectIDs(m, INBOX); err != nil {
+		return err
+	}
+	if err := expectIDs(m, TRASH, id); err != nil {
+		return err
+	}
+
+	got, err := m.Read(TRASH, id)
+	if err != nil {
+		return err
+	} else if err := sameEmail(got, email); err != nil {
+		return err
+	}
+
+	moved, err := m.ReadFlags(TRASH, id)
+	if err != nil {
+		return err
+	} else if !reflect.DeepEqual(moved, flags) {
+		return fmt.Errorf("moving changed the flags to %+v", moved)
+	}
+
+	// The Trash is purged from the time the emails were moved to it
+	modTime, err := m.ModTime(TRASH, id)
+	if err != nil {
+		return err
+	} else if modTime.Before(before) {
+		return fmt.Errorf("moving kept the modification time %s", modTime)
+	}
+
+	return expectNotExist(m.Move(INBOX, TRASH, id), "moving a moved email")
+}
+
+func checkWriteElsewhere(m Mailbox) error {
+	email := testEmail("write to another folder")
+	id := email.UUID.String()
+
+	if err := m.Write(INBOX, email); err != nil {
+		return err
+	}
+
+	if err := m.Write(TRASH, email); err != errEmailExists {
+		return fmt.Errorf("writing an email of another folder: got %v", err)
+	}
+
+	if err := expectIDs(m, INBOX, id); err != nil {
+		return err
+	}
+
+	return expectIDs(m, TRASH)
+}
+
+func checkSendAt(m Mailbox) error {
+	scheduled := testEmail("scheduled")
+	scheduled.SendAt = time.Date(2099, 1, 1, 8, 0, 0, 123456789,
+		time.FixedZone("CET", 3600))
+	id := scheduled.UUID.String()
+
+	now := testEmail("not scheduled")
+
+	for _, email := range []EMail{scheduled, now} {
+		if err := m.Write(OUTBOX, email); err != nil {
+			return err
+		}
+
+		got, err := m.Read(OUTBOX, email.UUID.String())
+		if err != nil {
+			return err
+		} else if err := sameEmail(got, email); err != nil {
+			return err
+		}
+	}
+
+	// The send time stays with the email when it goes back to the drafts
+	if err := m.Move(OUTBOX, DRAFTS, id); err != nil {
+		return err
+	}
+
+	got, err := m.Read(DRAFTS, id)
+	if err != nil {
+		return err
+	}
+
+	return sameEmail(got, scheduled)
+}
+
+func checkRemove(m Mailbox) error {
+	email := testEmail("remove")
+	id := email.UUID.String()
+
+	if err := m.Write(INBOX, email); err != nil {
+		return err
+	}
+	if err := m.WriteFlags(INBOX, id, Flags{Seen: true}); err != nil {
+		return err
+	}
+	if err := m.Remove(INBOX, id); err != nil {
+		return err
+	}
+
+	if err := expectIDs(m, INBOX); err != nil {
+		return err
+	}
+
+	_, err := m.Read(INBOX, id)
+	if err := expectNotExist(err, "reading a removed email"); err != nil {
+		return err
+	}
+
+	// Writing the email again must not bring its flags back
+	if err := m.Write(INBOX, email); err != nil {
+		return err
+	}
+
+	flags, err := m.ReadFlags(INBOX, id)
+	if err != nil {
+		return err
+	} else if !reflect.DeepEqual(flags, Flags{}) {
+		return fmt.Errorf("a removed email kept its flags %+v", flags)
+	}
+
+	return nil
+}
+
+func checkUserFolders(m Mailbox) error {
+	if err := m.CreateFolder("Work"); err != nil {
+		return err
+	}
+	if err := m.CreateFolder("Work"); err != errFolderExists {
+		return fmt.Errorf("creating an existing folder: got %v", err)
+	}
+	if err := m.CreateFolder(".hidden"); err != errInvalidFolder {
+		return fmt.Errorf("creating an invalid folder: got %v", err)
+	}
+	if err := m.CreateFolder("Personal"); err != nil {
+		return err
+	}
+
+	folders, err := m.Folders()
+	if err != nil {
+		return err
+	} else if len(folders) != 2 {
+		return fmt.Errorf("folders: got %v", folders)
+	}
+
+	email := testEmail("user folders")
+	id := email.UUID.String()
+
+	if err := m.Write("Work", email); err != nil {
+		return err
+	}
+	if err := m.WriteFlags("Work", id, Flags{Flagged: true}); err != nil {
+		return err
+	}
+
+	if err := m.RenameFolder("Work", "Personal"); err != errFolderExists {
+		return fmt.Errorf("renaming over a folder: got %v", err)
+	}
+	if err := m.RenameFolder("Work", "Job"); err != nil {
+		return err
+	}
+
+	if err := expectNotExist(m.CheckFolder("Work"), "renamed folder"); err != nil {
+		return err
+	}
+	if err := expectIDs(m, "Job", id); err != nil {
+		return err
+	}
+
+	flags, err := m.ReadFlags("Job", id)
+	if err != nil {
+		return err
+	} else if !flags.Flagged {
+		return fmt.Errorf("renaming changed the flags to %+v", flags)
+	}
+
+	if err := m.DeleteFolder("Job"); err != nil {
+		return err
+	}
+
+	if err := expectNotExist(m.CheckFolder("Job"), "deleted folder"); err != nil {
+		return err
+	}
+
+	folders, err = m.Folders()
+	if err != nil {
+		return err
+	} else if !reflect.DeepEqual(folders, []string{"Personal"}) {
+		return fmt.Errorf("folders after deleting one: got %v", folders)
+	}
+
+	// The emails of a deleted folder don't come back with a folder of the
+	// same name
+	if err := m.CreateFolder("Job"); err != nil {
+		return err
+	}
+
+	return expectIDs(m, "Job")
+}
+
+func checkMissing(m Mailbox) error {
+	email := testEmail("missing")
+	id := email.UUID.String()
+
+	if err := m.Write(INBOX, email); err != nil {
+		return err
+	}
+
+	_, err := m.Read(SENT, id)
+	if err := expectNotExist(err, "reading from the wrong folder"); err != nil {
+		return err
+	}
+
+	_, err = m.Read(INBOX, uuid.New().String())
+	if err := expectNotExist(err, "reading a missing email"); err != nil {
+		return err
+	}
+
+	_, err = m.Read(INBOX, "../"+id)
+	if err := expectNotExist(err, "reading outside the folder"); err != nil {
+		return err
+	}
+
+	_, err = m.IDs("Missing")
+	if err := expectNotExist(err, "listing a missing folder"); err != nil {
+		return err
+	}
+
+	if err := m.Write("Missing", email); err == nil {
+		return fmt.Errorf("writing to a missing folder succeeded")
+	}
+
+	if err := expectNotExist(m.Remove(SENT, id), "removing from the wrong folder"); err != nil {
+		return err
+	}
+
+	if err := m.Move(INBOX, "Missing", id); err == nil {
+		return fmt.Errorf("moving to a missing folder succeeded")
+	}
+
+	return expectIDs(m, INBOX, id)
+}
@@ -0,0 +1,445 @@
+/*
+threads.go handles grouping the emails of the mailbox into conversations
+Threads are built with Jamie Zawinski's algorithm, from the Message-ID,
+In-Reply-To and References of each email: emails are linked to the emails
+they reply to, even when those are missing from the mailbox, then the
+conversations left apart are grouped together by subject
+The Trash and the Drafts aren't part of any conversation
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// ThreadSummary struct describing a conversation, identified by the UUID of
+// its first email
+type ThreadSummary struct {
+	ID           string
+	Subject      string
+	Count        int
+	Unread       int
+	Participants []string
+	LastDate     time.Time
+}
+
+// ThreadMessage struct representing an email of a conversation, with the
+// folder it is in and its depth in the tree of replies
+type ThreadMessage struct {
+	Message
+	Folder string
+	Depth  int
+}
+
+// Thread struct representing a conversation with its emails in order
+type Thread struct {
+	ThreadSummary
+	Messages []ThreadMessage
+}
+
+// container is a node of the tree of replies. A container without an email
+// stands for an email which is referenced but isn't in the mailbox
+type container struct {
+	id       string
+	doc      *IndexedDoc
+	parent   *container
+	children []*container
+}
+
+// newMessageID creates the Message-ID of an email sent by this MSA
+func newMessageID(id uuid.UUID) string {
+	domain := self.Name
+	if at := strings.LastIndex(domain, "@"); at >= 0 {
+		domain = domain[at+1:]
+	}
+
+	return "<" + id.String() + "@" + domain + ">"
+}
+
+// threadReply completes the References of a reply with the References of the
+// email it replies to, when that email is in the mailbox
+func threadReply(email *EMail) {
+	if email.InReplyTo == "" || len(email.References) > 0 {
+		return
+	}
+
+	email.References = []string{email.InReplyTo}
+
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	for _, doc := range index.Docs {
+		if doc.MessageID == email.InReplyTo {
+			email.References = append(append([]string{}, doc.References...),
+				email.InReplyTo)
+			return
+		}
+	}
+}
+
+// normalizeSubject strips the reply and forward prefixes from a subject
+func normalizeSubject(subject string) string {
+	subject = strings.TrimSpace(subject)
+
+	for {
+		lower := strings.ToLower(subject)
+		trimmed := false
+
+		for _, prefix := range []string{"re:", "fwd:", "fw:"} {
+			if strings.HasPrefix(lower, prefix) {
+				subject = strings.TrimSpace(subject[len(prefix):])
+				trimmed = true
+			}
+		}
+
+		if !trimmed {
+			return subject
+		}
+	}
+}
+
+// isReply tells whether the subject of an email starts like a reply
+func isReply(doc *IndexedDoc) bool {
+	return doc != nil && normalizeSubject(doc.Subject) != strings.TrimSpace(doc.Subject)
+}
+
+// reachable tells whether a container is the same as, or a descendant of,
+// another one
+func (c *container) reachable(ancestor *container) bool {
+	for ; c != nil; c = c.parent {
+		if c == ancestor {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unlink detaches a container from its parent
+func (c *container) unlink() {
+	if c.parent == nil {
+		return
+	}
+
+	siblings := c.parent.children
+	for i, sibling := range siblings {
+		if sibling == c {
+			c.parent.children = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+
+	c.parent = nil
+}
+
+// adopt makes a container a child of this one, unless it would create a loop
+func (c *container) adopt(child *container) {
+	if c.reachable(child) {
+		return
+	}
+
+	child.unlink()
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+// first returns the email of a container, or of its first descendant with one
+func (c *container) first() *IndexedDoc {
+	if c.doc != nil {
+		return c.doc
+	}
+
+	for _, child := range c.children {
+		if doc := child.first(); doc != nil {
+			return doc
+		}
+	}
+
+	return nil
+}
+
+// date returns the date a container is sorted by
+func (c *container) date() time.Time {
+	if doc := c.first(); doc != nil {
+		return doc.Date
+	}
+
+	return time.Time{}
+}
+
+// sortChildren orders the replies of each container chronologically
+func (c *container) sortChildren() {
+	sort.Slice(c.children, func(i, j int) bool {
+		return c.children[i].date().Before(c.children[j].date())
+	})
+
+	for _, child := range c.children {
+		child.sortChildren()
+	}
+}
+
+// prune drops the containers without an email, promoting their replies
+// At the root, a container without an email is only dropped when it has at
+// most one reply, otherwise it is what holds the conversation together
+func prune(children []*container, root bool) []*container {
+	var pruned []*container
+
+	for _, child := range children {
+		child.children = prune(child.children, false)
+
+		if child.doc != nil || (root && len(child.children) > 1) {
+			pruned = append(pruned, child)
+			continue
+		}
+
+		for _, grandchild := range child.children {
+			grandchild.parent = child.parent
+			pruned = append(pruned, grandchild)
+		}
+	}
+
+	return pruned
+}
+
+// buildThreads groups emails into conversations, and returns the root of each
+func buildThreads(docs map[string]*IndexedDoc) []*container {
+	table := make(map[string]*container)
+
+	// lookup finds the container of a Message-ID, creating it if needed
+	lookup := func(key string) *container {
+		c, ok := table[key]
+		if !ok {
+			c = &container{}
+			table[key] = c
+		}
+
+		return c
+	}
+
+	for id, doc := range docs {
+		if doc.Folder == TRASH || doc.Folder == DRAFTS {
+			continue
+		}
+
+		// An email without Message-ID, or a copy of an email already seen,
+		// can't be replied to and gets a container of its own
+		key := doc.MessageID
+		if key == "" || (table[key] != nil && table[key].doc != nil) {
+			key = id
+		}
+
+		c := lookup(key)
+		c.id, c.doc = id, doc
+
+		references := doc.References
+		if doc.InReplyTo != "" && (len(references) == 0 ||
+			references[len(references)-1] != doc.InReplyTo) {
+			references = append(append([]string{}, references...), doc.InReplyTo)
+		}
+
+		// Link each reference to the next one, unless it's already linked
+		var parent *container
+		for _, reference := range references {
+			ref := lookup(reference)
+
+			if parent != nil && ref.parent == nil {
+				parent.adopt(ref)
+			}
+
+			parent = ref
+		}
+
+		if parent != nil && parent != c {
+			parent.adopt(c)
+		}
+	}
+
+	var roots []*container
+	for _, c := range table {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+
+	roots = prune(roots, true)
+
+	// Group the conversations left apart by subject, the original email of a
+	// conversation taking precedence over the replies
+	bySubject := make(map[string]*container)
+	var grouped []*container
+
+	for _, root := range roots {
+		subject := strings.ToLower(normalizeSubject(root.first().Subject))
+
+		other, ok := bySubject[subject]
+		if subject == "" || !ok {
+			bySubject[subject] = root
+			grouped = append(grouped, root)
+			continue
+		}
+
+		if isReply(other.doc) && !isReply(root.doc) {
+			root.adopt(other)
+			bySubject[subject] = root
+
+			for i := range grouped {
+				if grouped[i] == other {
+					grouped[i] = root
+				}
+			}
+		} else {
+			other.adopt(root)
+		}
+	}
+
+	for _, root := range grouped {
+		root.sortChildren()
+	}
+
+	return grouped
+}
+
+// flatten lists the emails of a conversation, each email being followed by
+// its replies
+func (c *container) flatten(depth int) []ThreadMessage {
+	var messages []ThreadMessage
+
+	if c.doc != nil {
+		messages = append(messages, ThreadMessage{
+			Message: Message{EMail: EMail{UUID: uuid.MustParse(c.id)}},
+			Folder:  c.doc.Folder,
+			Depth:   depth,
+		})
+		depth++
+	}
+
+	for _, child := range c.children {
+		messages = append(messages, child.flatten(depth)...)
+	}
+
+	return messages
+}
+
+// summarize describes the conversation starting at a root container
+func summarize(root *container, docs map[string]*IndexedDoc) ThreadSummary {
+	var summary ThreadSummary
+
+	seen := make(map[string]bool)
+	var earliest time.Time
+
+	for _, message := range root.flatten(0) {
+		id := message.UUID.String()
+		doc := docs[id]
+
+		if summary.ID == "" || doc.Date.Before(earliest) {
+			summary.ID, earliest = id, doc.Date
+		}
+
+		if doc.Date.After(summary.LastDate) {
+			summary.LastDate = doc.Date
+		}
+
+		if !doc.Flags.Seen {
+			summary.Unread++
+		}
+
+		if !seen[doc.From] {
+			seen[doc.From] = true
+			summary.Participants = append(summary.Participants, doc.From)
+		}
+
+		summary.Count++
+	}
+
+	summary.Subject = normalizeSubject(root.first().Subject)
+
+	return summary
+}
+
+// snapshotDocs copies the emails of the index, so that threads can be built
+// without holding the lock of the index
+func snapshotDocs() map[string]*IndexedDoc {
+	index.mutex.RLock()
+	defer index.mutex.RUnlock()
+
+	docs := make(map[string]*IndexedDoc, len(index.Docs))
+	for id, doc := range index.Docs {
+		copied := *doc
+		docs[id] = &copied
+	}
+
+	return docs
+}
+
+// MSAListThreads gets called from the handleRequests method
+// It lists the conversations of the mailbox, the most recent one first
+func MSAListThreads(w http.ResponseWriter, r *http.Request) {
+	docs := snapshotDocs()
+
+	threads := []ThreadSummary{}
+	for _, root := range buildThreads(docs) {
+		threads = append(threads, summarize(root, docs))
+	}
+
+	sort.Slice(threads, func(i, j int) bool {
+		return threads[i].LastDate.After(threads[j].LastDate)
+	})
+
+	threadsJSON, err := json.Marshal(threads)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(threadsJSON)
+}
+
+// MSAReadThread gets called from the handleRequests method
+// It reads all the emails of a conversation, each one followed by its replies
+func MSAReadThread(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	docs := snapshotDocs()
+
+	for _, root := range buildThreads(docs) {
+		summary := summarize(root, docs)
+		if summary.ID != id {
+			continue
+		}
+
+		thread := Thread{ThreadSummary: summary}
+
+		for _, message := range root.flatten(0) {
+			full, err := readMessage(message.Folder, message.UUID.String())
+			if err != nil {
+				// The email was removed since the threads were built, skip it
+				log.Print(err.Error())
+				continue
+			}
+
+			message.Message = full
+			thread.Messages = append(thread.Messages, message)
+		}
+
+		threadJSON, err := json.Marshal(thread)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		w.Write(threadJSON)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
@@ -14,18 +14,57 @@ import (
 )
 
 // INBOX is global variable to reference INBOX
-const INBOX = 0
+const INBOX = "Inbox"
 
 // OUTBOX is a global variable to reference OUTBOX
-const OUTBOX = 1
+const OUTBOX = "Outbox"
 
-// EMail struct representing an email
+// SENT is a global variable to reference the folder of delivered emails
+const SENT = "Sent"
+
+// DRAFTS is a global variable to reference the folder of unsent drafts
+const DRAFTS = "Drafts"
+
+// TRASH is a global variable to reference the folder of deleted emails
+const TRASH = "Trash"
+
+// FOLDERS is the directory holding the folders created by the user
+const FOLDERS = "Folders"
+
+// EMail struct representing an email. The MessageID identifies the email
+// across all the mailboxes, InReplyTo and References list the Message-IDs of
+// the emails it replies to, the closest one last
+// The Body is the text/plain version of the email, HTML its text/html
+// alternative if there is one. Headers holds any other header of the email
+// Received is the trace of the MTAs the email went through, the latest first
+// An email of an outbox isn't sent before its SendAt time
 type EMail struct {
-	UUID    uuid.UUID
-	From    string
-	To      string
-	Subject string
-	Body    string
+	UUID        uuid.UUID
+	MessageID   string   `json:",omitempty"`
+	InReplyTo   string   `json:",omitempty"`
+	References  []string `json:",omitempty"`
+	From        string
+	To          string
+	Subject     string
+	Body        string
+	HTML        string       `json:",omitempty"`
+	Attachments []Attachment `json:",omitempty"`
+	Date        time.Time
+	SendAt      time.Time
+	Headers     map[string]string `json:",omitempty"`
+	Received    []string          `json:",omitempty"`
+}
+
+// Attachment struct representing a file attached to an email. The content is
+// carried base64 encoded in the JSON of the email, the TransferEncoding is
+// the one used when the email is written in the MIME format
+type Attachment struct {
+	ID               string
+	Filename         string
+	ContentType      string
+	TransferEncoding string
+	Size             int
+	Data             []byte `json:",omitempty"`
 }
 
 // Server struct representing an MTA server
@@ -34,9 +73,14 @@ type Server struct {
 	Address string
 }
 
-// Folder struct representing a folder of email (inbox or outbox)
+// Folder struct representing a page of a folder of email, with the number of
+// emails matching the listing, the number of emails which haven't been seen
+// yet, and the cursor to the next page
 type Folder struct {
-	Emails []EMail
+	Emails []Message
+	Total  int
+	Unread int
+	Next   string `json:",omitempty"`
 }
 
 // This MSA
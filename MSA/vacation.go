@@ -0,0 +1,409 @@
+/*
+vacation.go handles the automatic replies sent on behalf of the user, either
+by the vacation action of a Sieve script or by the out-of-office settings
+The settings reply to the emails received between their start and end dates
+A reply is only sent to a given sender once every few days, and never to
+emails which were sent automatically, came from a mailing list, bounced, or
+weren't addressed to the user, so that two responders can't answer each other
+forever (RFC 3834)
+The settings and the senders already answered are kept in the SETTINGS
+directory
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultVacationDays is the number of days between two replies to a sender
+const defaultVacationDays = 7
+
+// VacationReply struct representing an automatic reply. Addresses are the
+// other addresses of the user, and Handle tells apart the replies whose
+// senders are tracked separately
+type VacationReply struct {
+	Days      int
+	Subject   string   `json:",omitempty"`
+	From      string   `json:",omitempty"`
+	Addresses []string `json:",omitempty"`
+	Handle    string   `json:",omitempty"`
+	Reason    string
+}
+
+// settingsHandle tells apart the senders replied to by the settings from
+// those replied to by a Sieve script
+const settingsHandle = "settings"
+
+var errBadVacation = errors.New("invalid vacation settings")
+
+// Vacation struct representing the out-of-office settings. Without a Start or
+// an End, the replies start now or never stop
+type Vacation struct {
+	Enabled   bool
+	Subject   string `json:",omitempty"`
+	Body      string
+	Start     time.Time
+	End       time.Time
+	Days      int
+	Addresses []string `json:",omitempty"`
+}
+
+// vacation holds the out-of-office settings
+var vacation struct {
+	settings Vacation
+	mutex    sync.RWMutex
+}
+
+// replied holds when each sender was last replied to, by handle
+var replied struct {
+	senders map[string]time.Time
+	mutex   sync.Mutex
+}
+
+// vacationPath returns the path of the file holding the out-of-office settings
+func vacationPath() string {
+	return filepath.Join(SETTINGS, "vacation.json")
+}
+
+// repliedPath returns the path of the file holding the senders replied to
+func repliedPath() string {
+	return filepath.Join(SETTINGS, "replied.json")
+}
+
+// migrateReplied moves the senders replied to out of vacation.json, where
+// they were kept before there were out-of-office settings, to replied.json.
+// Settings never parse as a map of dates
+func migrateReplied() {
+	var senders map[string]time.Time
+
+	data, err := ioutil.ReadFile(vacationPath())
+	if err != nil || json.Unmarshal(data, &senders) != nil {
+		return
+	}
+
+	if _, err := os.Stat(repliedPath()); err == nil {
+		err = os.Remove(vacationPath())
+	} else {
+		err = os.Rename(vacationPath(), repliedPath())
+	}
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Moved the senders replied to from vacation.json to replied.json")
+}
+
+// loadVacation reads the out-of-office settings saved on disk, if any
+func loadVacation() {
+	migrateReplied()
+
+	settings := Vacation{Days: defaultVacationDays}
+
+	data, err := ioutil.ReadFile(vacationPath())
+	if err == nil {
+		err = json.Unmarshal(data, &settings)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	vacation.mutex.Lock()
+	vacation.settings = settings
+	vacation.mutex.Unlock()
+}
+
+// validate checks the out-of-office settings can be used
+func (settings *Vacation) validate() error {
+	if settings.Days == 0 {
+		settings.Days = defaultVacationDays
+	}
+
+	if settings.Days < 0 || (settings.Enabled && strings.TrimSpace(settings.Body) == "") {
+		return errBadVacation
+	} else if !settings.Start.IsZero() && !settings.End.IsZero() &&
+		settings.End.Before(settings.Start) {
+		return errBadVacation
+	}
+
+	return nil
+}
+
+// vacationReply returns the reply of the out-of-office settings, if they are
+// enabled at the given time
+func vacationReply(now time.Time) (VacationReply, bool) {
+	vacation.mutex.RLock()
+	settings := vacation.settings
+	vacation.mutex.RUnlock()
+
+	if !settings.Enabled || (!settings.Start.IsZero() && now.Before(settings.Start)) ||
+		(!settings.End.IsZero() && now.After(settings.End)) {
+		return VacationReply{}, false
+	}
+
+	return VacationReply{
+		Days:      settings.Days,
+		Subject:   settings.Subject,
+		Addresses: settings.Addresses,
+		Handle:    settingsHandle,
+		Reason:    settings.Body,
+	}, true
+}
+
+// automaticSenders are the prefixes and suffixes of the local parts of the
+// addresses which never read replies
+var automaticSenders = []string{"mailer-daemon", "owner-", "-request",
+	"noreply", "no-reply", "postmaster"}
+
+// isAutomatic tells whether an email was sent automatically or to a list,
+// in which case it mustn't be replied to
+func isAutomatic(email EMail) bool {
+	if auto := emailHeader(email, "Auto-Submitted"); auto != nil &&
+		!strings.EqualFold(auto[0], "no") {
+		return true
+	}
+
+	if precedence := emailHeader(email, "Precedence"); precedence != nil {
+		switch strings.ToLower(precedence[0]) {
+		case "bulk", "list", "junk":
+			return true
+		}
+	}
+
+	for header, value := range email.Headers {
+		if strings.HasPrefix(strings.ToLower(header), "list-") {
+			return true
+		}
+
+		// Bounces have an empty return path
+		if strings.EqualFold(header, "Return-Path") && strings.TrimSpace(value) == "<>" {
+			return true
+		}
+	}
+
+	senders := parseAddressList(email.From)
+	if len(senders) == 0 {
+		return true
+	}
+
+	local := strings.ToLower(addressPart(senders[0], ":localpart"))
+	for _, automatic := range automaticSenders {
+		if strings.HasPrefix(local, automatic) || strings.HasSuffix(local, automatic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addressedTo tells whether one of the addresses is among the recipients of
+// an email
+func addressedTo(email EMail, addresses []string) bool {
+	recipients := parseAddressList(email.To)
+	if cc := emailHeader(email, "Cc"); cc != nil {
+		recipients = append(recipients, parseAddressList(cc[0])...)
+	}
+
+	for _, recipient := range recipients {
+		for _, address := range addresses {
+			if strings.EqualFold(recipient, address) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// shouldReply tells whether the sender wasn't replied to in the last days,
+// and remembers the reply if so
+func shouldReply(sender string, handle string, days int) bool {
+	replied.mutex.Lock()
+	defer replied.mutex.Unlock()
+
+	if replied.senders == nil {
+		replied.senders = make(map[string]time.Time)
+
+		data, err := ioutil.ReadFile(repliedPath())
+		if err == nil {
+			err = json.Unmarshal(data, &replied.senders)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Print(err.Error())
+		}
+	}
+
+	if days < 1 {
+		days = 1
+	}
+
+	key := handle + "\x00" + strings.ToLower(sender)
+	now := time.Now()
+
+	if last, ok := replied.senders[key]; ok && now.Sub(last) < time.Duration(days)*24*time.Hour {
+		return false
+	}
+
+	replied.senders[key] = now
+
+	// Forget the senders which could be replied to again anyway
+	for key, last := range replied.senders {
+		if now.Sub(last) > 365*24*time.Hour {
+			delete(replied.senders, key)
+		}
+	}
+
+	data, err := json.Marshal(replied.senders)
+	if err == nil {
+		err = writeFileAtomic(repliedPath(), data)
+	}
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	return true
+}
+
+// autoReply answers an email received by the user with an automatic reply,
+// placed in the outbox for the MTA to send it
+func autoReply(email EMail, reply VacationReply) {
+	if isAutomatic(email) {
+		return
+	}
+
+	addresses := append([]string{self.Name}, reply.Addresses...)
+
+	sender := parseAddressList(email.From)[0]
+	for _, address := range addresses {
+		if strings.EqualFold(sender, address) {
+			return
+		}
+	}
+
+	if !addressedTo(email, addresses) {
+		log.Println("Not replying to an email not addressed to " + self.Name)
+		return
+	}
+
+	if !shouldReply(sender, reply.Handle+reply.Reason, reply.Days) {
+		return
+	}
+
+	subject := reply.Subject
+	if subject == "" {
+		subject = "Auto: " + email.Subject
+	}
+
+	from := reply.From
+	if from == "" {
+		from = self.Name
+	}
+
+	answer := EMail{
+		InReplyTo: email.MessageID,
+		From:      from,
+		To:        sender,
+		Subject:   subject,
+		Body:      reply.Reason,
+		Headers:   map[string]string{"Auto-Submitted": "auto-replied"},
+	}
+
+	var err error
+	if answer.UUID, err = uuid.NewUUID(); err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	if email.MessageID != "" {
+		answer.References = append(append([]string{}, email.References...),
+			email.MessageID)
+	}
+
+	// Queued like the emails of the user, with a delivery history
+	if err := queueEmail(&answer); err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Replied automatically to " + sender)
+}
+
+// MSAReadVacation gets called from the handleRequests method
+// It sends back the out-of-office settings
+func MSAReadVacation(w http.ResponseWriter, r *http.Request) {
+	vacation.mutex.RLock()
+	settingsJSON, err := json.Marshal(vacation.settings)
+	vacation.mutex.RUnlock()
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(settingsJSON)
+}
+
+// MSAWriteVacation gets called from the handleRequests method
+// It replaces the out-of-office settings
+func MSAWriteVacation(w http.ResponseWriter, r *http.Request) {
+	var settings Vacation
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Print(err.Error())
+		return
+	}
+
+	if err := json.Unmarshal(body, &settings); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	if err := settings.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	vacation.mutex.Lock()
+	defer vacation.mutex.Unlock()
+
+	if err := writeFileAtomic(vacationPath(), settingsJSON); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	vacation.settings = settings
+
+	if settings.Enabled {
+		log.Println("Enabled the out-of-office replies")
+	} else {
+		log.Println("Disabled the out-of-office replies")
+	}
+
+	w.Write(settingsJSON)
+}
@@ -0,0 +1,318 @@
+/*
+vcard.go imports and exports the address book as vCards (RFC 6350)
+Only the properties the address book knows of are read: the name, the email
+addresses, the phone numbers, the categories, which are the groups, and the
+note. The contacts imported are merged with the contacts sharing one of
+their addresses
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// vcardLineLength is the length lines are folded at, in octets
+const vcardLineLength = 75
+
+var errBadVCard = errors.New("invalid vCard")
+
+// ImportResult struct representing what an import did to the address book
+type ImportResult struct {
+	Created int
+	Updated int
+	Skipped int
+}
+
+// vcardEscaper escapes the text values of a vCard
+var vcardEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\n", `\n`, "\r", "")
+
+// unescapeVCard reads a text value of a vCard
+func unescapeVCard(value string) string {
+	var buffer strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			buffer.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		if value[i] == 'n' || value[i] == 'N' {
+			buffer.WriteByte('\n')
+		} else {
+			buffer.WriteByte(value[i])
+		}
+	}
+
+	return buffer.String()
+}
+
+// splitVCard splits a value of a vCard on a separator which isn't escaped
+func splitVCard(value string, separator byte) []string {
+	var parts []string
+	start := 0
+
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' {
+			i++
+		} else if value[i] == separator {
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, value[start:])
+}
+
+// unfoldVCard reads the lines of vCards, joining the folded lines
+func unfoldVCard(reader io.Reader) ([]string, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 4096), maxRequestSize)
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// ParseVCards reads the contacts of vCards. The contacts have no ID yet
+func ParseVCards(reader io.Reader) ([]Contact, error) {
+	lines, err := unfoldVCard(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Contact
+	var contact *Contact
+	var structuredName string
+
+	for _, line := range lines {
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return nil, errBadVCard
+		}
+
+		// Parameters such as TYPE=work are ignored, and so are groups such as
+		// item1.EMAIL
+		name := strings.ToUpper(strings.SplitN(line[:colon], ";", 2)[0])
+		if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+			name = name[dot+1:]
+		}
+		value := line[colon+1:]
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			contact = &Contact{}
+			structuredName = ""
+
+		case contact == nil:
+			return nil, errBadVCard
+
+		case name == "END" && strings.EqualFold(value, "VCARD"):
+			if contact.Name == "" {
+				contact.Name = structuredName
+			}
+			list = append(list, *contact)
+			contact = nil
+
+		case name == "FN":
+			contact.Name = unescapeVCard(value)
+
+		case name == "N":
+			// Family; Given; Additional; Prefixes; Suffixes
+			parts := splitVCard(value, ';')
+			var names []string
+			for _, i := range []int{3, 1, 2, 0, 4} {
+				if i < len(parts) && parts[i] != "" {
+					names = append(names, unescapeVCard(parts[i]))
+				}
+			}
+			structuredName = strings.Join(names, " ")
+
+		case name == "EMAIL":
+			contact.Addresses = append(contact.Addresses, unescapeVCard(value))
+
+		case name == "TEL":
+			contact.Phones = append(contact.Phones, unescapeVCard(value))
+
+		case name == "CATEGORIES":
+			for _, group := range splitVCard(value, ',') {
+				contact.Groups = append(contact.Groups, unescapeVCard(group))
+			}
+
+		case name == "NOTE":
+			contact.Notes = unescapeVCard(value)
+		}
+	}
+
+	if contact != nil {
+		return nil, errBadVCard
+	}
+
+	return list, nil
+}
+
+// writeVCardLine writes a line of a vCard, folded
+func writeVCardLine(buffer *bytes.Buffer, line string) {
+	for len(line) > vcardLineLength {
+		// Don't fold in the middle of a UTF-8 character
+		cut := vcardLineLength
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+
+		buffer.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+
+	buffer.WriteString(line + "\r\n")
+}
+
+// FormatVCards writes contacts as vCards 4.0
+func FormatVCards(list []Contact) []byte {
+	var buffer bytes.Buffer
+
+	for _, contact := range list {
+		writeVCardLine(&buffer, "BEGIN:VCARD")
+		writeVCardLine(&buffer, "VERSION:4.0")
+		writeVCardLine(&buffer, "UID:urn:uuid:"+contact.ID)
+		writeVCardLine(&buffer, "FN:"+vcardEscaper.Replace(contact.Name))
+
+		for _, address := range contact.Addresses {
+			writeVCardLine(&buffer, "EMAIL:"+vcardEscaper.Replace(address))
+		}
+		for _, phone := range contact.Phones {
+			writeVCardLine(&buffer, "TEL:"+vcardEscaper.Replace(phone))
+		}
+
+		if len(contact.Groups) > 0 {
+			groups := make([]string, len(contact.Groups))
+			for i, group := range contact.Groups {
+				groups[i] = vcardEscaper.Replace(group)
+			}
+			writeVCardLine(&buffer, "CATEGORIES:"+strings.Join(groups, ","))
+		}
+
+		if contact.Notes != "" {
+			writeVCardLine(&buffer, "NOTE:"+vcardEscaper.Replace(contact.Notes))
+		}
+
+		writeVCardLine(&buffer, "END:VCARD")
+	}
+
+	return buffer.Bytes()
+}
+
+// mergeContact adds what an imported contact knows to an existing contact
+func mergeContact(existing *Contact, imported Contact) {
+	if existing.Collected || existing.Name == "" {
+		if imported.Name != "" {
+			existing.Name = imported.Name
+		}
+	}
+
+	// The lists are copied, the address book may still share them
+	existing.Addresses = appendUnique(append([]string{}, existing.Addresses...),
+		imported.Addresses...)
+	existing.Groups = appendUnique(append([]string{}, existing.Groups...),
+		imported.Groups...)
+	existing.Phones = appendUnique(append([]string{}, existing.Phones...),
+		imported.Phones...)
+
+	if existing.Notes == "" {
+		existing.Notes = imported.Notes
+	}
+
+	existing.Collected = false
+}
+
+// MSAExportContacts gets called from the handleRequests method
+// It sends back the whole address book as vCards
+func MSAExportContacts(w http.ResponseWriter, r *http.Request) {
+	contacts.mutex.RLock()
+	data := FormatVCards(contacts.list)
+	contacts.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="contacts.vcf"`)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// MSAImportContacts gets called from the handleRequests method
+// It adds the contacts of vCards to the address book. Contacts sharing an
+// address with a contact of the address book are merged with it, and invalid
+// contacts are skipped
+func MSAImportContacts(w http.ResponseWriter, r *http.Request) {
+	imported, err := ParseVCards(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	var result ImportResult
+
+	contacts.mutex.Lock()
+	defer contacts.mutex.Unlock()
+
+	list := append([]Contact{}, contacts.list...)
+
+	for _, contact := range imported {
+		if err := contact.validate(); err != nil {
+			result.Skipped++
+			continue
+		}
+
+		merged := false
+		for _, address := range contact.Addresses {
+			if i, ok := findAddress(list, address); ok {
+				mergeContact(&list[i], contact)
+				merged = true
+				break
+			}
+		}
+
+		if merged {
+			result.Updated++
+			continue
+		}
+
+		if err := newContact(&contact); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Print(err.Error())
+			return
+		}
+
+		list = append(list, contact)
+		result.Created++
+	}
+
+	if err := saveContacts(list); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	contacts.list = list
+
+	log.Printf("Imported %d contacts, updated %d, skipped %d\n", result.Created,
+		result.Updated, result.Skipped)
+	writeJSON(w, http.StatusOK, result)
+}
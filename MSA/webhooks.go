@@ -0,0 +1,623 @@
+/*
+webhooks.go calls other services back when something happens in the mailbox
+Each webhook is POSTed the events it subscribed to as JSON: emails received,
+and the delivery status of the emails sent. The payload is signed with the
+secret of the webhook, an HMAC-SHA256 of the timestamp and the body, so that
+the receiver can check it comes from this MSA
+The deliveries are queued on disk, one file each, so that none is lost when
+the MSA restarts. A failed delivery is retried with an exponential backoff,
+and given up after maxWebhookAttempts. The last attempts are logged
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// maxWebhookAttempts is the number of attempts after which a delivery is
+// given up
+const maxWebhookAttempts = 10
+
+// webhookBackoff and maxWebhookBackoff bound the time between two attempts
+const webhookBackoff = 10 * time.Second
+const maxWebhookBackoff = time.Hour
+
+// webhookLogSize is the number of attempts kept in the delivery log
+const webhookLogSize = 200
+
+var errBadWebhook = errors.New("invalid webhook")
+
+// webhookEvents are the types of the events a webhook can subscribe to
+var webhookEvents = map[string]bool{
+	eventReceived: true, eventDeleted: true, eventFlags: true, eventStatus: true,
+}
+
+// Webhook struct representing a subscription to the events of the mailbox.
+// Without Events, the webhook gets the emails received and the delivery
+// statuses. A webhook is active unless created or updated with Active false
+type Webhook struct {
+	ID      string
+	URL     string
+	Secret  string   `json:",omitempty"`
+	Events  []string `json:",omitempty"`
+	Folder  string   `json:",omitempty"`
+	Active  bool
+	Created time.Time
+}
+
+// WebhookPayload struct representing the body POSTed to a webhook
+type WebhookPayload struct {
+	Webhook string
+	Mailbox string
+	Event   Event
+}
+
+// WebhookDelivery struct representing a delivery waiting in the queue
+type WebhookDelivery struct {
+	ID          string
+	Webhook     string
+	Payload     WebhookPayload
+	Attempts    int
+	NextAttempt time.Time
+}
+
+// WebhookAttempt struct representing an attempt of the delivery log
+type WebhookAttempt struct {
+	Delivery string
+	Webhook  string
+	Event    uint64
+	Attempt  int
+	Status   int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Success  bool
+	GaveUp   bool `json:",omitempty"`
+	Date     time.Time
+}
+
+// webhooks holds the webhooks of the mailbox and the last attempts
+var webhooks struct {
+	hooks    []Webhook
+	attempts []WebhookAttempt
+	mutex    sync.RWMutex
+}
+
+// webhookClient gives up on the webhooks which take too long to answer
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhooksPath returns the path of the file holding the webhooks
+func webhooksPath() string {
+	return filepath.Join(SETTINGS, "webhooks.json")
+}
+
+// webhookQueue returns the directory holding the deliveries waiting
+func webhookQueue() string {
+	return filepath.Join(SETTINGS, "webhooks")
+}
+
+// loadWebhooks reads the webhooks saved on disk, if any
+func loadWebhooks() {
+	CreateDirIfNotExist(webhookQueue())
+
+	var hooks []Webhook
+
+	data, err := ioutil.ReadFile(webhooksPath())
+	if err == nil {
+		err = json.Unmarshal(data, &hooks)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	webhooks.mutex.Lock()
+	webhooks.hooks = hooks
+	webhooks.mutex.Unlock()
+}
+
+// saveWebhooks writes the webhooks to disk. The caller holds the lock
+func saveWebhooks(hooks []Webhook) error {
+	data, err := json.Marshal(hooks)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(webhooksPath(), data)
+}
+
+// validate checks a webhook can be called, and fills in its defaults
+func (hook *Webhook) validate() error {
+	target, err := url.Parse(hook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") ||
+		target.Host == "" {
+		return errBadWebhook
+	}
+
+	for _, event := range hook.Events {
+		if !webhookEvents[event] {
+			return errBadWebhook
+		}
+	}
+
+	if len(hook.Events) == 0 {
+		hook.Events = []string{eventReceived, eventStatus}
+	}
+
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+
+	return nil
+}
+
+// wants tells whether a webhook subscribed to an event
+func (hook Webhook) wants(event Event) bool {
+	if !hook.Active || (hook.Folder != "" && hook.Folder != event.Folder) {
+		return false
+	}
+
+	for _, eventType := range hook.Events {
+		if eventType == event.Type {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queueWebhooks queues the deliveries of an event to the webhooks which
+// subscribed to it
+func queueWebhooks(event Event) {
+	webhooks.mutex.RLock()
+	defer webhooks.mutex.RUnlock()
+
+	for _, hook := range webhooks.hooks {
+		if !hook.wants(event) {
+			continue
+		}
+
+		deliveryUUID, err := uuid.NewUUID()
+		if err != nil {
+			log.Print(err.Error())
+			continue
+		}
+
+		delivery := WebhookDelivery{
+			ID:          deliveryUUID.String(),
+			Webhook:     hook.ID,
+			Payload:     WebhookPayload{hook.ID, self.Name, event},
+			NextAttempt: time.Now(),
+		}
+
+		if err := saveDelivery(delivery); err != nil {
+			log.Print(err.Error())
+		}
+	}
+}
+
+// saveDelivery writes a delivery to the queue
+func saveDelivery(delivery WebhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(webhookQueue(), delivery.ID+".json"), data)
+}
+
+// sign returns the signature of a payload sent at the given timestamp
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the time to wait before the next attempt of a delivery
+func backoff(attempts int) time.Duration {
+	wait := webhookBackoff
+	for i := 1; i < attempts && wait < maxWebhookBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > maxWebhookBackoff {
+		wait = maxWebhookBackoff
+	}
+
+	return wait
+}
+
+// findWebhook returns a webhook by its ID. The caller holds the lock
+func findWebhook(id string) (int, bool) {
+	for i, hook := range webhooks.hooks {
+		if hook.ID == id {
+			return i, true
+		}
+	}
+
+	return -1, false
+}
+
+// attempt tries to deliver a payload to its webhook once. It returns whether
+// the delivery is over, delivered or given up
+func attempt(delivery *WebhookDelivery) bool {
+	webhooks.mutex.RLock()
+	i, ok := findWebhook(delivery.Webhook)
+	var hook Webhook
+	if ok {
+		hook = webhooks.hooks[i]
+	}
+	webhooks.mutex.RUnlock()
+
+	// The webhook was deleted or disabled since
+	if !ok || !hook.Active {
+		return true
+	}
+
+	delivery.Attempts++
+	record := WebhookAttempt{Delivery: delivery.ID, Webhook: hook.ID,
+		Event: delivery.Payload.Event.ID, Attempt: delivery.Attempts, Date: time.Now()}
+
+	body, err := json.Marshal(delivery.Payload)
+	if err != nil {
+		log.Print(err.Error())
+		return true
+	}
+
+	request, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err == nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-Webhook-ID", hook.ID)
+		request.Header.Set("X-Webhook-Delivery", delivery.ID)
+		request.Header.Set("X-Webhook-Event", delivery.Payload.Event.Type)
+		request.Header.Set("X-Webhook-Timestamp", timestamp)
+		request.Header.Set("X-Webhook-Signature", sign(hook.Secret, timestamp, body))
+
+		var resp *http.Response
+		if resp, err = webhookClient.Do(request); err == nil {
+			resp.Body.Close()
+			record.Status = resp.StatusCode
+			record.Success = resp.StatusCode >= 200 && resp.StatusCode <= 299
+		}
+	}
+
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	record.GaveUp = !record.Success && delivery.Attempts >= maxWebhookAttempts
+	logAttempt(record)
+
+	if record.Success {
+		return true
+	} else if record.GaveUp {
+		log.Printf("Gave up delivering %s to %s\n", delivery.ID, hook.URL)
+		return true
+	}
+
+	delivery.NextAttempt = time.Now().Add(backoff(delivery.Attempts))
+
+	return false
+}
+
+// logAttempt adds an attempt to the delivery log
+func logAttempt(record WebhookAttempt) {
+	webhooks.mutex.Lock()
+	defer webhooks.mutex.Unlock()
+
+	webhooks.attempts = append(webhooks.attempts, record)
+	if len(webhooks.attempts) > webhookLogSize {
+		webhooks.attempts = webhooks.attempts[len(webhooks.attempts)-webhookLogSize:]
+	}
+}
+
+// deliverWebhooks periodically attempts the deliveries which are due. Each
+// webhook gets its deliveries in order, while the webhooks are called at the
+// same time so that a slow one doesn't hold the others back
+func deliverWebhooks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for {
+		files, err := ioutil.ReadDir(webhookQueue())
+		if err != nil {
+			log.Print(err.Error())
+		}
+
+		due := make(map[string][]string)
+		for _, file := range files {
+			if filepath.Ext(file.Name()) != ".json" {
+				continue
+			}
+
+			path := filepath.Join(webhookQueue(), file.Name())
+
+			delivery, err := readDelivery(path)
+			if err != nil {
+				log.Print(err.Error())
+				continue
+			}
+
+			if time.Now().Before(delivery.NextAttempt) {
+				continue
+			}
+
+			due[delivery.Webhook] = append(due[delivery.Webhook], path)
+		}
+
+		var wg sync.WaitGroup
+		for _, paths := range due {
+			wg.Add(1)
+			go func(paths []string) {
+				defer wg.Done()
+				for _, path := range paths {
+					deliverQueued(path)
+				}
+			}(paths)
+		}
+		wg.Wait()
+
+		<-ticker.C
+	}
+}
+
+// readDelivery reads a delivery of the queue
+func readDelivery(path string) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &delivery)
+	}
+
+	return delivery, err
+}
+
+// deliverQueued attempts a delivery of the queue, and removes it once done
+func deliverQueued(path string) {
+	delivery, err := readDelivery(path)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	if attempt(&delivery) {
+		err = os.Remove(path)
+	} else {
+		err = saveDelivery(delivery)
+	}
+	if err != nil {
+		log.Print(err.Error())
+	}
+}
+
+// readWebhookRequest reads a webhook sent to the MSA, and checks it
+func readWebhookRequest(w http.ResponseWriter, r *http.Request) (Webhook, error) {
+	hook := Webhook{Active: true}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		return hook, err
+	}
+
+	if err := json.Unmarshal(body, &hook); err != nil {
+		return hook, err
+	}
+
+	return hook, hook.validate()
+}
+
+// writeJSON sends back a value as JSON, with the given status
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(valueJSON)
+}
+
+// withoutSecret hides the secret of a webhook, which is only shown when the
+// webhook is created
+func withoutSecret(hook Webhook) Webhook {
+	hook.Secret = ""
+	return hook
+}
+
+// MSAListWebhooks gets called from the handleRequests method
+// It lists the webhooks of the mailbox
+func MSAListWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks.mutex.RLock()
+	hooks := []Webhook{}
+	for _, hook := range webhooks.hooks {
+		hooks = append(hooks, withoutSecret(hook))
+	}
+	webhooks.mutex.RUnlock()
+
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+// MSACreateWebhook gets called from the handleRequests method
+// It subscribes a new webhook, and sends it back along with its secret
+func MSACreateWebhook(w http.ResponseWriter, r *http.Request) {
+	hook, err := readWebhookRequest(w, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	hookUUID, err := uuid.NewUUID()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	hook.ID = hookUUID.String()
+	hook.Created = time.Now()
+
+	webhooks.mutex.Lock()
+	defer webhooks.mutex.Unlock()
+
+	hooks := append(append([]Webhook{}, webhooks.hooks...), hook)
+	if err := saveWebhooks(hooks); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	webhooks.hooks = hooks
+
+	log.Println("Created the webhook " + hook.ID + " to " + hook.URL)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// MSAReadWebhook gets called from the handleRequests method
+// It sends back a webhook
+func MSAReadWebhook(w http.ResponseWriter, r *http.Request) {
+	webhooks.mutex.RLock()
+	defer webhooks.mutex.RUnlock()
+
+	i, ok := findWebhook(mux.Vars(r)["id"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, withoutSecret(webhooks.hooks[i]))
+}
+
+// MSAUpdateWebhook gets called from the handleRequests method
+// It replaces a webhook. Without a new secret, the webhook keeps its secret,
+// and without Active it keeps being active or not
+func MSAUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	webhooks.mutex.Lock()
+	defer webhooks.mutex.Unlock()
+
+	i, ok := findWebhook(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Without Active, the webhook stays as active as it was
+	hook := Webhook{Active: webhooks.hooks[i].Active}
+	if err := json.Unmarshal(body, &hook); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	if hook.Secret == "" {
+		hook.Secret = webhooks.hooks[i].Secret
+	}
+	hook.ID, hook.Created = id, webhooks.hooks[i].Created
+
+	if err := hook.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	hooks := append([]Webhook{}, webhooks.hooks...)
+	hooks[i] = hook
+
+	if err := saveWebhooks(hooks); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	webhooks.hooks = hooks
+
+	log.Println("Updated the webhook " + id)
+	writeJSON(w, http.StatusOK, withoutSecret(hook))
+}
+
+// MSADeleteWebhook gets called from the handleRequests method
+// It deletes a webhook. Its deliveries still queued are dropped
+func MSADeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	webhooks.mutex.Lock()
+	defer webhooks.mutex.Unlock()
+
+	i, ok := findWebhook(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	hooks := append(append([]Webhook{}, webhooks.hooks[:i]...), webhooks.hooks[i+1:]...)
+	if err := saveWebhooks(hooks); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	webhooks.hooks = hooks
+
+	log.Println("Deleted the webhook " + id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MSAWebhookLog gets called from the handleRequests method
+// It sends back the last delivery attempts, most recent first, of every
+// webhook or of the webhook given in the URL
+func MSAWebhookLog(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	webhooks.mutex.RLock()
+	defer webhooks.mutex.RUnlock()
+
+	if _, ok := findWebhook(id); id != "" && !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	attempts := []WebhookAttempt{}
+	for i := len(webhooks.attempts) - 1; i >= 0; i-- {
+		if id == "" || webhooks.attempts[i].Webhook == id {
+			attempts = append(attempts, webhooks.attempts[i])
+		}
+	}
+
+	writeJSON(w, http.StatusOK, attempts)
+}
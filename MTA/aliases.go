@@ -0,0 +1,543 @@
+/*
+aliases.go resolves the recipients of the emails this MTA receives
+An address of the domain is either the mailbox of an MSA registered with this
+MTA, a mailing list, or an alias. An alias stands for one or more addresses,
+of this domain or of others: the emails to an alias are delivered to the
+mailboxes behind it, and forwarded to the other domains
+A tag added to the name of a recipient (user+tag@domain) is ignored to find
+its mailbox, and the emails to an address which doesn't exist go to the
+catch-all mailbox of the domain, if there is one
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ALIASES is the directory holding the aliases of the domain
+const ALIASES = "Aliases"
+
+// maxAliasDepth is the number of aliases an address can go through before it
+// reaches a mailbox
+const maxAliasDepth = 8
+
+var errBadAlias = errors.New("invalid alias")
+var errAliasExists = errors.New("address already in use")
+var errUnknownRecipient = errors.New("unknown recipient")
+
+// Alias struct representing an address of the domain standing for other
+// addresses
+type Alias struct {
+	Address string
+	Targets []string
+	Created time.Time
+}
+
+// AliasTable struct representing the aliases of the domain, as saved. The
+// emails to unknown addresses of the domain go to the CatchAll address
+type AliasTable struct {
+	Aliases  []Alias
+	CatchAll string `json:",omitempty"`
+}
+
+// aliases holds the aliases, by address in lower case, and the catch-all
+// address of the domain
+var aliases struct {
+	all      map[string]Alias
+	catchAll string
+	mutex    sync.RWMutex
+}
+
+// aliasesPath returns the path of the file holding the aliases
+func aliasesPath() string {
+	return filepath.Join(ALIASES, "aliases.json")
+}
+
+// loadAliases reads the aliases saved on disk, if any
+func loadAliases() {
+	CreateDirIfNotExist(ALIASES)
+
+	var table AliasTable
+
+	data, err := ioutil.ReadFile(aliasesPath())
+	if err == nil {
+		err = json.Unmarshal(data, &table)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	all := make(map[string]Alias)
+	for _, alias := range table.Aliases {
+		all[strings.ToLower(alias.Address)] = alias
+	}
+
+	aliases.mutex.Lock()
+	aliases.all = all
+	aliases.catchAll = table.CatchAll
+	aliases.mutex.Unlock()
+}
+
+// saveAliases writes the aliases to disk. The caller holds the lock
+func saveAliases(all map[string]Alias, catchAll string) error {
+	table := AliasTable{Aliases: []Alias{}, CatchAll: catchAll}
+	for _, alias := range all {
+		table.Aliases = append(table.Aliases, alias)
+	}
+
+	sort.Slice(table.Aliases, func(i, j int) bool {
+		return table.Aliases[i].Address < table.Aliases[j].Address
+	})
+
+	data, err := json.Marshal(table)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(aliasesPath(), data)
+}
+
+// findMSA returns the MSA registered with this MTA for an address
+func findMSA(address string) (Server, bool) {
+	if server, ok := msa[address]; ok {
+		return server, true
+	}
+
+	for name, server := range msa {
+		if strings.EqualFold(name, address) {
+			return server, true
+		}
+	}
+
+	return Server{}, false
+}
+
+// findAlias returns the alias with an address, if there is one. The aliases
+// are locked before the mailing lists, never the other way round
+func findAlias(address string) (Alias, bool) {
+	aliases.mutex.RLock()
+	defer aliases.mutex.RUnlock()
+
+	alias, ok := aliases.all[strings.ToLower(strings.TrimSpace(address))]
+
+	return alias, ok
+}
+
+// isLocal tells whether an address belongs to the domain of this MTA
+func isLocal(address string) bool {
+	return strings.HasSuffix(strings.ToLower(address), "@"+strings.ToLower(self.Name))
+}
+
+// withoutTag removes the tag from the name of an address, user+tag@domain
+// becoming user@domain
+func withoutTag(address string) string {
+	at := strings.LastIndexByte(address, '@')
+	if at < 0 {
+		return address
+	}
+
+	if plus := strings.IndexByte(address[:at], '+'); plus > 0 {
+		return address[:plus] + address[at:]
+	}
+
+	return address
+}
+
+// resolveRecipient returns the addresses an email to a recipient of this
+// domain is delivered to: mailboxes and mailing lists of this MTA, and
+// addresses of other domains the email is forwarded to
+func resolveRecipient(address string) ([]string, error) {
+	address, err := normalizeAddress(address)
+	if err != nil || !isLocal(address) {
+		// This MTA doesn't relay the emails of other domains
+		return nil, errUnknownRecipient
+	}
+
+	aliases.mutex.RLock()
+	defer aliases.mutex.RUnlock()
+
+	var targets []string
+	if err := expandAddress(address, 0, make(map[string]bool), &targets); err != nil {
+		return nil, err
+	}
+
+	// Aliases only pointing at each other lead nowhere
+	if len(targets) == 0 {
+		return nil, errUnknownRecipient
+	}
+
+	return targets, nil
+}
+
+// expandAddress adds the addresses an address stands for to the targets. An
+// alias already expanded is skipped, so that aliases pointing at each other
+// don't go round forever. The caller holds the lock of the aliases
+func expandAddress(address string, depth int, seen map[string]bool, targets *[]string) error {
+	if seen[address] {
+		return nil
+	}
+	seen[address] = true
+
+	if depth > maxAliasDepth {
+		return errUnknownRecipient
+	}
+
+	if !isLocal(address) {
+		*targets = append(*targets, address)
+		return nil
+	}
+
+	if _, ok := findMSA(address); ok {
+		*targets = append(*targets, address)
+		return nil
+	}
+	if _, ok := findList(address); ok {
+		*targets = append(*targets, address)
+		return nil
+	}
+
+	if alias, ok := aliases.all[address]; ok {
+		found := false
+		for _, target := range alias.Targets {
+			if err := expandAddress(strings.ToLower(target), depth+1, seen, targets); err == nil {
+				found = true
+			}
+		}
+
+		if found {
+			return nil
+		}
+		return errUnknownRecipient
+	}
+
+	if base := withoutTag(address); base != address {
+		return expandAddress(base, depth, seen, targets)
+	}
+
+	if aliases.catchAll != "" && !seen[strings.ToLower(aliases.catchAll)] {
+		return expandAddress(strings.ToLower(aliases.catchAll), depth+1, seen, targets)
+	}
+
+	return errUnknownRecipient
+}
+
+// hasDelivered tells whether an email was already forwarded by an address of
+// this domain, which means it is going round
+func hasDelivered(email EMail, address string) bool {
+	for _, delivered := range strings.Split(email.Headers["Delivered-To"], ",") {
+		if strings.EqualFold(strings.TrimSpace(delivered), address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forward sends an email to an alias of this domain on to an address of
+// another domain. The email is resent by the alias, which becomes its
+// envelope sender, so that the problems of the forward come back to this
+// domain rather than to the sender, who never wrote to that address
+func forward(email EMail, recipient string, target string) (int, string) {
+	if hasDelivered(email, recipient) {
+		log.Printf("Not forwarding %s to %s again, it is going round\n",
+			email.Subject, target)
+		return http.StatusForbidden, "mail forwarding loop for " + recipient
+	}
+
+	headers := make(map[string]string)
+	for name, value := range email.Headers {
+		headers[name] = value
+	}
+
+	if headers["X-Original-To"] == "" {
+		headers["X-Original-To"] = email.To
+	}
+	if previous := headers["Delivered-To"]; previous != "" {
+		headers["Delivered-To"] = previous + ", " + recipient
+	} else {
+		headers["Delivered-To"] = recipient
+	}
+
+	headers["Return-Path"] = "<" + recipient + ">"
+	headers["Resent-From"] = recipient
+	headers["Resent-To"] = target
+	headers["Resent-Date"] = time.Now().Format(time.RFC1123Z)
+
+	forwarded := email
+	forwarded.To = target
+	forwarded.Headers = headers
+
+	status, reason, _, err := relay(forwarded, target)
+	if err != nil {
+		// The other domain can't be reached, the sending MTA tries again later
+		log.Print(err.Error())
+		return http.StatusServiceUnavailable, "could not forward the email"
+	}
+
+	log.Printf("Forwarded %s for %s to %s : %d\n", email.Subject, recipient,
+		target, status)
+
+	return status, reason
+}
+
+// dispatch delivers an email sent to a recipient of this domain to one of
+// the addresses the recipient stands for. It returns the status and the
+// reason sent back to the MTA of the sender
+func dispatch(email EMail, recipient string, target string) (int, string) {
+	if list, ok := findList(target); ok {
+		return postToList(list, email)
+	}
+
+	if _, ok := findMSA(target); !ok {
+		return forward(email, recipient, target)
+	}
+
+	status, reason, _, err := relay(email, target)
+	if err != nil {
+		// The MSA can't be reached, tell the MTA to try again later
+		log.Print(err.Error())
+		return http.StatusServiceUnavailable, "mailbox unavailable"
+	}
+
+	if status >= 200 && status <= 299 {
+		log.Printf("Delivered email %s to %s", email.Subject, target)
+	} else {
+		log.Printf("Couldn't dispatch to %s : %d\n", target, status)
+	}
+
+	return status, reason
+}
+
+// validate checks an alias belongs to the domain of this MTA, and doesn't
+// hide a mailbox or a mailing list
+func (alias *Alias) validate() error {
+	var err error
+
+	if alias.Address, err = normalizeAddress(alias.Address); err != nil ||
+		!isLocal(alias.Address) {
+		return errBadAlias
+	}
+
+	if alias.Targets, err = normalizeAddresses(alias.Targets); err != nil ||
+		len(alias.Targets) == 0 {
+		return errBadAlias
+	}
+
+	if _, ok := findMSA(alias.Address); ok {
+		return errAliasExists
+	}
+	if _, ok := findList(alias.Address); ok {
+		return errAliasExists
+	}
+
+	return nil
+}
+
+// readAliasRequest unmarshals the alias sent in the body of a request
+func readAliasRequest(r *http.Request) (Alias, error) {
+	var alias Alias
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &alias)
+	}
+
+	return alias, err
+}
+
+// writeAliasError answers a request to change an alias which failed
+func writeAliasError(w http.ResponseWriter, err error) {
+	if err == errAliasExists {
+		w.WriteHeader(http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	log.Print(err.Error())
+}
+
+// MTAListAliases lists the aliases of this domain, and its catch-all address
+func MTAListAliases(w http.ResponseWriter, r *http.Request) {
+	aliases.mutex.RLock()
+	table := AliasTable{Aliases: []Alias{}, CatchAll: aliases.catchAll}
+	for _, alias := range aliases.all {
+		table.Aliases = append(table.Aliases, alias)
+	}
+	aliases.mutex.RUnlock()
+
+	sort.Slice(table.Aliases, func(i, j int) bool {
+		return table.Aliases[i].Address < table.Aliases[j].Address
+	})
+
+	writeJSON(w, http.StatusOK, table)
+}
+
+// MTACreateAlias creates an alias in the domain of this MTA
+func MTACreateAlias(w http.ResponseWriter, r *http.Request) {
+	alias, err := readAliasRequest(r)
+	if err == nil {
+		err = alias.validate()
+	}
+	if err != nil {
+		writeAliasError(w, err)
+		return
+	}
+
+	alias.Created = time.Now()
+
+	aliases.mutex.Lock()
+	defer aliases.mutex.Unlock()
+
+	if _, ok := aliases.all[alias.Address]; ok {
+		writeAliasError(w, errAliasExists)
+		return
+	}
+
+	all := map[string]Alias{alias.Address: alias}
+	for k, v := range aliases.all {
+		all[k] = v
+	}
+
+	if err := saveAliases(all, aliases.catchAll); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	aliases.all = all
+
+	log.Println("Created the alias " + alias.Address + " for " +
+		strings.Join(alias.Targets, ", "))
+	writeJSON(w, http.StatusCreated, alias)
+}
+
+// MTAReadAlias sends back an alias
+func MTAReadAlias(w http.ResponseWriter, r *http.Request) {
+	alias, ok := findAlias(mux.Vars(r)["alias"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, alias)
+}
+
+// MTAUpdateAlias replaces the addresses an alias stands for
+func MTAUpdateAlias(w http.ResponseWriter, r *http.Request) {
+	address := strings.ToLower(mux.Vars(r)["alias"])
+
+	update, err := readAliasRequest(r)
+	if err == nil {
+		update.Address = address
+		err = update.validate()
+	}
+	if err != nil {
+		writeAliasError(w, err)
+		return
+	}
+
+	aliases.mutex.Lock()
+	defer aliases.mutex.Unlock()
+
+	alias, ok := aliases.all[address]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	update.Created = alias.Created
+
+	all := make(map[string]Alias)
+	for k, v := range aliases.all {
+		all[k] = v
+	}
+	all[address] = update
+
+	if err := saveAliases(all, aliases.catchAll); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	aliases.all = all
+
+	log.Println("Updated the alias " + address)
+	writeJSON(w, http.StatusOK, update)
+}
+
+// MTADeleteAlias deletes an alias
+func MTADeleteAlias(w http.ResponseWriter, r *http.Request) {
+	address := strings.ToLower(mux.Vars(r)["alias"])
+
+	aliases.mutex.Lock()
+	defer aliases.mutex.Unlock()
+
+	if _, ok := aliases.all[address]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	all := make(map[string]Alias)
+	for k, v := range aliases.all {
+		if k != address {
+			all[k] = v
+		}
+	}
+
+	if err := saveAliases(all, aliases.catchAll); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	aliases.all = all
+
+	log.Println("Deleted the alias " + address)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MTASetCatchAll sets the address the emails to unknown addresses of the
+// domain go to. An empty address turns the catch-all off
+func MTASetCatchAll(w http.ResponseWriter, r *http.Request) {
+	var table AliasTable
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &table)
+	}
+	if err == nil && table.CatchAll != "" {
+		table.CatchAll, err = normalizeAddress(table.CatchAll)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	aliases.mutex.Lock()
+	defer aliases.mutex.Unlock()
+
+	if err := saveAliases(aliases.all, table.CatchAll); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	aliases.catchAll = table.CatchAll
+
+	log.Println("Catch-all address set to " + table.CatchAll)
+	w.WriteHeader(http.StatusOK)
+}
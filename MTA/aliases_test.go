@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// useTestAliases runs a test on the domain here.com, with two mailboxes, a
+// mailing list and the aliases given, the catch-all going to catchAll
+func useTestAliases(t *testing.T, all map[string][]string, catchAll string) {
+	previousName, previousMSA := self.Name, msa
+	self.Name = "here.com"
+	msa = map[string]Server{
+		"bill@here.com": {Name: "bill@here.com"},
+		"tim@here.com":  {Name: "tim@here.com"},
+	}
+
+	lists.mutex.Lock()
+	previousLists := lists.all
+	lists.all = map[string]MailingList{"team@here.com": {Address: "team@here.com"}}
+	lists.mutex.Unlock()
+
+	aliases.mutex.Lock()
+	aliases.all = make(map[string]Alias)
+	for address, targets := range all {
+		aliases.all[address] = Alias{Address: address, Targets: targets}
+	}
+	aliases.catchAll = catchAll
+	aliases.mutex.Unlock()
+
+	t.Cleanup(func() {
+		self.Name, msa = previousName, previousMSA
+
+		lists.mutex.Lock()
+		lists.all = previousLists
+		lists.mutex.Unlock()
+
+		aliases.mutex.Lock()
+		aliases.all, aliases.catchAll = nil, ""
+		aliases.mutex.Unlock()
+	})
+}
+
+func TestWithoutTag(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		want    string
+	}{
+		{"bill@here.com", "bill@here.com"},
+		{"bill+news@here.com", "bill@here.com"},
+		{"bill+news+daily@here.com", "bill@here.com"},
+		{"bill+@here.com", "bill@here.com"},
+		{"+news@here.com", "+news@here.com"},
+		{"bill@here+there.com", "bill@here+there.com"},
+		{"bill", "bill"},
+	} {
+		if got := withoutTag(test.address); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.address, got, test.want)
+		}
+	}
+}
+
+func TestResolveRecipient(t *testing.T) {
+	// A chain of aliases longer than maxAliasDepth
+	chain := make(map[string][]string)
+	for i := 0; i <= maxAliasDepth; i++ {
+		chain[fmt.Sprintf("a%d@here.com", i)] = []string{fmt.Sprintf("a%d@here.com", i+1)}
+	}
+	chain[fmt.Sprintf("a%d@here.com", maxAliasDepth+1)] = []string{"bill@here.com"}
+
+	for _, test := range []struct {
+		name      string
+		aliases   map[string][]string
+		catchAll  string
+		recipient string
+		want      []string
+	}{
+		{"mailbox", nil, "",
+			"Bill <BILL@here.com>", []string{"bill@here.com"}},
+		{"mailing list", nil, "",
+			"team@here.com", []string{"team@here.com"}},
+		{"another domain", nil, "",
+			"steve@there.com", nil},
+		{"unknown", nil, "",
+			"steve@here.com", nil},
+		{"alias", map[string][]string{"sales@here.com": {"bill@here.com", "steve@there.com"}}, "",
+			"sales@here.com", []string{"bill@here.com", "steve@there.com"}},
+		{"alias of aliases", map[string][]string{
+			"sales@here.com": {"us@here.com", "bill@here.com"},
+			"us@here.com":    {"BILL@here.com", "tim@here.com"},
+		}, "",
+			"sales@here.com", []string{"bill@here.com", "tim@here.com"}},
+		{"alias cycle", map[string][]string{
+			"a@here.com": {"b@here.com"},
+			"b@here.com": {"a@here.com", "tim@here.com"},
+		}, "",
+			"a@here.com", []string{"tim@here.com"}},
+		{"alias cycle to nowhere", map[string][]string{
+			"a@here.com": {"b@here.com"},
+			"b@here.com": {"a@here.com"},
+		}, "",
+			"a@here.com", nil},
+		{"alias to itself", map[string][]string{"a@here.com": {"a@here.com"}}, "",
+			"a@here.com", nil},
+		{"alias too deep", chain, "",
+			"a0@here.com", nil},
+		{"alias with unknown targets", map[string][]string{"sales@here.com": {"nobody@here.com", "tim@here.com"}}, "",
+			"sales@here.com", []string{"tim@here.com"}},
+		{"tag of a mailbox", nil, "",
+			"bill+news@here.com", []string{"bill@here.com"}},
+		{"tag of an alias", map[string][]string{"sales@here.com": {"tim@here.com"}}, "",
+			"sales+eu@here.com", []string{"tim@here.com"}},
+		{"tag of a list", nil, "",
+			"team+dev@here.com", []string{"team@here.com"}},
+		{"catch-all", nil, "tim@here.com",
+			"steve@here.com", []string{"tim@here.com"}},
+		{"catch-all for an unknown tag", nil, "tim@here.com",
+			"steve+news@here.com", []string{"tim@here.com"}},
+		{"catch-all alias", map[string][]string{"postmaster@here.com": {"bill@here.com"}}, "postmaster@here.com",
+			"steve@here.com", []string{"bill@here.com"}},
+		{"catch-all not for another domain", nil, "tim@here.com",
+			"steve@there.com", nil},
+		{"catch-all back to the catch-all", nil, "nobody@here.com",
+			"steve@here.com", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useTestAliases(t, test.aliases, test.catchAll)
+
+			got, err := resolveRecipient(test.recipient)
+			if test.want == nil {
+				if err != errUnknownRecipient {
+					t.Errorf("got %v %v, want an unknown recipient", got, err)
+				}
+				return
+			}
+
+			sort.Strings(got)
+			if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v %v, want %v", got, err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+/*
+bounce.go handles the emails which can't be delivered
+When the destination refuses an email for good, the sender is told with a
+bounce: an email from the MAILER-DAEMON of this domain, delivered straight
+to the inbox of the sender, which quotes the email that failed
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxMessageSize is the maximum size of an email accepted by this MTA, as
+// JSON. It leaves room for the largest email an MSA accepts, whose
+// attachments grow by a third once encoded in base64
+const maxMessageSize = 35 << 20
+
+// Limits struct advertising what this MTA accepts
+type Limits struct {
+	MaxMessageSize int
+}
+
+// bounceReasons explain to the sender why the destination refused an email
+var bounceReasons = map[int]string{
+	http.StatusRequestEntityTooLarge: "the email is larger than the destination accepts",
+	http.StatusInsufficientStorage:   "the mailbox of the recipient is full",
+	http.StatusForbidden:             "the recipient refused the email",
+	http.StatusNotFound:              "the recipient does not exist",
+	http.StatusLoopDetected:          "the email went through too many servers, it may be looping",
+}
+
+// deliveryCodes name the errors sent back for an email refused for good
+var deliveryCodes = map[int]string{
+	http.StatusBadRequest:            "invalid-email",
+	http.StatusForbidden:             "refused",
+	http.StatusNotFound:              "no-such-user",
+	http.StatusRequestEntityTooLarge: "message-too-large",
+	http.StatusInsufficientStorage:   "mailbox-full",
+	http.StatusLoopDetected:          "too-many-hops",
+}
+
+// DeliveryError struct representing why an MTA didn't accept an email, and
+// for which recipient. Temporary errors are worth trying again later, the
+// others are bounced to the sender
+type DeliveryError struct {
+	Recipient string `json:",omitempty"`
+	Code      string
+	Temporary bool
+	Message   string
+}
+
+// maxRefusalSize is the maximum length of the reason given for a refusal
+const maxRefusalSize = 1024
+
+// temporaryStatus tells whether an email refused with a status is worth
+// trying again later. The errors of the 5xx class are temporary, but for a
+// full mailbox or a loop which are bounced, and so is a destination asking
+// to slow down
+func temporaryStatus(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		(status >= 500 && deliveryCodes[status] == "")
+}
+
+// writeDeliveryError answers an MTA whose email wasn't accepted
+func writeDeliveryError(w http.ResponseWriter, status int, recipient string, message string) {
+	deliveryError := DeliveryError{
+		Recipient: recipient,
+		Code:      deliveryCodes[status],
+		Temporary: temporaryStatus(status),
+		Message:   message,
+	}
+
+	if deliveryError.Code == "" && deliveryError.Temporary {
+		deliveryError.Code = "unavailable"
+	} else if deliveryError.Code == "" {
+		deliveryError.Code = "rejected"
+	}
+
+	if deliveryError.Message == "" {
+		deliveryError.Message = strings.ToLower(http.StatusText(status))
+	}
+
+	errorJSON, err := json.Marshal(deliveryError)
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(errorJSON)
+}
+
+// refusal reads the reason given by the destination for refusing an email,
+// if any, and whether the email is worth trying again later. The reason is
+// either a DeliveryError, which tells whether it is temporary, or plain text
+// from the MTAs which don't send one, in which case the status tells
+func refusal(resp *http.Response) (string, bool) {
+	message, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRefusalSize))
+	if err != nil {
+		log.Print(err.Error())
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var deliveryError DeliveryError
+		if json.Unmarshal(message, &deliveryError) == nil && deliveryError.Message != "" {
+			if deliveryError.Recipient != "" {
+				return deliveryError.Recipient + ": " + deliveryError.Message,
+					deliveryError.Temporary
+			}
+			return deliveryError.Message, deliveryError.Temporary
+		}
+	}
+
+	return strings.TrimSpace(string(message)), temporaryStatus(resp.StatusCode)
+}
+
+// isBounce tells whether an email was sent automatically, in which case it
+// mustn't be bounced, otherwise two MTAs could bounce emails at each other
+// forever
+func isBounce(email EMail) bool {
+	auto := email.Headers["Auto-Submitted"]
+
+	return (auto != "" && auto != "no") ||
+		strings.HasPrefix(strings.ToUpper(email.From), "MAILER-DAEMON@")
+}
+
+// bounce tells the sender of an email, through its MSA at address, that the
+// email couldn't be delivered
+func bounce(address string, email EMail, reason string) {
+	if isBounce(email) {
+		log.Println("Not bouncing an automatic email : " + email.Subject)
+		return
+	}
+
+	notice := EMail{
+		InReplyTo: email.MessageID,
+		From:      "MAILER-DAEMON@" + self.Name,
+		To:        email.From,
+		Subject:   "Undelivered Mail Returned to Sender: " + email.Subject,
+		Body: fmt.Sprintf("Your email to %s could not be delivered: %s.\n\n"+
+			"----- Original email -----\n%sDate: %s\nSubject: %s\n\n%s",
+			email.To, reason, trace(email), email.Date.Format(time.RFC1123Z),
+			email.Subject, email.Body),
+		Date:    time.Now(),
+		Headers: map[string]string{"Auto-Submitted": "auto-replied"},
+	}
+
+	var err error
+	if notice.UUID, err = uuid.NewUUID(); err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	if email.MessageID != "" {
+		notice.References = append(append([]string{}, email.References...),
+			email.MessageID)
+	}
+
+	noticeJSON, err := json.Marshal(notice)
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	resp, err := http.Post(address+"email/outbox", "application/json",
+		bytes.NewReader(noticeJSON))
+
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		log.Print("Could not bounce email " + resp.Status)
+	} else {
+		log.Printf("Bounced email %s to %s : %s\n", email.Subject, email.From,
+			reason)
+	}
+}
+
+// MTALimits sends back the limits of this MTA, for the other MTAs to know
+// what they can send
+func MTALimits(w http.ResponseWriter, r *http.Request) {
+	limitsJSON, err := json.Marshal(Limits{MaxMessageSize: maxMessageSize})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.Write(limitsJSON)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTemporaryStatus(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusForbidden, false},
+		{http.StatusNotFound, false},
+		{http.StatusRequestEntityTooLarge, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusInsufficientStorage, false},
+		{http.StatusLoopDetected, false},
+	} {
+		if got := temporaryStatus(test.status); got != test.want {
+			t.Errorf("%d: got %v, want %v", test.status, got, test.want)
+		}
+	}
+}
+
+func TestRefusal(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		write     func(w http.ResponseWriter)
+		reason    string
+		temporary bool
+	}{
+		{"unknown recipient",
+			func(w http.ResponseWriter) {
+				writeDeliveryError(w, http.StatusNotFound, "steve@here.com", "no such user")
+			},
+			"steve@here.com: no such user", false},
+		{"mailbox full",
+			func(w http.ResponseWriter) {
+				writeDeliveryError(w, http.StatusInsufficientStorage, "", "")
+			},
+			"insufficient storage", false},
+		{"unavailable",
+			func(w http.ResponseWriter) {
+				writeDeliveryError(w, http.StatusServiceUnavailable, "", "try again later")
+			},
+			"try again later", true},
+		{"the flag over the status",
+			func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"Code":"rejected","Temporary":false,"Message":"spam"}`))
+			},
+			"spam", false},
+		{"plain text, permanent",
+			func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte("go away\n"))
+			},
+			"go away", false},
+		{"plain text, temporary",
+			func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("busy"))
+			},
+			"busy", true},
+		{"invalid JSON",
+			func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				w.Write([]byte("slow down"))
+			},
+			"slow down", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			test.write(w)
+
+			reason, temporary := refusal(w.Result())
+			if reason != test.reason || temporary != test.temporary {
+				t.Errorf("got %q %v, want %q %v", reason, temporary,
+					test.reason, test.temporary)
+			}
+		})
+	}
+}
@@ -0,0 +1,1079 @@
+/*
+lists.go hosts the mailing lists of the domain of this MTA
+An email to a mailing list (team@here.com) is sent on to each member of the
+list, with the List-* headers telling the members where it comes from and
+how to unsubscribe. Who may post to a list depends on its posting policy:
+anyone, the members only, or anyone but through the moderation of the owners
+Each copy carries the address of the list in X-Loop, so that an email coming
+back to a list it already went through is dropped instead of going round the
+lists forever
+The one-click unsubscribe link of each copy holds a token, an HMAC of the list
+and the member with the secret of this MTA, rather than the address of the
+member. The members which can't be reached are tried again a few times, and
+the owners are told about the ones which never got the email. The emails
+being sent to the members are kept on disk until then, and taken up again
+when the MTA restarts
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// LISTS is the directory holding the mailing lists and the emails waiting for
+// moderation
+const LISTS = "Lists"
+
+// Posting policies of the mailing lists
+const (
+	postingOpen      = "open"
+	postingMembers   = "members"
+	postingModerated = "moderated"
+)
+
+// listRetries is the number of times a member which couldn't be reached is
+// tried again, waiting twice as long each time from listRetryDelay
+const listRetries = 3
+
+var listRetryDelay = time.Minute
+
+var errBadList = errors.New("invalid mailing list")
+var errListExists = errors.New("mailing list already exists")
+
+// MailingList struct representing a mailing list of this domain. The owners
+// moderate the list, and can always post to it
+type MailingList struct {
+	Address       string
+	Name          string `json:",omitempty"`
+	Description   string `json:",omitempty"`
+	Posting       string
+	SubjectPrefix string `json:",omitempty"`
+	Owners        []string
+	Members       []string
+	Created       time.Time
+}
+
+// HeldEmail struct representing an email to a moderated list, waiting for an
+// owner to approve it
+type HeldEmail struct {
+	UUID     string
+	List     string
+	From     string
+	Subject  string
+	Received time.Time
+	Email    EMail
+}
+
+// ListDelivery struct representing an email being sent to the members of a
+// list. Pending are the members still to be tried, at NextTry, and Failed the
+// ones which couldn't be reached so far, with the reason
+type ListDelivery struct {
+	UUID      string
+	List      MailingList
+	Email     EMail
+	Pending   []string
+	Failed    map[string]string `json:",omitempty"`
+	Delivered int
+	Retry     int
+	NextTry   time.Time
+}
+
+// SubscribeRequest struct representing a request to subscribe to a list
+type SubscribeRequest struct {
+	Address string
+}
+
+// lists holds the mailing lists, by address in lower case, and the secret
+// the unsubscribe tokens are signed with
+var lists struct {
+	all    map[string]MailingList
+	secret []byte
+	mutex  sync.RWMutex
+}
+
+// listsPath returns the path of the file holding the mailing lists
+func listsPath() string {
+	return filepath.Join(LISTS, "lists.json")
+}
+
+// secretPath returns the path of the file holding the secret of the
+// unsubscribe tokens
+func secretPath() string {
+	return filepath.Join(LISTS, "secret")
+}
+
+// heldPath returns the path of the file holding an email waiting for
+// moderation
+func heldPath(id string) string {
+	return filepath.Join(LISTS, "held", id+".json")
+}
+
+// deliveryPath returns the path of the file holding an email being sent to
+// the members of a list
+func deliveryPath(id string) string {
+	return filepath.Join(LISTS, "queue", id+".json")
+}
+
+// writeFileAtomic writes a file through a temporary file, so that it is never
+// left half written
+func writeFileAtomic(path string, data []byte) error {
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(temp, path)
+}
+
+// writeJSON sends a value back as JSON
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	w.WriteHeader(status)
+	w.Write(valueJSON)
+}
+
+// loadLists reads the mailing lists saved on disk, if any
+func loadLists() {
+	CreateDirIfNotExist(filepath.Join(LISTS, "held"))
+	CreateDirIfNotExist(filepath.Join(LISTS, "queue"))
+
+	var saved []MailingList
+
+	data, err := ioutil.ReadFile(listsPath())
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	all := make(map[string]MailingList)
+	for _, list := range saved {
+		all[strings.ToLower(list.Address)] = list
+	}
+
+	lists.mutex.Lock()
+	lists.all = all
+	lists.secret = loadSecret()
+	lists.mutex.Unlock()
+}
+
+// loadSecret reads the secret of the unsubscribe tokens, or makes one the
+// first time. It stays the same across restarts, for the links of the emails
+// already sent to keep working
+func loadSecret() []byte {
+	secret, err := ioutil.ReadFile(secretPath())
+	if err == nil && len(secret) > 0 {
+		return secret
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Print(err.Error())
+	}
+
+	secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Print(err.Error())
+	}
+
+	if err := writeFileAtomic(secretPath(), secret); err != nil {
+		log.Print(err.Error())
+	}
+
+	return secret
+}
+
+// unsubscribeToken returns the token which unsubscribes a member from a list
+func unsubscribeToken(list string, member string) string {
+	lists.mutex.RLock()
+	mac := hmac.New(sha256.New, lists.secret)
+	lists.mutex.RUnlock()
+
+	mac.Write([]byte(strings.ToLower(list) + "\n" + strings.ToLower(member)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// saveLists writes the mailing lists to disk. The caller holds the lock
+func saveLists(all map[string]MailingList) error {
+	saved := []MailingList{}
+	for _, list := range all {
+		saved = append(saved, list)
+	}
+
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Address < saved[j].Address })
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(listsPath(), data)
+}
+
+// findList returns the mailing list with an address, if there is one
+func findList(address string) (MailingList, bool) {
+	lists.mutex.RLock()
+	defer lists.mutex.RUnlock()
+
+	list, ok := lists.all[strings.ToLower(strings.TrimSpace(address))]
+
+	return list, ok
+}
+
+// normalizeAddress keeps the address part of an address, in lower case
+func normalizeAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToLower(parsed.Address), nil
+}
+
+// normalizeAddresses normalizes a list of addresses, removing the duplicates
+func normalizeAddresses(addresses []string) ([]string, error) {
+	normalized := []string{}
+	seen := make(map[string]bool)
+
+	for _, address := range addresses {
+		address, err := normalizeAddress(address)
+		if err != nil {
+			return nil, err
+		}
+
+		if !seen[address] {
+			seen[address] = true
+			normalized = append(normalized, address)
+		}
+	}
+
+	return normalized, nil
+}
+
+// contains tells whether an address is one of a list of addresses
+func contains(addresses []string, address string) bool {
+	for _, candidate := range addresses {
+		if strings.EqualFold(candidate, address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate checks a mailing list belongs to the domain of this MTA, and fills
+// in its defaults
+func (list *MailingList) validate() error {
+	var err error
+
+	if list.Address, err = normalizeAddress(list.Address); err != nil ||
+		!strings.HasSuffix(list.Address, "@"+strings.ToLower(self.Name)) {
+		return errBadList
+	}
+
+	if _, ok := findMSA(list.Address); ok {
+		// The address is the mailbox of a user
+		return errListExists
+	}
+	if _, ok := findAlias(list.Address); ok {
+		return errListExists
+	}
+
+	switch list.Posting {
+	case "":
+		list.Posting = postingMembers
+	case postingOpen, postingMembers, postingModerated:
+	default:
+		return errBadList
+	}
+
+	if list.Owners, err = normalizeAddresses(list.Owners); err != nil {
+		return errBadList
+	}
+	if list.Members, err = normalizeAddresses(list.Members); err != nil {
+		return errBadList
+	}
+
+	return nil
+}
+
+// lookupServer asks the BlueBook which MTA handles the domain of an address
+func lookupServer(address string) (Server, error) {
+	var server Server
+
+	resp, err := http.Get("http://192.168.1.3:8888/bluebook/" + url.PathEscape(address))
+	if err != nil {
+		return server, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return server, fmt.Errorf("no server for %s: %s", address, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &server)
+	}
+
+	return server, err
+}
+
+// relay sends an email on to a recipient, straight to its MSA if it is a
+// client of this MTA, or else to the MTA of its domain. It returns the status
+// sent back, and the reason given for refusing the email, if any, along with
+// whether the refusal is temporary
+func relay(email EMail, recipient string) (int, string, bool, error) {
+	emailJSON, err := json.Marshal(email)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	var target string
+	if local, ok := findMSA(recipient); ok {
+		target = local.Address + "email/outbox"
+	} else {
+		server, err := lookupServer(recipient)
+		if err != nil {
+			return 0, "", false, err
+		}
+		target = server.Address + "email/server"
+	}
+
+	resp, err := http.Post(target, "application/json", bytes.NewReader(emailJSON))
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		reason, temporary := refusal(resp)
+		return resp.StatusCode, reason, temporary, nil
+	}
+
+	return resp.StatusCode, "", false, nil
+}
+
+// hasLooped tells whether an email already went through a mailing list
+func hasLooped(list MailingList, email EMail) bool {
+	for _, address := range strings.Split(email.Headers["X-Loop"], ",") {
+		if strings.EqualFold(strings.TrimSpace(address), list.Address) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// listID returns the List-Id of a mailing list (RFC 2919)
+func listID(list MailingList) string {
+	id := "<" + strings.Replace(list.Address, "@", ".", 1) + ">"
+	if list.Name != "" {
+		id = mime.QEncoding.Encode("utf-8", list.Name) + " " + id
+	}
+
+	return id
+}
+
+// listCopy makes the copy of an email to a list for one of its members
+func listCopy(list MailingList, email EMail, loop string, member string) EMail {
+	headers := make(map[string]string)
+	for name, value := range email.Headers {
+		headers[name] = value
+	}
+
+	headers["List-Id"] = listID(list)
+	headers["List-Post"] = "<mailto:" + list.Address + ">"
+	headers["List-Unsubscribe"] = "<" + self.Address + "lists/" +
+		url.PathEscape(list.Address) + "/unsubscribe?token=" +
+		unsubscribeToken(list.Address, member) + ">"
+	headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+	headers["Precedence"] = "list"
+	headers["X-Loop"] = loop
+
+	memberEmail := email
+	memberEmail.To = member
+	memberEmail.Headers = headers
+
+	return memberEmail
+}
+
+// queueDelivery saves an email to a list, to be sent to each member of the
+// list but its sender
+func queueDelivery(list MailingList, email EMail) (ListDelivery, error) {
+	sender, _ := normalizeAddress(email.From)
+
+	if list.SubjectPrefix != "" && !strings.Contains(email.Subject, list.SubjectPrefix) {
+		email.Subject = list.SubjectPrefix + " " + email.Subject
+	}
+
+	delivery := ListDelivery{List: list, Email: email, NextTry: time.Now()}
+
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return delivery, err
+	}
+	delivery.UUID = id.String()
+
+	for _, member := range list.Members {
+		if member != sender {
+			delivery.Pending = append(delivery.Pending, member)
+		}
+	}
+
+	return delivery, saveDelivery(delivery)
+}
+
+// saveDelivery writes an email being sent to the members of a list to disk
+func saveDelivery(delivery ListDelivery) error {
+	deliveryJSON, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(deliveryPath(delivery.UUID), deliveryJSON)
+}
+
+// resumeDeliveries takes up the emails which were being sent to the members
+// of the lists when the MTA stopped. They wait for one listRetryDelay at
+// least, for the MSAs of the domain to register again
+func resumeDeliveries() {
+	files, err := ioutil.ReadDir(filepath.Join(LISTS, "queue"))
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	earliest := time.Now().Add(listRetryDelay)
+
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		var delivery ListDelivery
+
+		data, err := ioutil.ReadFile(filepath.Join(LISTS, "queue", file.Name()))
+		if err == nil {
+			err = json.Unmarshal(data, &delivery)
+		}
+		if err != nil {
+			log.Print(err.Error())
+			continue
+		}
+
+		if delivery.NextTry.Before(earliest) {
+			delivery.NextTry = earliest
+		}
+
+		go distribute(delivery)
+	}
+}
+
+// distribute sends a copy of an email to the members of a mailing list still
+// pending. The members which are unavailable are tried again later, as the
+// MTA does with the emails of the outboxes, and the owners get the list of
+// the members which couldn't be reached in the end. The delivery is saved
+// after each round, a member reached just before the MTA stopped may get the
+// email twice but none loses it
+func distribute(delivery ListDelivery) {
+	list, email := delivery.List, delivery.Email
+
+	loop := list.Address
+	if previous := email.Headers["X-Loop"]; previous != "" {
+		loop = previous + ", " + list.Address
+	}
+
+	if delivery.Failed == nil {
+		delivery.Failed = make(map[string]string)
+	}
+
+	for len(delivery.Pending) > 0 {
+		if wait := time.Until(delivery.NextTry); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		var unavailable []string
+
+		for _, member := range delivery.Pending {
+			status, reason, temporary, err := relay(listCopy(list, email, loop, member), member)
+			if err == nil && status <= 299 {
+				delete(delivery.Failed, member)
+				delivery.Delivered++
+				continue
+			}
+
+			if err != nil {
+				reason = err.Error()
+			} else if reason == "" {
+				reason = strconv.Itoa(status) + " " + http.StatusText(status)
+			}
+
+			log.Printf("Could not send %s from %s to %s : %s\n", email.Subject,
+				list.Address, member, reason)
+			delivery.Failed[member] = reason
+
+			// Only an unavailable destination is worth trying again
+			if err != nil || temporary {
+				unavailable = append(unavailable, member)
+			}
+		}
+
+		delivery.Pending = nil
+		if delivery.Retry < listRetries && len(unavailable) > 0 {
+			delivery.Pending = unavailable
+			delivery.NextTry = time.Now().Add(listRetryDelay << uint(delivery.Retry))
+			delivery.Retry++
+
+			if err := saveDelivery(delivery); err != nil {
+				log.Print(err.Error())
+			}
+		}
+	}
+
+	log.Printf("Sent %s from %s to %d members\n", email.Subject, list.Address,
+		delivery.Delivered)
+
+	if len(delivery.Failed) > 0 {
+		notifyOwners(list, email, delivery.Failed)
+	}
+
+	if err := os.Remove(deliveryPath(delivery.UUID)); err != nil {
+		log.Print(err.Error())
+	}
+}
+
+// notifyOwners tells the owners of a list which members couldn't be sent an
+// email of the list, and why
+func notifyOwners(list MailingList, email EMail, failed map[string]string) {
+	members := make([]string, 0, len(failed))
+	for member := range failed {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "The email %q sent to %s could not be delivered to:\n\n",
+		email.Subject, list.Address)
+	for _, member := range members {
+		fmt.Fprintf(&body, "%s: %s\n", member, failed[member])
+	}
+
+	for _, owner := range list.Owners {
+		notice := EMail{
+			From:    "MAILER-DAEMON@" + self.Name,
+			To:      owner,
+			Subject: "Undelivered email of " + list.Address + ": " + email.Subject,
+			Body:    body.String(),
+			Date:    time.Now(),
+			Headers: map[string]string{"Auto-Submitted": "auto-generated"},
+		}
+
+		var err error
+		if notice.UUID, err = uuid.NewUUID(); err != nil {
+			log.Print(err.Error())
+			return
+		}
+
+		status, reason, _, err := relay(notice, owner)
+		if err == nil && status > 299 {
+			err = fmt.Errorf("%d %s", status, reason)
+		}
+		if err != nil {
+			log.Printf("Could not tell %s about the members of %s not reached : %s\n",
+				owner, list.Address, err.Error())
+		}
+	}
+}
+
+// hold keeps an email to a moderated list until an owner approves it
+func hold(list MailingList, email EMail) error {
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return err
+	}
+
+	held := HeldEmail{id.String(), list.Address, email.From, email.Subject,
+		time.Now(), email}
+
+	heldJSON, err := json.Marshal(held)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(heldPath(held.UUID), heldJSON)
+}
+
+// readHeld reads an email waiting for the moderation of a list
+func readHeld(list string, id string) (HeldEmail, error) {
+	var held HeldEmail
+
+	if _, err := uuid.Parse(id); err != nil {
+		return held, os.ErrNotExist
+	}
+
+	data, err := ioutil.ReadFile(heldPath(id))
+	if err != nil {
+		return held, err
+	}
+
+	if err := json.Unmarshal(data, &held); err != nil {
+		return held, err
+	}
+
+	if !strings.EqualFold(held.List, list) {
+		return held, os.ErrNotExist
+	}
+
+	return held, nil
+}
+
+// postToList handles an email to a mailing list, and returns the status and
+// the reason sent back to the MTA of the sender
+func postToList(list MailingList, email EMail) (int, string) {
+	if hasLooped(list, email) {
+		// Accepted, so that the email isn't bounced or retried, but dropped
+		log.Printf("Dropped %s, it already went through %s\n", email.Subject,
+			list.Address)
+		return http.StatusOK, ""
+	}
+
+	if isBounce(email) {
+		log.Printf("Dropped the automatic email %s to %s\n", email.Subject,
+			list.Address)
+		return http.StatusOK, ""
+	}
+
+	sender, err := normalizeAddress(email.From)
+	if err != nil {
+		return http.StatusBadRequest, "invalid sender"
+	}
+
+	isOwner := contains(list.Owners, sender)
+
+	switch {
+	case list.Posting == postingMembers && !isOwner && !contains(list.Members, sender):
+		log.Printf("Refused %s from %s, not a member of %s\n", email.Subject,
+			sender, list.Address)
+		return http.StatusForbidden, "only the members of " + list.Address +
+			" can post to it"
+
+	case list.Posting == postingModerated && !isOwner:
+		if err := hold(list, email); err != nil {
+			log.Print(err.Error())
+			return http.StatusInternalServerError, ""
+		}
+
+		log.Printf("Held %s from %s for moderation in %s\n", email.Subject,
+			sender, list.Address)
+		return http.StatusAccepted, ""
+	}
+
+	delivery, err := queueDelivery(list, email)
+	if err != nil {
+		// Refused for now, the MTA of the sender tries again later
+		log.Print(err.Error())
+		return http.StatusServiceUnavailable, ""
+	}
+
+	go distribute(delivery)
+
+	return http.StatusOK, ""
+}
+
+// readListRequest unmarshals and validates the mailing list sent in the body
+// of a request
+func readListRequest(r *http.Request) (MailingList, error) {
+	var list MailingList
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return list, err
+	}
+
+	if err := json.Unmarshal(body, &list); err != nil {
+		return list, err
+	}
+
+	return list, list.validate()
+}
+
+// updateList applies a change to a mailing list and saves it, and sends the
+// list back
+func updateList(w http.ResponseWriter, address string, change func(list *MailingList) error) {
+	lists.mutex.Lock()
+	defer lists.mutex.Unlock()
+
+	key := strings.ToLower(address)
+
+	list, ok := lists.all[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := change(&list); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	all := make(map[string]MailingList)
+	for k, v := range lists.all {
+		all[k] = v
+	}
+	all[key] = list
+
+	if err := saveLists(all); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	lists.all = all
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// MTAListMailingLists lists the mailing lists of this domain
+func MTAListMailingLists(w http.ResponseWriter, r *http.Request) {
+	lists.mutex.RLock()
+	all := []MailingList{}
+	for _, list := range lists.all {
+		all = append(all, list)
+	}
+	lists.mutex.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Address < all[j].Address })
+
+	writeJSON(w, http.StatusOK, all)
+}
+
+// MTACreateMailingList creates a mailing list in the domain of this MTA
+func MTACreateMailingList(w http.ResponseWriter, r *http.Request) {
+	list, err := readListRequest(r)
+	if err == errListExists {
+		w.WriteHeader(http.StatusConflict)
+		log.Print(err.Error())
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	list.Created = time.Now()
+
+	lists.mutex.Lock()
+	defer lists.mutex.Unlock()
+
+	if _, ok := lists.all[list.Address]; ok {
+		w.WriteHeader(http.StatusConflict)
+		log.Println("Mailing list " + list.Address + " already exists")
+		return
+	}
+
+	all := map[string]MailingList{list.Address: list}
+	for k, v := range lists.all {
+		all[k] = v
+	}
+
+	if err := saveLists(all); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	lists.all = all
+
+	log.Println("Created the mailing list " + list.Address)
+	writeJSON(w, http.StatusCreated, list)
+}
+
+// MTAReadMailingList sends back a mailing list with its members
+func MTAReadMailingList(w http.ResponseWriter, r *http.Request) {
+	list, ok := findList(mux.Vars(r)["list"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+// MTAUpdateMailingList replaces the settings and the members of a mailing
+// list. Its address can't change
+func MTAUpdateMailingList(w http.ResponseWriter, r *http.Request) {
+	address := mux.Vars(r)["list"]
+
+	var update MailingList
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &update)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	// The aliases can't be looked up once the mailing lists are locked
+	update.Address = address
+	if err := update.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	updateList(w, address, func(list *MailingList) error {
+		update.Created = list.Created
+		*list = update
+		return nil
+	})
+}
+
+// MTADeleteMailingList deletes a mailing list, along with the emails waiting
+// for its moderation
+func MTADeleteMailingList(w http.ResponseWriter, r *http.Request) {
+	address := strings.ToLower(mux.Vars(r)["list"])
+
+	lists.mutex.Lock()
+	defer lists.mutex.Unlock()
+
+	if _, ok := lists.all[address]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	all := make(map[string]MailingList)
+	for k, v := range lists.all {
+		if k != address {
+			all[k] = v
+		}
+	}
+
+	if err := saveLists(all); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	lists.all = all
+
+	for _, held := range listHeld(address) {
+		if err := os.Remove(heldPath(held.UUID)); err != nil {
+			log.Print(err.Error())
+		}
+	}
+
+	log.Println("Deleted the mailing list " + address)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MTASubscribe adds an address to the members of a mailing list
+func MTASubscribe(w http.ResponseWriter, r *http.Request) {
+	var request SubscribeRequest
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &request)
+	}
+	if err == nil {
+		request.Address, err = normalizeAddress(request.Address)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Print(err.Error())
+		return
+	}
+
+	updateList(w, mux.Vars(r)["list"], func(list *MailingList) error {
+		if !contains(list.Members, request.Address) {
+			list.Members = append(append([]string{}, list.Members...), request.Address)
+			log.Println(request.Address + " subscribed to " + list.Address)
+		}
+		return nil
+	})
+}
+
+// unsubscribe removes an address from the members of a mailing list
+func unsubscribe(w http.ResponseWriter, list string, address string) {
+	updateList(w, list, func(list *MailingList) error {
+		members := []string{}
+		for _, member := range list.Members {
+			if !strings.EqualFold(member, address) {
+				members = append(members, member)
+			}
+		}
+
+		list.Members = members
+		log.Println(address + " unsubscribed from " + list.Address)
+		return nil
+	})
+}
+
+// MTAUnsubscribe removes the member given in the URL from a mailing list
+func MTAUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	unsubscribe(w, vars["list"], vars["member"])
+}
+
+// MTAUnsubscribeOneClick removes the member whose token is given in the
+// query from a mailing list, it is the List-Unsubscribe link of the emails of
+// the list (RFC 8058)
+func MTAUnsubscribeOneClick(w http.ResponseWriter, r *http.Request) {
+	token, err := hex.DecodeString(r.URL.Query().Get("token"))
+	if err != nil || len(token) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("Unsubscribe without a valid token")
+		return
+	}
+
+	list, ok := findList(mux.Vars(r)["list"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	for _, member := range list.Members {
+		expected, _ := hex.DecodeString(unsubscribeToken(list.Address, member))
+		if hmac.Equal(token, expected) {
+			unsubscribe(w, list.Address, member)
+			return
+		}
+	}
+
+	// Already unsubscribed, or a token of another list
+	w.WriteHeader(http.StatusNotFound)
+	log.Println("Unsubscribe from " + list.Address + " with an unknown token")
+}
+
+// listHeld reads the emails waiting for the moderation of a list, oldest
+// first
+func listHeld(address string) []HeldEmail {
+	files, err := ioutil.ReadDir(filepath.Join(LISTS, "held"))
+	if err != nil {
+		log.Print(err.Error())
+		return nil
+	}
+
+	held := []HeldEmail{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		email, err := readHeld(address, strings.TrimSuffix(file.Name(), ".json"))
+		if err == nil {
+			held = append(held, email)
+		} else if !os.IsNotExist(err) {
+			log.Print(err.Error())
+		}
+	}
+
+	sort.Slice(held, func(i, j int) bool { return held[i].Received.Before(held[j].Received) })
+
+	return held
+}
+
+// MTAListHeld lists the emails waiting for the moderation of a list
+func MTAListHeld(w http.ResponseWriter, r *http.Request) {
+	list, ok := findList(mux.Vars(r)["list"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, listHeld(list.Address))
+}
+
+// MTAApproveHeld sends an email waiting for moderation to the members of the
+// list
+func MTAApproveHeld(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	list, ok := findList(vars["list"])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// The email is saved for the members before it leaves the moderation. It
+	// is only sent by the approval which gets to remove it
+	var delivery ListDelivery
+
+	held, err := readHeld(list.Address, vars["uuid"])
+	if err == nil {
+		delivery, err = queueDelivery(list, held.Email)
+	}
+	if err == nil {
+		if err = os.Remove(heldPath(held.UUID)); err != nil {
+			os.Remove(deliveryPath(delivery.UUID))
+		}
+	}
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	go distribute(delivery)
+
+	log.Println("Approved " + held.Subject + " in " + list.Address)
+	w.WriteHeader(http.StatusOK)
+}
+
+// MTARejectHeld drops an email waiting for moderation
+func MTARejectHeld(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	held, err := readHeld(vars["list"], vars["uuid"])
+	if err == nil {
+		err = os.Remove(heldPath(held.UUID))
+	}
+	if os.IsNotExist(err) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Print(err.Error())
+		return
+	}
+
+	log.Println("Rejected " + held.Subject + " in " + held.List)
+	w.WriteHeader(http.StatusOK)
+}
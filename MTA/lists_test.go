@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testList is the mailing list of the tests, its owner isn't a member
+var testList = MailingList{
+	Address: "team@here.com",
+	Posting: postingOpen,
+	Owners:  []string{"boss@here.com"},
+	Members: []string{"bill@here.com", "tim@here.com"},
+}
+
+// useTestLists runs a test with the mailing lists stored in a temporary
+// directory, and the members of testList served by a local MSA which sends
+// back on received the address of each email it gets
+func useTestLists(t *testing.T) (received chan string) {
+	dir := t.TempDir()
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	loadLists()
+	lists.mutex.Lock()
+	lists.all[testList.Address] = testList
+	lists.mutex.Unlock()
+
+	received = make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var email EMail
+		json.NewDecoder(r.Body).Decode(&email)
+		received <- email.To
+	}))
+
+	previous := msa
+	msa = make(map[string]Server)
+	for _, member := range append(testList.Members, testList.Owners...) {
+		msa[member] = Server{Name: member, Address: server.URL + "/"}
+	}
+
+	t.Cleanup(func() {
+		server.Close()
+		msa = previous
+		os.Chdir(cwd)
+	})
+
+	return received
+}
+
+// receive waits for n emails to reach the MSA of the tests, and lists their
+// recipients
+func receive(t *testing.T, received chan string, n int) []string {
+	var recipients []string
+
+	for len(recipients) < n {
+		select {
+		case to := <-received:
+			recipients = append(recipients, to)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v, want %d emails", recipients, n)
+		}
+	}
+	sort.Strings(recipients)
+
+	return recipients
+}
+
+func TestHasLooped(t *testing.T) {
+	for _, test := range []struct {
+		loop string
+		want bool
+	}{
+		{"", false},
+		{"team@here.com", true},
+		{"TEAM@here.com", true},
+		{"dev@there.com, team@here.com", true},
+		{"dev@there.com,team@here.com", true},
+		{"dev@there.com", false},
+		{"steam@here.com", false},
+	} {
+		email := EMail{Headers: map[string]string{"X-Loop": test.loop}}
+		if got := hasLooped(testList, email); got != test.want {
+			t.Errorf("X-Loop %q: got %v, want %v", test.loop, got, test.want)
+		}
+	}
+}
+
+func TestPostToList(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		posting string
+		email   EMail
+		status  int
+		held    int
+	}{
+		{"open to anyone", postingOpen,
+			EMail{From: "steve@there.com"}, http.StatusOK, 0},
+		{"looped", postingOpen,
+			EMail{From: "steve@there.com", Headers: map[string]string{"X-Loop": "team@here.com"}},
+			http.StatusOK, 0},
+		{"automatic", postingOpen,
+			EMail{From: "steve@there.com", Headers: map[string]string{"Auto-Submitted": "auto-replied"}},
+			http.StatusOK, 0},
+		{"bounce", postingOpen,
+			EMail{From: "MAILER-DAEMON@there.com"}, http.StatusOK, 0},
+		{"invalid sender", postingOpen,
+			EMail{From: "steve"}, http.StatusBadRequest, 0},
+		{"members only, from a member", postingMembers,
+			EMail{From: "Bill <BILL@here.com>"}, http.StatusOK, 0},
+		{"members only, from the owner", postingMembers,
+			EMail{From: "boss@here.com"}, http.StatusOK, 0},
+		{"members only, from anyone", postingMembers,
+			EMail{From: "steve@there.com"}, http.StatusForbidden, 0},
+		{"moderated, from a member", postingModerated,
+			EMail{From: "bill@here.com"}, http.StatusAccepted, 1},
+		{"moderated, from the owner", postingModerated,
+			EMail{From: "boss@here.com"}, http.StatusOK, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			received := useTestLists(t)
+
+			list := testList
+			list.Posting = test.posting
+
+			status, _ := postToList(list, test.email)
+			if status != test.status {
+				t.Fatalf("got status %d, want %d", status, test.status)
+			}
+
+			if held := listHeld(list.Address); len(held) != test.held {
+				t.Errorf("got %d emails held, want %d", len(held), test.held)
+			}
+
+			// Only the emails accepted and not held reach the members, but
+			// their sender
+			var want []string
+			if status == http.StatusOK && test.email.Headers == nil &&
+				!isBounce(test.email) {
+				sender, _ := normalizeAddress(test.email.From)
+				for _, member := range list.Members {
+					if member != sender {
+						want = append(want, member)
+					}
+				}
+			}
+
+			got := receive(t, received, len(want))
+			if len(got) != len(want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("got %v, want %v", got, want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestResumeDeliveries(t *testing.T) {
+	received := useTestLists(t)
+
+	previous := listRetryDelay
+	listRetryDelay = 0
+	defer func() { listRetryDelay = previous }()
+
+	// The MTA stopped with one member left to try
+	delivery, err := queueDelivery(testList, EMail{From: "steve@there.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery.Pending = []string{"tim@here.com"}
+	delivery.Retry = 1
+	if err := saveDelivery(delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	resumeDeliveries()
+
+	if got := receive(t, received, 1); got[0] != "tim@here.com" {
+		t.Errorf("got %v, want tim@here.com", got)
+	}
+
+	// The delivery is dropped once done
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		files, _ := ioutil.ReadDir(filepath.Join(LISTS, "queue"))
+		if len(files) == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("got %d deliveries left", len(files))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUnsubscribeOneClick(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		list    string
+		token   func() string
+		status  int
+		members int
+	}{
+		{"member", "team@here.com",
+			func() string { return unsubscribeToken("team@here.com", "bill@here.com") },
+			http.StatusOK, 1},
+		{"case of the addresses", "TEAM@here.com",
+			func() string { return unsubscribeToken("Team@Here.com", "BILL@here.com") },
+			http.StatusOK, 1},
+		{"not a member", "team@here.com",
+			func() string { return unsubscribeToken("team@here.com", "steve@there.com") },
+			http.StatusNotFound, 2},
+		{"another list", "team@here.com",
+			func() string { return unsubscribeToken("dev@here.com", "bill@here.com") },
+			http.StatusNotFound, 2},
+		{"unknown list", "dev@here.com",
+			func() string { return unsubscribeToken("dev@here.com", "bill@here.com") },
+			http.StatusNotFound, 2},
+		{"no token", "team@here.com",
+			func() string { return "" },
+			http.StatusBadRequest, 2},
+		{"not hexadecimal", "team@here.com",
+			func() string { return "bill@here.com" },
+			http.StatusBadRequest, 2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			useTestLists(t)
+
+			// Signed with the secret made for the test
+			w := httptest.NewRecorder()
+			MTAUnsubscribeOneClick(w, mux.SetURLVars(
+				httptest.NewRequest("POST", "/lists/x/unsubscribe?token="+test.token(), nil),
+				map[string]string{"list": test.list}))
+
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+
+			list, _ := findList(testList.Address)
+			if len(list.Members) != test.members {
+				t.Errorf("got members %v, want %d", list.Members, test.members)
+			}
+		})
+	}
+}
@@ -12,20 +12,29 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	flag.IntVar(&maxHops, "max-hops", 50,
+		"maximum number of MTAs an email may go through before it is bounced")
+	flag.Parse()
+
 	msa = make(map[string]Server)
 
-	if len(os.Args) < 2 {
+	if flag.NArg() < 1 {
 		fmt.Println("To run the MTA service, please provide a domain name.")
 		fmt.Println("e.g 'go run mta.go domain.com'")
 		fmt.Println("or with Docker: 'docker run MSA-image domain.com'")
@@ -33,7 +42,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	self.Name = os.Args[1]
+	self.Name = flag.Arg(0)
 
 	// Register with the Bluebook service
 	self.Address = "http://" + GetOutboundIP() + ":8888/"
@@ -42,6 +51,11 @@ func main() {
 	// serving requests independently of whether the Blue Book works or not
 	go register(self)
 
+	// Host the mailing lists and the aliases of the domain
+	loadLists()
+	loadAliases()
+	resumeDeliveries()
+
 	// Start a gorountine to handle requests in background
 	go handleRequests()
 
@@ -64,8 +78,30 @@ func handleRequests() {
 	router := mux.NewRouter().StrictSlash(true)
 
 	router.HandleFunc("/email/server", MTAServe).Methods("POST")
+	router.HandleFunc("/email/server", MTALimits).Methods("GET")
 	router.HandleFunc("/email/server/register", AddMSA).Methods("POST")
 
+	// Alias methods
+	router.HandleFunc("/aliases", MTAListAliases).Methods("GET")
+	router.HandleFunc("/aliases", MTACreateAlias).Methods("POST")
+	router.HandleFunc("/aliases/catch-all", MTASetCatchAll).Methods("PUT")
+	router.HandleFunc("/aliases/{alias}", MTAReadAlias).Methods("GET")
+	router.HandleFunc("/aliases/{alias}", MTAUpdateAlias).Methods("PUT")
+	router.HandleFunc("/aliases/{alias}", MTADeleteAlias).Methods("DELETE")
+
+	// Mailing list methods
+	router.HandleFunc("/lists", MTAListMailingLists).Methods("GET")
+	router.HandleFunc("/lists", MTACreateMailingList).Methods("POST")
+	router.HandleFunc("/lists/{list}", MTAReadMailingList).Methods("GET")
+	router.HandleFunc("/lists/{list}", MTAUpdateMailingList).Methods("PUT")
+	router.HandleFunc("/lists/{list}", MTADeleteMailingList).Methods("DELETE")
+	router.HandleFunc("/lists/{list}/members", MTASubscribe).Methods("POST")
+	router.HandleFunc("/lists/{list}/members/{member}", MTAUnsubscribe).Methods("DELETE")
+	router.HandleFunc("/lists/{list}/unsubscribe", MTAUnsubscribeOneClick).Methods("POST")
+	router.HandleFunc("/lists/{list}/held", MTAListHeld).Methods("GET")
+	router.HandleFunc("/lists/{list}/held/{uuid}", MTARejectHeld).Methods("DELETE")
+	router.HandleFunc("/lists/{list}/held/{uuid}/approve", MTAApproveHeld).Methods("POST")
+
 	log.Fatal(http.ListenAndServe(":8888", router))
 }
 
@@ -97,16 +133,25 @@ func AddMSA(w http.ResponseWriter, r *http.Request) {
 }
 
 // MTAServe handles forwarding the email sent by other MTAs to this MTA, and
-// dispatching to the right MSAs
+// dispatching to the right MSAs. Emails larger than maxMessageSize are
+// refused, and the limit is advertised with every response. This MTA adds
+// its record to the trace of the email, and refuses it after maxHops MTAs
+// A refused email is answered with a DeliveryError telling the sending MTA why
 func MTAServe(w http.ResponseWriter, r *http.Request) {
 	var email EMail
 
-	body, err := ioutil.ReadAll(r.Body)
+	w.Header().Set("X-Max-Message-Size", strconv.Itoa(maxMessageSize))
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
 
 	// If we can't read the body, exit with error
 	if err != nil {
 		log.Println("Could not read body " + err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		writeDeliveryError(w, http.StatusServiceUnavailable, "", "could not read the email")
+		return
+	} else if len(body) > maxMessageSize {
+		log.Println("Refused an email larger than the limit")
+		writeDeliveryError(w, http.StatusRequestEntityTooLarge, "", "")
 		return
 	}
 
@@ -116,149 +161,279 @@ func MTAServe(w http.ResponseWriter, r *http.Request) {
 	// in formatting their request
 	if err != nil {
 		log.Println("Could not unmarshal email " + err.Error())
-		w.WriteHeader(http.StatusBadRequest)
+		writeDeliveryError(w, http.StatusBadRequest, "", "")
 		return
 	}
 
-	// Find the address of the MSA client
-	recipient := msa[email.To]
+	// The email is going round in circles, the sender gets a bounce with the
+	// trace showing the loop
+	addTrace(&email, remoteHost(r))
+	if tooManyHops(email) {
+		log.Printf("Refused an email to %s after %d hops\n", email.To,
+			len(email.Received))
+		writeDeliveryError(w, http.StatusLoopDetected, email.To,
+			fmt.Sprintf("too many hops (%d)", len(email.Received)))
+		return
+	}
 
-	// Re-marshal the email
-	emailJSON, err := json.Marshal(email)
+	// Find the mailboxes, mailing lists and forwarding addresses the
+	// recipient stands for. A recipient which doesn't exist is refused for
+	// good, for the sender to get a bounce
+	targets, err := resolveRecipient(email.To)
+	if err != nil {
+		log.Println("No recipient " + email.To + " in " + self.Name)
+		writeDeliveryError(w, http.StatusNotFound, email.To, "no such user")
+		return
+	}
 
-	// Forward to the MSA
-	resp, err := http.Post(recipient.Address+"email/outbox", "application/json",
-		bytes.NewReader(emailJSON))
+	// The email is accepted as soon as one of them accepts it. Otherwise the
+	// error is forwarded to the MTA, a full mailbox included, along with the
+	// reason given
+	status, reason := 0, ""
+	for _, target := range targets {
+		targetStatus, targetReason := dispatch(email, email.To, target)
 
-	if resp.StatusCode >= 200 && resp.StatusCode <= 299 && err == nil {
-		w.WriteHeader(http.StatusOK)
-		log.Printf("Delivered email %s to %s", email.Subject, email.To)
-	} else if (resp.StatusCode < 200 || resp.StatusCode > 299) && err != nil {
-		// forward the error to the MTA
-		w.WriteHeader(resp.StatusCode)
-		log.Print("Couldn't dispatch : " + resp.Status)
-	} else if err != nil {
-		// error occured while dispatching, tell the MTA
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Print(err.Error())
+		if status == 0 || (status > 299 && targetStatus <= 299) {
+			status, reason = targetStatus, targetReason
+		}
+	}
+
+	if status > 299 {
+		writeDeliveryError(w, status, email.To, reason)
+		return
 	}
 
+	w.WriteHeader(status)
 }
 
 // MTAScanAndSend scans all the outboxes on the server and sends all the emails
+// which are due. The outboxes are listed page by page, in summary, and each
+// email is only read when it is sent, so that the emails scheduled for later
+// and their attachments aren't read over and over
 func MTAScanAndSend() {
-	var destServer Server
-
-	var folder Folder
-
 	// iterate over all the MSAs registered with this MTA
 	for _, msaObj := range msa {
 		log.Print("Scan and serve: " + msaObj.Address + " (" + msaObj.Name + ")")
-		responseMSA, err := http.Get(msaObj.Address + "email/outbox")
-
-		// couldn't get the mail from this outbox... log and move on to the next
-		if responseMSA.StatusCode > 299 && err != nil {
-			// MSA busy or down, log and move on
-			log.Print("Couldn't reach MSA : " + responseMSA.Status)
-			continue
-		} else if err != nil {
-			// error occured, log and move on to the next
-			log.Print(err.Error())
-			continue
-		}
 
-		bodyMSA, err := ioutil.ReadAll(responseMSA.Body)
+		sent, cursor := 0, ""
+		for {
+			folder, err := readOutbox(msaObj.Address, cursor)
+			if err != nil {
+				// MSA busy or down, log and move on to the next
+				log.Print(err.Error())
+				break
+			}
+
+			for _, summary := range folder.Emails {
+				// The email is scheduled for later, or can still be cancelled
+				if summary.SendAt.After(time.Now()) {
+					continue
+				}
+
+				email, err := readOutboxEmail(msaObj.Address, summary.UUID)
+				if err != nil {
+					// The email may have been cancelled since, it is read again
+					// at the next "scan and serve" otherwise
+					log.Print(err.Error())
+					continue
+				}
+
+				sendOutboxEmail(msaObj, email)
+				sent++
+			}
 
-		// couldn't get the mail from this outbox... log and move on to the next
-		if err != nil {
-			log.Print(err.Error())
-			continue
+			if folder.Next == "" {
+				break
+			}
+			cursor = folder.Next
 		}
 
-		err = json.Unmarshal(bodyMSA, &folder)
+		log.Printf("Found %d emails to send !\n", sent)
+	}
+}
 
-		// could not unmarshal the mail from this outbox... assuming that the MSA
-		// handled all emails being well formed, this is an error of the unmarshal
-		// so log and move on, it should be read at the next "scan and serve"
-		if err != nil {
-			log.Print(err.Error())
-			continue
-		}
+// readOutbox reads a page of the summaries of the outbox of an MSA, oldest
+// emails first so that they don't wait behind the newer ones
+func readOutbox(address string, cursor string) (Folder, error) {
+	var folder Folder
 
-		log.Printf("Found %d emails !\n", len(folder.Emails))
-
-		// Process each email in the folder
-		for _, email := range folder.Emails {
-			log.Println("Sending " + email.Subject)
-
-			// Ask the bluebook who this email should go to
-			blueBookRequest := "http://192.168.1.3:8888/bluebook/" + email.To
-			blueBookResponse, err := http.Get(blueBookRequest)
-
-			address := msa[email.From].Address
-
-			if blueBookResponse.StatusCode == 400 {
-				// Bad request, delete the offending email and move on to the next
-				deleteEmail(address, email)
-				continue
-			} else if blueBookResponse.StatusCode > 299 {
-				// Default behaviour is: if we couldn't contact the BlueBook,
-				// or the domain does not exist, then just leave the message in the
-				// inbox
-				log.Println("Error while sending the request to the BlueBook ",
-					blueBookResponse.Status)
-				continue
-			} else if err != nil {
-				log.Println(err.Error())
-				continue
-			}
+	query := url.Values{"order": {"asc"}, "summary": {"true"}}
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
 
-			// Read the reponse and unmarshal into a Server struct
-			blueBookBody, err := ioutil.ReadAll(blueBookResponse.Body)
+	resp, err := http.Get(address + "email/outbox?" + query.Encode())
+	if err != nil {
+		return folder, err
+	}
+	defer resp.Body.Close()
 
-			if err != nil {
-				log.Println("Could not read BlueBook response " + err.Error())
-				return
-			}
+	if resp.StatusCode > 299 {
+		return folder, errors.New("couldn't reach MSA : " + resp.Status)
+	}
 
-			err = json.Unmarshal(blueBookBody, &destServer)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &folder)
+	}
 
-			if err != nil {
-				log.Println("Could not unmarshal BlueBook response " + err.Error())
-				return
-			}
+	return folder, err
+}
 
-			// format the  EMail struct into a JSON object, reading for sending
-			emailJSON, err := json.Marshal(email)
+// readOutboxEmail reads an email of the outbox of an MSA
+func readOutboxEmail(address string, id string) (EMail, error) {
+	var email EMail
 
-			if err != nil {
-				log.Println("Could not marshal email " + err.Error())
-				return
-			}
+	resp, err := http.Get(address + "email/outbox/" + url.PathEscape(id))
+	if err != nil {
+		return email, err
+	}
+	defer resp.Body.Close()
 
-			serverPath := destServer.Address + "email" + "/server"
+	if resp.StatusCode > 299 {
+		return email, errors.New("couldn't read email " + id + " : " + resp.Status)
+	}
 
-			// Finally, POST the email to the correct MTA !
-			respMTA, err := http.Post(serverPath, "application/json",
-				bytes.NewReader(emailJSON))
+	body, err := ioutil.ReadAll(resp.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &email)
+	}
 
-			// Here we deal with the reponse from the desintation
-			// If it is unavailable, or there was an error with the request itself,
-			// leave the email in the outbox and deal with it later. For any other
-			// error, or if everything went okay, delete the email from the MSA's
-			// outbox
-			if err != nil {
-				log.Print(err.Error())
-			} else if respMTA.StatusCode >= 500 && respMTA.StatusCode <= 599 {
-				// the MTA is currently unavailable, exit here and come back later
-				log.Print("Destination MTA unavailable " + respMTA.Status +
-					", retry later")
-				return
-			} else {
-				deleteEmail(address, email)
-			}
+	return email, err
+}
+
+// sendOutboxEmail sends an email of the outbox of an MSA on to the MTA of its
+// recipient, and tells the MSA how it went
+func sendOutboxEmail(msaObj Server, email EMail) {
+	var destServer Server
+
+	log.Println("Sending " + email.Subject)
+
+	// The email is in the outbox of this MSA, whoever it claims to be
+	// from
+	address := msaObj.Address
+
+	// An email redirected over and over by the mailboxes is bounced
+	// before it goes any further
+	addTrace(&email, msaObj.Name)
+	if tooManyHops(email) {
+		reason := bounceReasons[http.StatusLoopDetected]
+		reportStatus(address, email, statusBounced, reason, "")
+		bounce(address, email, reason)
+		deleteEmail(address, email)
+		return
+	}
+
+	// Ask the bluebook who this email should go to
+	blueBookRequest := "http://192.168.1.3:8888/bluebook/" + email.To
+	blueBookResponse, err := http.Get(blueBookRequest)
+
+	if err != nil {
+		// The BlueBook can't be reached, try again later
+		log.Println(err.Error())
+		reportStatus(address, email, statusDeferred,
+			"directory unavailable", "")
+		return
+	}
+
+	// Read the reponse and unmarshal into a Server struct
+	blueBookBody, err := ioutil.ReadAll(blueBookResponse.Body)
+	blueBookResponse.Body.Close()
+
+	if blueBookResponse.StatusCode == 400 {
+		// Bad request, delete the offending email and move on to the next
+		reportStatus(address, email, statusFailed,
+			"invalid destination address", "")
+		deleteEmail(address, email)
+		return
+	} else if blueBookResponse.StatusCode > 299 {
+		// Default behaviour is: if we couldn't contact the BlueBook,
+		// or the domain does not exist, then just leave the message in the
+		// inbox
+		log.Println("Error while sending the request to the BlueBook ",
+			blueBookResponse.Status)
+		reportStatus(address, email, statusDeferred,
+			"destination domain not found: "+blueBookResponse.Status, "")
+		return
+	}
+
+	if err != nil {
+		log.Println("Could not read BlueBook response " + err.Error())
+		return
+	}
+
+	err = json.Unmarshal(blueBookBody, &destServer)
+
+	if err != nil {
+		log.Println("Could not unmarshal BlueBook response " + err.Error())
+		return
+	}
+
+	// format the  EMail struct into a JSON object, reading for sending
+	emailJSON, err := json.Marshal(email)
+
+	if err != nil {
+		log.Println("Could not marshal email " + err.Error())
+		return
+	}
+
+	serverPath := destServer.Address + "email" + "/server"
+
+	reportStatus(address, email, statusAttempting, "", destServer.Name)
+
+	// Finally, POST the email to the correct MTA !
+	respMTA, err := http.Post(serverPath, "application/json",
+		bytes.NewReader(emailJSON))
+
+	// Here we deal with the reponse from the desintation
+	// If it is unavailable, as its DeliveryError or its status says, or
+	// there was an error with the request itself, leave the email in the
+	// outbox and deal with it later. If everything went okay, the MSA
+	// moves the email to its Sent folder. If the recipient doesn't exist,
+	// the email is too large or the mailbox of the recipient is full, the
+	// sender gets a bounce, as when the recipient refuses it. For any
+	// other error, delete the email from the MSA's outbox
+	reason, bounced, message, temporary := "", false, "", false
+	if err == nil {
+		message, temporary = refusal(respMTA)
+		respMTA.Body.Close()
+
+		reason, bounced = bounceReasons[respMTA.StatusCode]
+		if bounced && message != "" {
+			reason += " (" + message + ")"
 		}
 	}
+
+	// The MSA of the sender is told about each outcome
+	if err != nil {
+		log.Print(err.Error())
+		reportStatus(address, email, statusDeferred, err.Error(),
+			destServer.Name)
+	} else if temporary && respMTA.StatusCode > 299 {
+		// the destination is currently unavailable, leave the email for
+		// later and move on to the next
+		log.Print("Destination MTA unavailable " + respMTA.Status +
+			", retry later")
+		if message == "" {
+			message = "destination MTA unavailable: " + respMTA.Status
+		}
+		reportStatus(address, email, statusDeferred, message, destServer.Name)
+		return
+	} else if bounced {
+		reportStatus(address, email, statusBounced, reason, destServer.Name)
+		bounce(address, email, reason)
+		deleteEmail(address, email)
+	} else if respMTA.StatusCode >= 200 && respMTA.StatusCode <= 299 {
+		reportStatus(address, email, statusDelivered, "", destServer.Name)
+		sentEmail(address, email)
+	} else {
+		if message == "" {
+			message = respMTA.Status
+		}
+		reportStatus(address, email, statusFailed,
+			"refused by the destination: "+message, destServer.Name)
+		deleteEmail(address, email)
+	}
 }
 
 func deleteEmail(address string, email EMail) {
@@ -274,14 +449,37 @@ func deleteEmail(address string, email EMail) {
 		return
 	}
 
+	// The MSA records the email as failed, not as cancelled by the user
+	deleteReq.Header.Set("X-MTA", self.Name)
+
 	resp, err := client.Do(deleteReq)
 
-	if (resp.StatusCode > 299) && err == nil {
-		// the MTA is currently unavailable, exit here and come back later
-		log.Print("Could not delete email " + resp.Status + ", retry later")
+	if err != nil {
+		log.Print(err.Error())
 		return
-	} else if err != nil {
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		// the MSA is currently unavailable, the email is tried again later
+		log.Print("Could not delete email " + resp.Status + ", retry later")
+	}
+
+}
+
+// sentEmail tells the MSA an email of its outbox was delivered, so that it can
+// move it to the Sent folder
+func sentEmail(address string, email EMail) {
+	resp, err := http.Post(address+"email/outbox/"+email.UUID.String()+"/sent",
+		"application/json", nil)
+
+	if err != nil {
 		log.Print(err.Error())
+		return
 	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode > 299 {
+		log.Print("Could not move email to Sent " + resp.Status)
+	}
 }
@@ -0,0 +1,58 @@
+/*
+status.go reports the delivery status of the emails to their MSAs
+Each attempt to deliver an email of an outbox, and its outcome, is POSTed to
+the MSA of the sender, which keeps the history for the sender to read
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Delivery statuses of the emails of the outboxes
+const (
+	statusAttempting = "attempting"
+	statusDeferred   = "deferred"
+	statusDelivered  = "delivered"
+	statusBounced    = "bounced"
+	statusFailed     = "failed"
+)
+
+// DeliveryStatus struct representing a step of the delivery of an email.
+// Server is the MTA the email was handed to
+type DeliveryStatus struct {
+	Status string
+	Reason string `json:",omitempty"`
+	Server string `json:",omitempty"`
+	Date   time.Time
+}
+
+// reportStatus tells the MSA at address what happened to an email of its
+// outbox. The report is only informative, the delivery goes on if it fails
+func reportStatus(address string, email EMail, status string, reason string,
+	server string) {
+
+	statusJSON, err := json.Marshal(DeliveryStatus{status, reason, server, time.Now()})
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+
+	resp, err := http.Post(address+"email/outbox/"+email.UUID.String()+"/status",
+		"application/json", bytes.NewReader(statusJSON))
+
+	if err != nil {
+		log.Print(err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		log.Print("Could not report the delivery status " + resp.Status)
+	}
+}
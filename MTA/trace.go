@@ -0,0 +1,67 @@
+/*
+trace.go keeps the trace of the MTAs an email goes through
+Each MTA adds a Received record on top of the trace of an email when it takes
+the email in, from the outbox of one of its MSAs or from another MTA. An
+email with more records than maxHops is going round in circles between
+forwarding addresses, and is refused instead of being sent on again
+*/
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxHops is the maximum number of MTAs an email may go through, set with
+// the -max-hops flag
+var maxHops = 50
+
+// traceRecord writes the Received record of this MTA for an email taken in
+// from a client, an MSA or another MTA
+func traceRecord(email EMail, from string, date time.Time) string {
+	id := email.MessageID
+	if id == "" {
+		id = "<" + email.UUID.String() + ">"
+	}
+
+	return "from " + from + " by " + self.Name + " with HTTP id " + id +
+		" for <" + email.To + ">; " + date.Format(time.RFC1123Z)
+}
+
+// addTrace adds the record of this MTA on top of the trace of an email. The
+// trace is copied, the email may still share it with other copies
+func addTrace(email *EMail, from string) {
+	received := make([]string, 0, len(email.Received)+1)
+	received = append(received, traceRecord(*email, from, time.Now()))
+	email.Received = append(received, email.Received...)
+}
+
+// tooManyHops tells whether an email went through more MTAs than allowed
+func tooManyHops(email EMail) bool {
+	return len(email.Received) > maxHops
+}
+
+// trace writes the trace of an email as Received headers, to be quoted in a
+// bounce
+func trace(email EMail) string {
+	var lines strings.Builder
+
+	for _, received := range email.Received {
+		lines.WriteString("Received: " + received + "\n")
+	}
+
+	return lines.String()
+}
+
+// remoteHost is the host another MTA sends a request from
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
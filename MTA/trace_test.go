@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// hops returns the trace of an email which went through n MTAs
+func hops(n int) []string {
+	received := make([]string, n)
+	for i := range received {
+		received[i] = "from 192.168.1.5 by there.com with HTTP id <1@there.com>"
+	}
+
+	return received
+}
+
+func TestTooManyHops(t *testing.T) {
+	previous := maxHops
+	maxHops = 3
+	defer func() { maxHops = previous }()
+
+	for _, test := range []struct {
+		hops int
+		want bool
+	}{
+		{0, false},
+		{1, false},
+		{3, false},
+		{4, true},
+		{10, true},
+	} {
+		if got := tooManyHops(EMail{Received: hops(test.hops)}); got != test.want {
+			t.Errorf("%d hops: got %v, want %v", test.hops, got, test.want)
+		}
+	}
+}
+
+func TestAddTrace(t *testing.T) {
+	previous := self.Name
+	self.Name = "here.com"
+	defer func() { self.Name = previous }()
+
+	email := EMail{MessageID: "<1@there.com>", To: "bill@here.com", Received: hops(2)}
+	shared := email.Received
+
+	addTrace(&email, "192.168.1.7")
+
+	if len(email.Received) != 3 {
+		t.Fatalf("got %d records, want 3", len(email.Received))
+	}
+	if want := "from 192.168.1.7 by here.com with HTTP id <1@there.com> for <bill@here.com>; "; !strings.HasPrefix(email.Received[0], want) {
+		t.Errorf("got %q, want the record of this MTA first", email.Received[0])
+	}
+	if len(shared) != 2 || shared[0] != hops(1)[0] {
+		t.Errorf("the trace shared with the other copies changed to %v", shared)
+	}
+}
+
+func TestServeTooManyHops(t *testing.T) {
+	previous := maxHops
+	maxHops = 3
+	defer func() { maxHops = previous }()
+
+	// The record of this MTA makes one hop too many
+	emailJSON, _ := json.Marshal(EMail{To: "bill@here.com", Received: hops(3)})
+
+	w := httptest.NewRecorder()
+	MTAServe(w, httptest.NewRequest("POST", "/email/server", bytes.NewReader(emailJSON)))
+
+	if w.Code != http.StatusLoopDetected {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusLoopDetected)
+	}
+
+	var deliveryError DeliveryError
+	if err := json.Unmarshal(w.Body.Bytes(), &deliveryError); err != nil ||
+		deliveryError.Code != "too-many-hops" || deliveryError.Temporary {
+		t.Errorf("got %s, want a permanent too-many-hops error", w.Body.String())
+	}
+}
@@ -12,13 +12,40 @@ import (
 	"github.com/google/uuid"
 )
 
-// EMail struct representing an email
+// EMail struct representing an email. The MessageID identifies the email
+// across all the mailboxes, InReplyTo and References list the Message-IDs of
+// the emails it replies to, the closest one last
+// The Body is the text/plain version of the email, HTML its text/html
+// alternative if there is one. Headers holds any other header of the email
+// Received is the trace of the MTAs the email went through, the latest first
+// An email of an outbox isn't sent before its SendAt time
 type EMail struct {
-	UUID    uuid.UUID
-	From    string
-	To      string
-	Subject string
-	Body    string
+	UUID        uuid.UUID
+	MessageID   string   `json:",omitempty"`
+	InReplyTo   string   `json:",omitempty"`
+	References  []string `json:",omitempty"`
+	From        string
+	To          string
+	Subject     string
+	Body        string
+	HTML        string       `json:",omitempty"`
+	Attachments []Attachment `json:",omitempty"`
+	Date        time.Time
+	SendAt      time.Time
+	Headers     map[string]string `json:",omitempty"`
+	Received    []string          `json:",omitempty"`
+}
+
+// Attachment struct representing a file attached to an email. The content is
+// carried base64 encoded in the JSON of the email, the TransferEncoding is
+// the one used when the email is written in the MIME format
+type Attachment struct {
+	ID               string
+	Filename         string
+	ContentType      string
+	TransferEncoding string
+	Size             int
+	Data             []byte `json:",omitempty"`
 }
 
 // Server struct representing an MTA server
@@ -27,9 +54,18 @@ type Server struct {
 	Address string
 }
 
-// Folder struct representing a folder of email (inbox or outbox)
+// Folder struct representing a page of a folder of email (inbox or outbox),
+// in summary. Next is the cursor of the next page, if any
 type Folder struct {
-	Emails []EMail
+	Emails []Summary
+	Next   string
+}
+
+// Summary struct representing an email of a folder, without its content
+type Summary struct {
+	UUID    string
+	Subject string
+	SendAt  time.Time
 }
 
 // MSA clients registered with this MTA server